@@ -3,8 +3,11 @@
 package common
 
 import (
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -15,12 +18,15 @@ const (
 	RegistryAPILoc = "/registry"
 	DataAPILoc     = "/data"
 	// Query parameters
-	ParamPage    = "page"
-	ParamPerPage = "perPage"
-	ParamLimit   = "limit"
-	ParamFrom    = "from"
-	ParamTo      = "to"
-	ParamSort    = "sort"
+	ParamPage     = "page"
+	ParamPerPage  = "perPage"
+	ParamLimit    = "limit"
+	ParamFrom     = "from"
+	ParamTo       = "to"
+	ParamSort     = "sort"
+	ParamAggr     = "aggr"
+	ParamInterval = "interval"
+	ParamCursor   = "cursor"
 	// Values for ParamSort
 	ASC  = "asc"  // ascending
 	DESC = "desc" // descending
@@ -44,9 +50,16 @@ var (
 	// supported type values
 	supportedTypes = []string{STRING, BOOL, FLOAT, DATA}
 	// supported aggregates
-	supportedAggregates = []string{"mean", "stddev", "sum", "min", "max", "median"}
+	supportedAggregates = []string{"mean", "stddev", "sum", "min", "max", "median", "count"}
 	// supported period suffixes
 	supportedPeriods = []string{"m", "h", "d", "w"}
+	// durations of the period suffixes
+	periodUnits = map[string]time.Duration{
+		"m": time.Minute,
+		"h": time.Hour,
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
 )
 
 func SetVersion(version string) {
@@ -69,6 +82,50 @@ func SupportedPeriod(p string) bool {
 	return re.MatchString(p)
 }
 
+// ParsePeriod converts a supported period (e.g. 15m or 2w) to a duration
+func ParsePeriod(p string) (time.Duration, error) {
+	if p == "" || !SupportedPeriod(p) {
+		return 0, fmt.Errorf("invalid period: %s. Supported period suffixes are: %s", p, strings.Join(supportedPeriods, ", "))
+	}
+	n := 1
+	if len(p) > 1 {
+		var err error
+		n, err = strconv.Atoi(p[:len(p)-1])
+		if err != nil || n == 0 {
+			return 0, fmt.Errorf("invalid period: %s", p)
+		}
+	}
+	return time.Duration(n) * periodUnits[p[len(p)-1:]], nil
+}
+
+// FormatPeriod converts a duration to a period with the largest possible unit
+func FormatPeriod(d time.Duration) string {
+	for _, suffix := range []string{"w", "d", "h", "m"} {
+		if d >= periodUnits[suffix] && d%periodUnits[suffix] == 0 {
+			return fmt.Sprintf("%d%s", d/periodUnits[suffix], suffix)
+		}
+	}
+	return d.String()
+}
+
+// ParseFunction parses the function of a derived data stream, which is either an aggregate over
+// a period (e.g. mean(15m) or max(1h)) or diff. The period is zero for diff.
+func ParseFunction(f string) (string, time.Duration, error) {
+	if f == "diff" {
+		return f, 0, nil
+	}
+	matches := regexp.MustCompile(`^([a-z]+)\((.*)\)$`).FindStringSubmatch(f)
+	if matches == nil || !SupportedAggregate(matches[1]) {
+		return "", 0, fmt.Errorf("invalid function: %s. Supported functions are diff and %s with a period, e.g. mean(15m)",
+			f, strings.Join(supportedAggregates, ", "))
+	}
+	period, err := ParsePeriod(matches[2])
+	if err != nil {
+		return "", 0, err
+	}
+	return matches[1], period, nil
+}
+
 // SupportedPeriods returns supported periods
 func SupportedPeriods() []string {
 	var periods []string
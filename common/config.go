@@ -21,8 +21,12 @@ type Config struct {
 	Aggr AggrConf `json:"aggregation"`
 	// LinkSmart Service Catalog registration config
 	ServiceCatalog *ServiceCatalogConf `json:"serviceCatalog"`
+	// Replication of data streams to a remote Historical Datastore
+	Replication ReplicationConf `json:"replication"`
 	// Auth config
 	Auth ValidatorConf `json:"auth"`
+	// ShutdownTimeout is the maximum duration of a graceful shutdown in seconds (default 30)
+	ShutdownTimeout uint `json:"shutdownTimeout"`
 }
 
 // HTTP config
@@ -30,6 +34,17 @@ type HTTPConf struct {
 	PublicEndpoint string `json:"publicEndpoint"`
 	BindAddr       string `json:"bindAddr"`
 	BindPort       uint16 `json:"bindPort"`
+	// TLS enables HTTPS when set
+	TLS *HTTPTLSConf `json:"tls"`
+}
+
+// HTTPS config
+// The certificate, key and client CAs are reloaded from the files on SIGHUP
+type HTTPTLSConf struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// ClientCAFile enables mutual TLS, requiring client certificates which are signed by one of the CAs
+	ClientCAFile string `json:"clientCAFile"`
 }
 
 // Web GUI Config
@@ -62,9 +77,46 @@ type RegBackendConf struct {
 // Data config
 type DataConf struct {
 	Backend DataBackendConf `json:"backend"`
+	// Dir is the directory of the local files, e.g. of dead letters and MQTT sessions
+	// It defaults to the directory of the senmlstore file, or to ./data for other backends
+	Dir string `json:"dir"`
 	// RetentionPeriods is deprecated, will be removed from v0.6.0. Use registry.retentionPeriods instead.
 	RetentionPeriods []string `json:"retentionPeriods"`
 	AutoRegistration bool     `json:"autoRegistration"`
+	// DeadLetter configures the store of rejected submissions
+	DeadLetter DeadLetterConf `json:"deadLetter"`
+	// Batch configures the queue which writes the submissions in batches
+	Batch BatchConf `json:"batch"`
+	// WAL configures the write-ahead log of the submissions
+	WAL WALConf `json:"wal"`
+}
+
+// Ingest queue config
+type BatchConf struct {
+	// Enabled queues the submissions to write them to the storage in batches
+	Enabled bool `json:"enabled"`
+	// MaxSize is the number of records after which a batch is written (default 1000)
+	MaxSize int `json:"maxSize"`
+	// MaxLatency is the time in milliseconds a submission waits for others to be written with (default 50)
+	MaxLatency int `json:"maxLatency"`
+	// QueueSize is the number of queued records, after which submissions are rejected or held off (default 10000)
+	QueueSize int `json:"queueSize"`
+}
+
+// Write-ahead log config
+type WALConf struct {
+	// Enabled logs the submissions to a file before acknowledging them, to write them after a crash
+	Enabled bool `json:"enabled"`
+	// Sync is when the log is flushed to the disk: none, batch (the concurrent submissions at once) or every (default batch)
+	Sync string `json:"sync"`
+	// SegmentSize is the size in bytes after which the log continues in a new file (default 16777216)
+	SegmentSize int `json:"segmentSize"`
+}
+
+// Dead letter store config
+type DeadLetterConf struct {
+	// MaxEntries is the number of kept submissions, after which the oldest ones are removed (default 10000)
+	MaxEntries int `json:"maxEntries"`
 }
 
 // Data backend config
@@ -84,6 +136,31 @@ type ServiceCatalogConf struct {
 	Auth     *ObtainerConf `json:"auth"`
 }
 
+// Replication config
+type ReplicationConf struct {
+	// Enabled forwards the data of the selected data streams to the remote Historical Datastore
+	Enabled bool `json:"enabled"`
+	// Endpoint is the URL of the remote Historical Datastore, e.g. https://hds.example.com
+	Endpoint string `json:"endpoint"`
+	// Streams are patterns of the names of the replicated data streams, e.g. factory/* (default all)
+	Streams []string `json:"streams"`
+	// Filters select the replicated data streams by their registrations, e.g. by meta.site equals factory
+	Filters []FilterConf `json:"filters"`
+	// Interval is the time in seconds between forwarding the new data (default 10)
+	Interval int `json:"interval"`
+	// BatchSize is the number of records forwarded per request (default 1000)
+	BatchSize int `json:"batchSize"`
+	// Auth obtains the tickets for the remote Historical Datastore
+	Auth *ObtainerConf `json:"auth"`
+}
+
+// Registry filter config, as in the registry filter API
+type FilterConf struct {
+	Path  string `json:"path"`
+	Op    string `json:"op"`
+	Value string `json:"value"`
+}
+
 // Ticket Validator Config
 type ValidatorConf struct {
 	// Auth switch
@@ -98,6 +175,8 @@ type ValidatorConf struct {
 	BasicEnabled bool `json:"basicEnabled"`
 	// Authorization config
 	Authz *authz.Conf `json:"authorization"`
+	// ExemptMetrics allows unauthenticated access to the metrics endpoint
+	ExemptMetrics bool `json:"exemptMetrics"`
 }
 
 func (c ValidatorConf) Validate() error {
@@ -0,0 +1,191 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	datastore "github.com/dschowta/senml.datastore"
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+)
+
+// Accumulator incrementally calculates the aggregates of a sequence of values
+type Accumulator struct {
+	count    int
+	sum      float64
+	min      float64
+	max      float64
+	mean     float64
+	m2       float64   // sum of squared differences from the mean
+	values   []float64 // kept only for the median
+	keepVals bool
+}
+
+// NewAccumulator returns an accumulator for the given aggregates
+func NewAccumulator(aggregates []string) *Accumulator {
+	a := &Accumulator{}
+	for _, aggr := range aggregates {
+		if aggr == "median" {
+			a.keepVals = true
+		}
+	}
+	return a
+}
+
+// Add adds a value to the accumulator
+func (a *Accumulator) Add(v float64) {
+	a.count++
+	a.sum += v
+	if a.count == 1 || v < a.min {
+		a.min = v
+	}
+	if a.count == 1 || v > a.max {
+		a.max = v
+	}
+	// Welford's online algorithm for the variance
+	delta := v - a.mean
+	a.mean += delta / float64(a.count)
+	a.m2 += delta * (v - a.mean)
+	if a.keepVals {
+		a.values = append(a.values, v)
+	}
+}
+
+// Count returns the number of accumulated values
+func (a *Accumulator) Count() int {
+	return a.count
+}
+
+// Result returns the value of the given aggregate
+func (a *Accumulator) Result(aggregate string) float64 {
+	switch aggregate {
+	case "mean":
+		return a.mean
+	case "sum":
+		return a.sum
+	case "min":
+		return a.min
+	case "max":
+		return a.max
+	case "count":
+		return float64(a.count)
+	case "stddev": // sample standard deviation
+		if a.count < 2 {
+			return 0
+		}
+		return math.Sqrt(a.m2 / float64(a.count-1))
+	case "median":
+		if len(a.values) == 0 {
+			return 0
+		}
+		sorted := make([]float64, len(a.values))
+		copy(sorted, a.values)
+		sort.Float64s(sorted)
+		middle := len(sorted) / 2
+		if len(sorted)%2 == 0 {
+			return (sorted[middle-1] + sorted[middle]) / 2
+		}
+		return sorted[middle]
+	}
+	return math.NaN()
+}
+
+// AggregateName returns the name of aggregated records of a series
+func AggregateName(series, aggregate string) string {
+	return fmt.Sprintf("%s/%s", series, aggregate)
+}
+
+// aggregationWindow returns the first and last intervals covered by a page of the query, as well as
+// the time to continue with in the next page. The earliest and latest are the times of the oldest and newest
+// data points in the queried series and avoid paging through empty intervals.
+func aggregationWindow(q Query, earliest, latest time.Time, intervals int) (first, last time.Time, next *time.Time) {
+	from, to := q.From, q.To
+	if from.Before(earliest) {
+		from = earliest
+	}
+	if to.After(latest) {
+		to = latest
+	}
+	lower, upper := from.Truncate(q.Interval), to.Truncate(q.Interval)
+
+	if q.Sort == common.ASC {
+		first = lower
+		last = first.Add(time.Duration(intervals-1) * q.Interval)
+		if !last.Before(upper) {
+			return first, upper, nil
+		}
+		n := last.Add(q.Interval)
+		return first, last, &n
+	}
+
+	last = upper
+	first = last.Add(-time.Duration(intervals-1) * q.Interval)
+	if !first.After(lower) {
+		return lower, last, nil
+	}
+	n := first.Add(-time.Nanosecond)
+	return first, last, &n
+}
+
+// aggregateRecords calculates the aggregates for every interval between first and last (inclusive)
+// The records must be sorted in ascending order. The channel is drained completely.
+func aggregateRecords(records <-chan senml.Record, series string, aggregates []string, interval time.Duration, first, last time.Time) senml.Pack {
+	var (
+		pack   senml.Pack
+		acc    *Accumulator
+		bucket time.Time
+		unit   string
+	)
+	flush := func() {
+		if acc == nil || acc.Count() == 0 {
+			return
+		}
+		for _, aggr := range aggregates {
+			v := acc.Result(aggr)
+			r := senml.Record{
+				Name:  AggregateName(series, aggr),
+				Unit:  unit,
+				Time:  datastore.ToSenmlTime(bucket),
+				Value: &v,
+			}
+			if aggr == "count" {
+				r.Unit = ""
+			}
+			pack = append(pack, r)
+		}
+	}
+
+	for r := range records {
+		if r.Value == nil {
+			continue
+		}
+		b := datastore.FromSenmlTime(r.Time).Truncate(interval)
+		if b.Before(first) || b.After(last) {
+			continue
+		}
+		if acc == nil || !b.Equal(bucket) {
+			flush()
+			acc = NewAccumulator(aggregates)
+			bucket = b
+			unit = r.Unit
+		}
+		acc.Add(*r.Value)
+	}
+	flush()
+
+	return pack
+}
+
+// sortRecords sorts records by time, keeping the order of records with equal time
+func sortRecords(pack senml.Pack, order string) {
+	sort.SliceStable(pack, func(i, j int) bool {
+		if order == common.ASC {
+			return pack[i].Time < pack[j].Time
+		}
+		return pack[i].Time > pack[j].Time
+	})
+}
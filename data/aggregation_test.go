@@ -0,0 +1,113 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+func TestAccumulator(t *testing.T) {
+	acc := NewAccumulator([]string{"median"})
+	for _, v := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		acc.Add(v)
+	}
+
+	expected := map[string]float64{
+		"mean":   5,
+		"sum":    40,
+		"min":    2,
+		"max":    9,
+		"count":  8,
+		"median": 4.5,
+		"stddev": math.Sqrt(32.0 / 7),
+	}
+	for aggr, value := range expected {
+		if math.Abs(acc.Result(aggr)-value) > 1e-9 {
+			t.Errorf("Expected %s to be %v, got %v", aggr, value, acc.Result(aggr))
+		}
+	}
+}
+
+func TestLightdbAggregation(t *testing.T) {
+	fileName := os.TempDir() + "/TestLightdbAggregation"
+	deleteFile(fileName)
+	defer deleteFile(fileName)
+	storage, disconnect, err := NewSenmlStorage(common.DataConf{Backend: common.DataBackendConf{Type: SENMLSTORE, DSN: fileName}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disconnect()
+
+	ds := &registry.DataStream{Name: "aggr/test", Type: common.FLOAT}
+	if err := storage.CreateHandler(*ds); err != nil {
+		t.Fatal(err)
+	}
+
+	// one value per minute over one hour: 0, 1, ..., 59
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	var pack senml.Pack
+	for i := 0; i < 60; i++ {
+		v := float64(i)
+		pack = append(pack, senml.Record{Name: ds.Name, Value: &v, Time: float64(start.Add(time.Duration(i) * time.Minute).Unix())})
+	}
+	err = storage.Submit(map[string]senml.Pack{ds.Name: pack}, map[string]*registry.DataStream{ds.Name: ds})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := Query{
+		To:         start.Add(2 * time.Hour),
+		Sort:       common.ASC,
+		Limit:      -1,
+		perPage:    3,
+		Aggregates: []string{"mean", "count"},
+		Interval:   15 * time.Minute,
+	}
+	res, total, next, err := storage.Query(q, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || len(res) != 6 {
+		t.Fatalf("Expected 3 intervals with 6 records, got %d intervals with %d records", total, len(res))
+	}
+	if res[0].Name != AggregateName(ds.Name, "mean") || *res[0].Value != 7 || *res[1].Value != 15 {
+		t.Errorf("Unexpected first interval: %v=%v, %v=%v", res[0].Name, *res[0].Value, res[1].Name, *res[1].Value)
+	}
+	if next.uniform() == nil || !next.uniform().Equal(start.Add(45*time.Minute)) {
+		t.Fatalf("Expected next page at %v, got %v", start.Add(45*time.Minute), next)
+	}
+
+	// the last page
+	q.From = *next.uniform()
+	res, _, next, err = storage.Query(q, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || *res[0].Value != 52 {
+		t.Errorf("Unexpected last page: %v", res)
+	}
+	if next != nil {
+		t.Errorf("Unexpected next page after the last interval: %v", next)
+	}
+
+	// descending order starts with the latest interval
+	q.From = time.Time{}
+	q.Sort = common.DESC
+	res, _, next, err = storage.Query(q, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 6 || res[0].Time != float64(start.Add(45*time.Minute).Unix()) || *res[0].Value != 52 {
+		t.Errorf("Unexpected descending page: %v", res)
+	}
+	if next.uniform() == nil || !next.uniform().Equal(start.Add(15*time.Minute-time.Nanosecond)) {
+		t.Errorf("Expected next page to end before %v, got %v", start.Add(15*time.Minute), next)
+	}
+}
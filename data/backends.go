@@ -0,0 +1,207 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	datastore "github.com/dschowta/senml.datastore"
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// BackendFactory creates a storage for the data configuration, along with a function to disconnect from it
+type BackendFactory func(conf common.DataConf) (Storage, func() error, error)
+
+var (
+	backendsLock sync.RWMutex
+	backends     = make(map[string]BackendFactory)
+)
+
+// RegisterBackend makes a storage backend available by the given type name, replacing any other with the same name
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	backends[strings.ToLower(name)] = factory
+}
+
+// NewStorage creates the storage of the configured backend type
+func NewStorage(conf common.DataConf) (Storage, func() error, error) {
+	backendsLock.RLock()
+	factory, found := backends[strings.ToLower(conf.Backend.Type)]
+	backendsLock.RUnlock()
+	if !found {
+		return nil, nil, fmt.Errorf("unsupported data backend: %s", conf.Backend.Type)
+	}
+	return factory(conf)
+}
+
+// seriesQuery queries up to max data points of a series within a time range (inclusive) in the given order,
+// returning the time of the next data point if there are more. A non-positive max means no limit.
+type seriesQuery func(ds *registry.DataStream, from, to time.Time, order string, max int) (senml.Pack, *time.Time, error)
+
+// queryPages queries a full page from every series and merges them. The next entry of a series is either the first
+// one which didn't make it into the merged page or the one following its own page.
+func queryPages(q Query, sources []*registry.DataStream, query seriesQuery) (senml.Pack, int, Cursor, error) {
+	//TODO: Is this a right place to decide the maxentries? Should be at API level
+	maxEntries := q.perPage
+	if q.Limit > 0 && (maxEntries <= 0 || maxEntries > q.Limit) { //if limit is provided by the user and it is less than perPage, then use the limit
+		maxEntries = q.Limit
+	}
+	if maxEntries <= 0 {
+		maxEntries = -1 // no limit
+	}
+
+	packs := make([]senml.Pack, len(sources))
+	nextEntries := make(Cursor, len(sources))
+	for i, ds := range sources {
+		from, to := q.From, q.To
+		if q.Cursor != nil {
+			if q.Cursor[i] == nil { // no more entries in this series
+				continue
+			}
+			if q.Sort == common.DESC {
+				to = *q.Cursor[i]
+			} else {
+				from = *q.Cursor[i]
+			}
+		}
+
+		pack, next, err := query(ds, from, to, q.Sort, maxEntries)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		packs[i] = pack
+		nextEntries[i] = next
+	}
+
+	retPack, taken := mergePacks(packs, q.Sort, maxEntries)
+	for i, pack := range packs {
+		if taken[i] < len(pack) {
+			t := datastore.FromSenmlTime(pack[taken[i]].Time)
+			nextEntries[i] = &t
+		}
+	}
+	if !nextEntries.more() {
+		nextEntries = nil
+	}
+
+	return retPack, len(retPack), nextEntries, nil
+}
+
+// mergePacks merges the sorted packs into one with up to max entries, returning the number of entries taken from each
+// Entries with equal time are ordered by the index of their packs. A non-positive max means no limit.
+func mergePacks(packs []senml.Pack, order string, max int) (senml.Pack, []int) {
+	taken := make([]int, len(packs))
+	merged := senml.Pack{}
+	for max <= 0 || len(merged) < max {
+		selected := -1
+		for i, pack := range packs {
+			if taken[i] == len(pack) {
+				continue
+			}
+			if selected == -1 {
+				selected = i
+				continue
+			}
+			t, selectedT := pack[taken[i]].Time, packs[selected][taken[selected]].Time
+			if order == common.DESC && t > selectedT || order != common.DESC && t < selectedT {
+				selected = i
+			}
+		}
+		if selected == -1 {
+			break
+		}
+		merged = append(merged, packs[selected][taken[selected]])
+		taken[selected]++
+	}
+	return merged, taken
+}
+
+// aggregatePages calculates the aggregates for a page of intervals from the data points of the series
+func aggregatePages(q Query, sources []*registry.DataStream, query seriesQuery) (senml.Pack, int, Cursor, error) {
+	intervals := q.perPage
+	if q.Limit > 0 && q.Limit < intervals {
+		intervals = q.Limit
+	}
+
+	// Find the oldest and newest data points to avoid paging through empty intervals
+	var earliest, latest *time.Time
+	for _, ds := range sources {
+		for _, sort := range []string{common.ASC, common.DESC} {
+			pack, _, err := query(ds, q.From, q.To, sort, 1)
+			if err != nil {
+				return nil, 0, nil, err
+			}
+			if len(pack) == 0 {
+				break
+			}
+			t := datastore.FromSenmlTime(pack[0].Time)
+			if earliest == nil || t.Before(*earliest) {
+				earliest = &t
+			}
+			if latest == nil || t.After(*latest) {
+				latest = &t
+			}
+		}
+	}
+	if earliest == nil {
+		return senml.Pack{}, 0, nil, nil
+	}
+
+	first, last, next := aggregationWindow(q, *earliest, *latest, intervals)
+	from, to := first, last.Add(q.Interval-time.Nanosecond)
+	if from.Before(q.From) {
+		from = q.From
+	}
+	if to.After(q.To) {
+		to = q.To
+	}
+
+	var aggrPack senml.Pack
+	for _, ds := range sources {
+		records := make(chan senml.Record, 10)
+		errCh := make(chan error, 1)
+		go func(ds *registry.DataStream) {
+			defer close(records)
+			for start := from; ; {
+				pack, next, err := query(ds, start, to, common.ASC, MaxPerPage)
+				if err != nil {
+					errCh <- err
+					return
+				}
+				for _, r := range pack {
+					records <- r
+				}
+				if next == nil {
+					errCh <- nil
+					return
+				}
+				start = *next
+			}
+		}(ds)
+		aggrPack = append(aggrPack, aggregateRecords(records, ds.Name, q.Aggregates, q.Interval, first, last)...)
+		if err := <-errCh; err != nil {
+			return nil, 0, nil, err
+		}
+	}
+	sortRecords(aggrPack, q.Sort)
+
+	total := 0
+	if !last.Before(first) {
+		total = int(last.Sub(first)/q.Interval) + 1
+	}
+	// all series continue from the same interval
+	var cursor Cursor
+	if next != nil {
+		cursor = make(Cursor, len(sources))
+		for i := range cursor {
+			cursor[i] = next
+		}
+	}
+	return aggrPack, total, cursor, nil
+}
@@ -0,0 +1,31 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestBackends(t *testing.T) {
+	for _, backend := range []string{SENMLSTORE, MEMORY, INFLUXDB} {
+		if !SupportedBackends(backend) {
+			t.Errorf("Backend %s is not registered", backend)
+		}
+	}
+	// the postgres backends are registered along with their driver
+	driver := false
+	for _, name := range sql.Drivers() {
+		if name == postgresDriver {
+			driver = true
+		}
+	}
+	for _, backend := range []string{POSTGRES, TIMESCALEDB} {
+		if SupportedBackends(backend) != driver {
+			t.Errorf("Backend %s is registered: %t, with the driver: %t", backend, SupportedBackends(backend), driver)
+		}
+	}
+	if SupportedBackends(MONGODB) {
+		t.Errorf("Backend %s is registered", MONGODB)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+const (
+	backupRegistryFile = "registry.json"
+	backupDataDir      = "data"
+)
+
+// SnapshotStorage is a storage which provides consistent snapshots of its data
+type SnapshotStorage interface {
+	Storage
+	// Snapshot calls f with a storage of the data at the time of the call, which is not affected by later changes
+	Snapshot(f func(snapshot Storage) error) error
+}
+
+// WriteBackup writes a gzipped tar archive of the registry, optionally including the sensitive information,
+// and a snapshot of the data of the registered data streams
+// The data is archived in pages of SenML JSON packs
+func WriteBackup(w io.Writer, reg registry.Storage, storage SnapshotStorage, sensitive bool) error {
+	// the registry is read before the snapshot, as it notifies the storage while locked
+	regJSON, err := registry.Export(reg, sensitive)
+	if err != nil {
+		return err
+	}
+	var dataStreams []registry.DataStream
+	err = json.Unmarshal(regJSON, &dataStreams)
+	if err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err = writeTarFile(tw, backupRegistryFile, regJSON)
+	if err != nil {
+		return err
+	}
+
+	files := 0
+	err = storage.Snapshot(func(snapshot Storage) error {
+		for i := range dataStreams {
+			// the far future within the nanosecond range of the storage
+			to := time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)
+			q := Query{From: time.Unix(0, 0), To: to, Sort: common.ASC, Limit: -1, perPage: MaxPerPage}
+			for {
+				pack, _, cursor, err := snapshot.Query(q, &dataStreams[i])
+				if err != nil {
+					return fmt.Errorf("error querying %s: %v", dataStreams[i].Name, err)
+				}
+				if len(pack) > 0 {
+					b, err := pack.Encode(senml.JSON, senml.OutputOptions{})
+					if err != nil {
+						return err
+					}
+					files++
+					err = writeTarFile(tw, fmt.Sprintf("%s/%08d.json", backupDataDir, files), b)
+					if err != nil {
+						return err
+					}
+				}
+				if cursor == nil {
+					break
+				}
+				q.Cursor = cursor
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, b []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(b)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(b)
+	return err
+}
+
+// RestoreBackup imports the registry and submits the data of an archive written by WriteBackup
+// The existing data streams are kept, while the data points with the same time are overwritten
+func RestoreBackup(r io.Reader, reg registry.Storage, storage Storage) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("error reading archive: %v", err)
+	}
+	tr := tar.NewReader(gr)
+
+	restored, skipped := 0, 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading archive: %v", err)
+		}
+
+		if header.Name == backupRegistryFile {
+			var dataStreams []registry.DataStream
+			err = json.NewDecoder(tr).Decode(&dataStreams)
+			if err != nil {
+				return fmt.Errorf("error decoding registry: %v", err)
+			}
+			result, err := registry.Import(reg, dataStreams, registry.ImportSkip)
+			if err != nil {
+				return fmt.Errorf("error importing registry: %v", err)
+			}
+			for name, reason := range result.Failed {
+				log.Printf("Restore: Error importing %s: %s", name, reason)
+			}
+			log.Printf("Restore: Imported %d and skipped %d existing data streams", len(result.Created), len(result.Skipped))
+			continue
+		}
+
+		var pack senml.Pack
+		err = json.NewDecoder(tr).Decode(&pack)
+		if err != nil {
+			return fmt.Errorf("error decoding %s: %v", header.Name, err)
+		}
+		data := make(map[string]senml.Pack)
+		sources := make(map[string]*registry.DataStream)
+		unknown := make(map[string]bool)
+		for _, r := range pack {
+			if _, found := sources[r.Name]; !found && !unknown[r.Name] {
+				ds, err := reg.Get(r.Name)
+				if err != nil {
+					// e.g. the data stream failed to be imported
+					unknown[r.Name] = true
+				} else {
+					sources[r.Name] = ds
+				}
+			}
+			if unknown[r.Name] {
+				skipped++
+				continue
+			}
+			data[r.Name] = append(data[r.Name], r)
+		}
+		if len(data) == 0 {
+			continue
+		}
+		err = storage.Submit(data, sources)
+		if err != nil {
+			return fmt.Errorf("error submitting %s: %v", header.Name, err)
+		}
+		for _, records := range data {
+			restored += len(records)
+		}
+	}
+	log.Printf("Restore: Restored %d data points and skipped %d of unknown data streams", restored, skipped)
+	return nil
+}
+
+// BackupAPI serves the backups of the registry and data
+type BackupAPI struct {
+	registry registry.Storage
+	storage  SnapshotStorage
+	// include the sensitive information, as in the export of the registry API
+	sensitive bool
+}
+
+func NewBackupAPI(registry registry.Storage, storage SnapshotStorage, sensitive bool) *BackupAPI {
+	return &BackupAPI{
+		registry:  registry,
+		storage:   storage,
+		sensitive: sensitive,
+	}
+}
+
+// Backup is a handler for downloading a backup archive
+func (api *BackupAPI) Backup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="hds-backup-%s.tar.gz"`, time.Now().UTC().Format("20060102T150405Z")))
+
+	bw := &backupWriter{w: w}
+	err := WriteBackup(bw, api.registry, api.storage, api.sensitive)
+	if err != nil {
+		log.Printf("Error writing backup: %s", err)
+		// a partially written archive is left incomplete, failing its extraction
+		if !bw.written {
+			common.ErrorResponse(http.StatusInternalServerError, "Error writing backup: "+err.Error(), w)
+		}
+	}
+}
+
+// backupWriter records whether any part of the archive is written, which sends the status of the response
+type backupWriter struct {
+	w       io.Writer
+	written bool
+}
+
+func (bw *backupWriter) Write(p []byte) (int, error) {
+	bw.written = true
+	return bw.w.Write(p)
+}
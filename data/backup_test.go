@@ -0,0 +1,200 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+func TestBackupRestore(t *testing.T) {
+	fileName := os.TempDir() + "/TestBackup"
+	deleteFile(fileName)
+	defer deleteFile(fileName)
+	storage, disconnect, err := NewSenmlStorage(common.DataConf{Backend: common.DataBackendConf{Type: SENMLSTORE, DSN: fileName}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disconnect()
+	reg := registry.NewMemoryStorage(common.RegConf{}, storage)
+	ds, err := reg.Add(registry.DataStream{Name: "backup/sensor", Type: common.FLOAT})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// more than a page
+	total := MaxPerPage + 10
+	pack := make(senml.Pack, total)
+	now := time.Now().Unix()
+	for i := range pack {
+		v := float64(i)
+		pack[i] = senml.Record{Name: ds.Name, Value: &v, Time: float64(now - int64(i))}
+	}
+	err = storage.Submit(map[string]senml.Pack{ds.Name: pack}, map[string]*registry.DataStream{ds.Name: ds})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the storage is not held off while the snapshot is read
+	q := Query{From: time.Unix(now-int64(total), 0), To: time.Unix(now+1, 0), Sort: common.ASC, Limit: -1}
+	err = storage.Snapshot(func(snapshot Storage) error {
+		v := -1.0
+		submitted := make(chan error, 1)
+		go func() {
+			submitted <- storage.Submit(map[string]senml.Pack{ds.Name: {{Name: ds.Name, Value: &v, Time: float64(now + 1)}}},
+				map[string]*registry.DataStream{ds.Name: ds})
+		}()
+		select {
+		case err := <-submitted:
+			if err != nil {
+				return err
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Submission is blocked by the snapshot")
+		}
+		_, n, _, err := snapshot.Query(q, ds)
+		if err != nil {
+			return err
+		}
+		if n != total {
+			t.Errorf("Expected %d data points in the snapshot, got %d", total, n)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Delete([]*registry.DataStream{ds}, time.Unix(now+1, 0), time.Unix(now+1, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err := WriteBackup(&archive, reg, storage, true); err != nil {
+		t.Fatal(err)
+	}
+
+	restoredFile := os.TempDir() + "/TestRestore"
+	deleteFile(restoredFile)
+	defer deleteFile(restoredFile)
+	restoredStorage, disconnectRestored, err := NewSenmlStorage(common.DataConf{Backend: common.DataBackendConf{Type: SENMLSTORE, DSN: restoredFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disconnectRestored()
+	restoredReg := registry.NewMemoryStorage(common.RegConf{}, restoredStorage)
+	if err := RestoreBackup(&archive, restoredReg, restoredStorage); err != nil {
+		t.Fatal(err)
+	}
+
+	restoredDS, err := restoredReg.Get(ds.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, _, _, err := restoredStorage.Query(q, restoredDS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != total || *restored[total-1].Value != 0 {
+		t.Fatalf("Expected %d restored data points, got %d", total, len(restored))
+	}
+}
+
+func TestBackupSensitive(t *testing.T) {
+	fileName := os.TempDir() + "/TestBackupSensitive"
+	deleteFile(fileName)
+	defer deleteFile(fileName)
+	storage, disconnect, err := NewSenmlStorage(common.DataConf{Backend: common.DataBackendConf{Type: SENMLSTORE, DSN: fileName}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disconnect()
+	reg := registry.NewMemoryStorage(common.RegConf{}, storage)
+	ds := registry.DataStream{Name: "backup/mqtt", Type: common.FLOAT}
+	ds.Source.SrcType = registry.MqttType
+	ds.Source.MQTTSource = &registry.MQTTSource{BrokerURL: "tcp://localhost:1883", Topic: "sensor", Username: "hds", Password: "secret"}
+	if _, err := reg.Add(ds); err != nil {
+		t.Fatal(err)
+	}
+
+	// returns the registry of the archive
+	backup := func(sensitive bool) string {
+		var archive bytes.Buffer
+		if err := WriteBackup(&archive, reg, storage, sensitive); err != nil {
+			t.Fatal(err)
+		}
+		gr, err := gzip.NewReader(&archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(gr)
+		for {
+			header, err := tr.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Name == backupRegistryFile {
+				b, err := ioutil.ReadAll(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return string(b)
+			}
+		}
+	}
+	if regJSON := backup(false); strings.Contains(regJSON, "secret") {
+		t.Errorf("Expected the password to be masked, got %s", regJSON)
+	}
+	if regJSON := backup(true); !strings.Contains(regJSON, "secret") {
+		t.Errorf("Expected the password to be included, got %s", regJSON)
+	}
+}
+
+// failingSnapshotStorage fails to take snapshots
+type failingSnapshotStorage struct {
+	Storage
+}
+
+func (s *failingSnapshotStorage) Snapshot(f func(snapshot Storage) error) error {
+	return fmt.Errorf("snapshot failed")
+}
+
+func TestBackupAPIIncomplete(t *testing.T) {
+	memory, _, err := NewMemoryStorage(common.DataConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := registry.NewMemoryStorage(common.RegConf{}, memory)
+	if _, err := reg.Add(registry.DataStream{Name: "backup/incomplete", Type: common.FLOAT}); err != nil {
+		t.Fatal(err)
+	}
+	api := NewBackupAPI(reg, &failingSnapshotStorage{memory}, false)
+	w := httptest.NewRecorder()
+	api.Backup(w, httptest.NewRequest("GET", "/backup", nil))
+
+	// the archive is sent with the status, and left incomplete instead of followed by an error
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/gzip" {
+		t.Fatalf("Expected the archive to be sent, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte("snapshot failed")) {
+		t.Fatalf("Expected no error response after the archive, got %q", w.Body.Bytes())
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(gr); err == nil {
+		t.Fatal("Expected the incomplete archive to fail extraction")
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+const (
+	defaultBatchSize    = 1000  // records
+	defaultBatchLatency = 50    // milliseconds
+	defaultBatchQueue   = 10000 // records
+)
+
+var (
+	// ErrQueueFull is returned by the submissions which are not queued because the queue is full
+	ErrQueueFull = errors.New("the ingest queue is full")
+	// ErrQueueClosed is returned by the submissions after the queue is closed
+	ErrQueueClosed = errors.New("the ingest queue is closed")
+)
+
+// batchEntry is a queued submission
+type batchEntry struct {
+	data    map[string]senml.Pack
+	sources map[string]*registry.DataStream
+	records int
+	queued  time.Time
+	// flush marks the end of the submissions which are waited for by a flush
+	flush bool
+	// done is called with the result of writing the batch which includes the submission
+	done func(error)
+}
+
+// BatchStorage queues the submissions and writes them to the underlying storage in batches
+// A batch is written when it has the maximum number of records, or when its first submission
+// has waited for the maximum latency. The submissions of a batch are merged into one, which
+// lets the storage write them in a single transaction. When writing a batch fails, its submissions
+// are written one by one to find the failing ones if the storage is an AtomicStorage, and fail otherwise.
+type BatchStorage struct {
+	Storage
+	maxSize    int
+	maxLatency time.Duration
+	queueSize  int
+
+	sync.Mutex
+	pending []*batchEntry
+	queued  int // records
+	// flushing is the number of waiting flushes, which write the pending submissions at once
+	flushing int
+	// space is closed when records are taken off the queue
+	space  chan struct{}
+	signal chan struct{}
+	closed bool
+	// stopped is closed when the writer has written all submissions after the queue is closed
+	stopped chan struct{}
+}
+
+// NewBatchStorage starts writing the queued submissions to the storage
+func NewBatchStorage(storage Storage, conf common.BatchConf) *BatchStorage {
+	b := &BatchStorage{
+		Storage:    storage,
+		maxSize:    conf.MaxSize,
+		maxLatency: time.Duration(conf.MaxLatency) * time.Millisecond,
+		queueSize:  conf.QueueSize,
+		space:      make(chan struct{}),
+		signal:     make(chan struct{}, 1),
+		stopped:    make(chan struct{}),
+	}
+	if b.maxSize <= 0 {
+		b.maxSize = defaultBatchSize
+	}
+	if b.maxLatency <= 0 {
+		b.maxLatency = defaultBatchLatency * time.Millisecond
+	}
+	if b.queueSize <= 0 {
+		b.queueSize = defaultBatchQueue
+	}
+	go b.run()
+	return b
+}
+
+// Submit queues the data and waits until it is written
+// ErrQueueFull is returned at once when the queue is full.
+func (b *BatchStorage) Submit(data map[string]senml.Pack, sources map[string]*registry.DataStream) error {
+	done := make(chan error, 1)
+	err := b.Enqueue(data, sources, func(err error) { done <- err }, false)
+	if err != nil {
+		return err
+	}
+	return <-done
+}
+
+// Enqueue queues the data and calls done with the result of writing it
+// While the queue is full, it either blocks or returns ErrQueueFull.
+func (b *BatchStorage) Enqueue(data map[string]senml.Pack, sources map[string]*registry.DataStream, done func(error), block bool) error {
+	entry := &batchEntry{data: data, sources: sources, done: done, queued: time.Now()}
+	for _, pack := range data {
+		entry.records += len(pack)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	// a submission which is larger than the queue is accepted when the queue is empty
+	for !b.closed && b.queued > 0 && b.queued+entry.records > b.queueSize {
+		if !block {
+			return ErrQueueFull
+		}
+		space := b.space
+		b.Unlock()
+		<-space
+		b.Lock()
+	}
+	if b.closed {
+		return ErrQueueClosed
+	}
+	b.pending = append(b.pending, entry)
+	b.queued += entry.records
+	b.wake()
+	return nil
+}
+
+// wake signals the writer to check the queue
+func (b *BatchStorage) wake() {
+	select {
+	case b.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Flush waits until the submissions which are queued before the call are written
+func (b *BatchStorage) Flush() {
+	done := make(chan struct{})
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		<-b.stopped
+		return
+	}
+	b.flushing++
+	b.pending = append(b.pending, &batchEntry{flush: true, done: func(error) { close(done) }, queued: time.Now()})
+	b.wake()
+	b.Unlock()
+	<-done
+}
+
+// Queued returns the number of queued records
+func (b *BatchStorage) Queued() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.queued
+}
+
+// Close writes the queued submissions and stops the writer
+// The submissions after closing are rejected with ErrQueueClosed.
+func (b *BatchStorage) Close() {
+	b.Lock()
+	b.closed = true
+	// release the blocked submissions
+	close(b.space)
+	b.space = make(chan struct{})
+	b.wake()
+	b.Unlock()
+	<-b.stopped
+}
+
+func (b *BatchStorage) run() {
+	defer close(b.stopped)
+	timer := time.NewTimer(b.maxLatency)
+	for {
+		batch := b.next(timer)
+		if batch == nil {
+			return
+		}
+		b.write(batch)
+	}
+}
+
+// next waits for the next batch, which is nil when the queue is closed and empty
+func (b *BatchStorage) next(timer *time.Timer) []*batchEntry {
+	b.Lock()
+	defer b.Unlock()
+	for len(b.pending) == 0 {
+		if b.closed {
+			return nil
+		}
+		b.Unlock()
+		<-b.signal
+		b.Lock()
+	}
+	for b.queued < b.maxSize && b.flushing == 0 && !b.closed {
+		wait := b.maxLatency - time.Since(b.pending[0].queued)
+		if wait <= 0 {
+			break
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		b.Unlock()
+		select {
+		case <-b.signal:
+		case <-timer.C:
+		}
+		b.Lock()
+	}
+
+	// take whole submissions up to the maximum size, but at least one
+	n, records := 0, 0
+	for n < len(b.pending) && (n == 0 || records+b.pending[n].records <= b.maxSize) {
+		if b.pending[n].flush {
+			b.flushing--
+		}
+		records += b.pending[n].records
+		n++
+	}
+	batch := b.pending[:n:n]
+	b.pending = b.pending[n:]
+	b.queued -= records
+	close(b.space)
+	b.space = make(chan struct{})
+	return batch
+}
+
+// write submits the batch as one and passes the result to the submissions
+func (b *BatchStorage) write(batch []*batchEntry) {
+	data := make(map[string]senml.Pack)
+	sources := make(map[string]*registry.DataStream)
+	submissions, records := 0, 0
+	for _, entry := range batch {
+		if entry.flush {
+			continue
+		}
+		for name, pack := range entry.data {
+			data[name] = append(data[name], pack...)
+			sources[name] = entry.sources[name]
+		}
+		submissions++
+		records += entry.records
+	}
+
+	var err error
+	if submissions > 0 {
+		err = b.Storage.Submit(data, sources)
+		batchRecords.Observe(float64(records))
+	}
+	if err != nil && submissions > 1 && IsAtomic(b.Storage) {
+		// find the failing submissions by writing them one by one, as none of them is stored
+		// Otherwise, writing them again would repeat the effects of the stored data, e.g. the derived data and events.
+		log.Printf("Batch: Error writing %d submissions at once, writing them separately: %s", submissions, err)
+		for _, entry := range batch {
+			if entry.flush {
+				entry.done(nil)
+				continue
+			}
+			entry.done(b.Storage.Submit(entry.data, entry.sources))
+		}
+		return
+	}
+	for _, entry := range batch {
+		if entry.flush {
+			entry.done(nil)
+			continue
+		}
+		entry.done(err)
+	}
+}
+
+// Delete deletes the data points after writing the queued submissions
+func (b *BatchStorage) Delete(sources []*registry.DataStream, from time.Time, to time.Time) (int, error) {
+	b.Flush()
+	return b.Storage.Delete(sources, from, to)
+}
+
+// DeleteHandler handles deletion of a data source after writing the queued submissions
+func (b *BatchStorage) DeleteHandler(ds registry.DataStream) error {
+	b.Flush()
+	return b.Storage.DeleteHandler(ds)
+}
+
+// QueryStream streams the query results of the underlying storage
+func (b *BatchStorage) QueryStream(q Query, ds *registry.DataStream, send func(senml.Record) error) error {
+	return QueryStream(b.Storage, q, ds, send)
+}
+
+// submitWaiting submits the data to an AsyncStorage waiting for space in its queue, instead of failing when it is full
+func submitWaiting(storage Storage, data map[string]senml.Pack, sources map[string]*registry.DataStream) error {
+	async, ok := storage.(AsyncStorage)
+	if !ok {
+		return storage.Submit(data, sources)
+	}
+	done := make(chan error, 1)
+	err := async.Enqueue(data, sources, func(err error) { done <- err }, true)
+	if err != nil {
+		return err
+	}
+	return <-done
+}
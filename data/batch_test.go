@@ -0,0 +1,264 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/gorilla/mux"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// gatedStorage records the sizes of the submissions, which wait for the gate to be opened
+type gatedStorage struct {
+	Storage
+	sync.Mutex
+	gate  chan struct{}
+	sizes []int
+}
+
+func (s *gatedStorage) Submit(data map[string]senml.Pack, sources map[string]*registry.DataStream) error {
+	<-s.gate
+	records := 0
+	for name, pack := range data {
+		if name == "batch/bad" {
+			return fmt.Errorf("rejected %s", name)
+		}
+		records += len(pack)
+	}
+	s.Lock()
+	s.sizes = append(s.sizes, records)
+	s.Unlock()
+	return s.Storage.Submit(data, sources)
+}
+
+// Atomic returns true, as the failing submissions are rejected before storing any data
+func (s *gatedStorage) Atomic() bool {
+	return true
+}
+
+func newGatedStorage(t *testing.T, open bool) *gatedStorage {
+	memory, _, err := NewMemoryStorage(common.DataConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &gatedStorage{Storage: memory, gate: make(chan struct{})}
+	if open {
+		close(s.gate)
+	}
+	return s
+}
+
+// records returns a submission of n records of the data stream
+func records(ds *registry.DataStream, offset, n int) (map[string]senml.Pack, map[string]*registry.DataStream) {
+	var pack senml.Pack
+	for i := offset; i < offset+n; i++ {
+		v := float64(i)
+		pack = append(pack, senml.Record{Name: ds.Name, Value: &v, Time: float64(i)})
+	}
+	return map[string]senml.Pack{ds.Name: pack}, map[string]*registry.DataStream{ds.Name: ds}
+}
+
+func count(t *testing.T, storage Storage, ds *registry.DataStream) int {
+	pack, _, _, err := storage.Query(Query{From: time.Unix(0, 0), To: time.Unix(1e6, 0), Sort: common.ASC, Limit: -1}, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(pack)
+}
+
+func TestBatchStorageCoalesce(t *testing.T) {
+	inner := newGatedStorage(t, true)
+	batch := NewBatchStorage(inner, common.BatchConf{MaxSize: 20, MaxLatency: 100})
+	defer batch.Close()
+	ds := &registry.DataStream{Name: "batch/coalesce", Type: common.FLOAT}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := batch.Submit(records(ds, i, 1)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := count(t, inner, ds); n != 50 {
+		t.Fatalf("Expected all 50 records to be written, got %d", n)
+	}
+	if len(inner.sizes) >= 50 {
+		t.Fatalf("Expected the submissions to be written in batches, got %v", inner.sizes)
+	}
+	for _, size := range inner.sizes {
+		if size > 20 {
+			t.Fatalf("Expected batches of up to 20 records, got %v", inner.sizes)
+		}
+	}
+}
+
+func TestBatchStorageBackpressure(t *testing.T) {
+	inner := newGatedStorage(t, false)
+	batch := NewBatchStorage(inner, common.BatchConf{MaxSize: 5, MaxLatency: 1, QueueSize: 10})
+	defer batch.Close()
+	ds := &registry.DataStream{Name: "batch/backpressure", Type: common.FLOAT}
+
+	// the first batch is held by the storage and the second one fills the queue
+	var written sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		written.Add(1)
+		data, sources := records(ds, i*5, 5)
+		err := batch.Enqueue(data, sources, func(err error) {
+			if err != nil {
+				t.Error(err)
+			}
+			written.Done()
+		}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// let the writer take the first batch
+		for i == 0 && batch.Queued() != 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if err := batch.Submit(records(ds, 15, 1)); err != ErrQueueFull {
+		t.Fatalf("Expected %s, got %v", ErrQueueFull, err)
+	}
+
+	// the submissions through the HTTP API are rejected as unavailable
+	regStorage := registry.NewMemoryStorage(common.RegConf{})
+	if _, err := regStorage.Add(*ds); err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPI(regStorage, batch, nil, nil, false)
+	router := mux.NewRouter()
+	router.Methods("POST").Path("/data/{id:.+}").HandlerFunc(api.Submit)
+	req := httptest.NewRequest("POST", "/data/"+ds.Name, bytes.NewBufferString(`[{"n":"batch/backpressure","v":1,"t":100}]`))
+	req.Header.Set("Content-Type", "application/senml+json")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != http.StatusServiceUnavailable || res.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected %d with Retry-After, got %d: %s", http.StatusServiceUnavailable, res.Code, res.Body)
+	}
+
+	// the blocking submissions wait for space in the queue
+	queued := make(chan error)
+	go func() {
+		data, sources := records(ds, 16, 5)
+		queued <- batch.Enqueue(data, sources, func(error) {}, true)
+	}()
+	select {
+	case err := <-queued:
+		t.Fatalf("Expected the submission to wait for the full queue, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(inner.gate)
+	if err := <-queued; err != nil {
+		t.Fatal(err)
+	}
+	written.Wait()
+	batch.Flush()
+	if n := count(t, inner, ds); n != 20 {
+		t.Fatalf("Expected 20 records to be written, got %d", n)
+	}
+}
+
+func TestBatchStorageClose(t *testing.T) {
+	inner := newGatedStorage(t, true)
+	batch := NewBatchStorage(inner, common.BatchConf{MaxSize: 1000, MaxLatency: int(time.Hour / time.Millisecond)})
+	ds := &registry.DataStream{Name: "batch/close", Type: common.FLOAT}
+
+	done := make(chan error, 1)
+	data, sources := records(ds, 0, 10)
+	if err := batch.Enqueue(data, sources, func(err error) { done <- err }, true); err != nil {
+		t.Fatal(err)
+	}
+	batch.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("Expected the queued submission to be written on close")
+	}
+	if n := count(t, inner, ds); n != 10 {
+		t.Fatalf("Expected the 10 queued records to be written, got %d", n)
+	}
+	if err := batch.Submit(records(ds, 10, 1)); err != ErrQueueClosed {
+		t.Fatalf("Expected %s after closing, got %v", ErrQueueClosed, err)
+	}
+}
+
+func TestBatchStorageFailure(t *testing.T) {
+	inner := newGatedStorage(t, false)
+	batch := NewBatchStorage(inner, common.BatchConf{MaxSize: 100, MaxLatency: 1})
+	defer batch.Close()
+	good := &registry.DataStream{Name: "batch/good", Type: common.FLOAT}
+	bad := &registry.DataStream{Name: "batch/bad", Type: common.FLOAT}
+
+	// both submissions are queued while the storage is held, to be written in one batch
+	results := make(chan error, 2)
+	for _, ds := range []*registry.DataStream{good, bad, good} {
+		data, sources := records(ds, 0, 1)
+		ds := ds
+		err := batch.Enqueue(data, sources, func(err error) {
+			if ds == bad {
+				results <- err
+			} else if err != nil {
+				t.Errorf("Unexpected error for %s: %s", ds.Name, err)
+			}
+		}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(inner.gate)
+	if err := <-results; err == nil {
+		t.Fatal("Expected the error of the failing submission")
+	}
+	batch.Flush()
+	if n := count(t, inner, good); n != 1 {
+		t.Fatalf("Expected the other submissions to be written, got %d records", n)
+	}
+}
+
+func TestBatchStorageFailureNotAtomic(t *testing.T) {
+	inner := newGatedStorage(t, false)
+	// hides that the storage is atomic
+	batch := NewBatchStorage(struct{ Storage }{inner}, common.BatchConf{MaxSize: 100, MaxLatency: 100})
+	defer batch.Close()
+	good := &registry.DataStream{Name: "batch/good", Type: common.FLOAT}
+	bad := &registry.DataStream{Name: "batch/bad", Type: common.FLOAT}
+
+	// the submissions of the failed batch are not written again
+	results := make(chan error, 3)
+	for _, ds := range []*registry.DataStream{good, bad, good} {
+		data, sources := records(ds, 0, 1)
+		if err := batch.Enqueue(data, sources, func(err error) { results <- err }, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(inner.gate)
+	for i := 0; i < 3; i++ {
+		if err := <-results; err == nil {
+			t.Fatal("Expected every submission of the failed batch to fail")
+		}
+	}
+	inner.Lock()
+	defer inner.Unlock()
+	if len(inner.sizes) != 0 {
+		t.Fatalf("Expected no submission to be written again, got %v", inner.sizes)
+	}
+}
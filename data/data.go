@@ -7,6 +7,8 @@ import (
 	"time"
 
 	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
 )
 
 // RecordSet describes the recordset returned on querying the Data API
@@ -22,10 +24,63 @@ type RecordSet struct {
 	NextLink string `json:"nextLink"`
 }
 
+// DeleteResult describes the result of deleting data points from the Data API
+type DeleteResult struct {
+	// Deleted is the number of deleted data points
+	Deleted int `json:"deleted"`
+}
+
 type Query struct {
 	From    time.Time
 	To      time.Time
 	Sort    string
 	Limit   int
 	perPage int
+	// Cursor continues a query over multiple series from where the previous page ended
+	// It overrides From (ascending) or To (descending) of the series
+	Cursor Cursor
+	// Aggregates to be calculated for every Interval instead of returning the raw data points
+	// The Limit and the number of entries per page apply to intervals
+	Aggregates []string
+	Interval   time.Duration
+}
+
+// Cursor is the position to continue a query from for every queried series, in the order of the series in the query
+// The position of a series which has no more entries is nil
+type Cursor []*time.Time
+
+// more returns true if any of the series has more entries
+func (c Cursor) more() bool {
+	for _, t := range c {
+		if t != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// uniform returns the position of all series if it is the same for every one of them
+func (c Cursor) uniform() *time.Time {
+	if len(c) == 0 || c[0] == nil {
+		return nil
+	}
+	for _, t := range c[1:] {
+		if t == nil || !t.Equal(*c[0]) {
+			return nil
+		}
+	}
+	return c[0]
+}
+
+// validType checks if the value of the record matches the type of the data stream
+func validType(ds *registry.DataStream, r senml.Record) bool {
+	switch ds.Type {
+	case common.FLOAT:
+		return r.Value != nil
+	case common.STRING:
+		return r.StringValue != ""
+	case common.BOOL:
+		return r.BoolValue != nil
+	}
+	return true
 }
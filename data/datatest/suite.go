@@ -0,0 +1,516 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+// Package datatest provides the conformance tests for implementations of data.Storage
+package datatest
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	datastore "github.com/dschowta/senml.datastore"
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/data"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// StorageFactory returns a new and empty storage
+// The storage should be closed and removed with the cleanup functions of the test.
+type StorageFactory func(t *testing.T) data.Storage
+
+// start is the time of the first data point of every test
+var start = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// RunStorageSuite runs the tests which every data storage must pass
+// Every test starts with a new storage created by the factory.
+func RunStorageSuite(t *testing.T, factory StorageFactory) {
+	t.Run("value types", func(t *testing.T) { testValueTypes(t, factory(t)) })
+	t.Run("sort order", func(t *testing.T) { testSortOrder(t, factory(t)) })
+	t.Run("limit", func(t *testing.T) { testLimit(t, factory(t)) })
+	t.Run("pagination", func(t *testing.T) { testPagination(t, factory(t)) })
+	t.Run("empty pages", func(t *testing.T) { testEmptyPages(t, factory(t)) })
+	t.Run("concurrent submits", func(t *testing.T) { testConcurrentSubmits(t, factory(t)) })
+	t.Run("aggregation", func(t *testing.T) { testAggregation(t, factory(t)) })
+	t.Run("delete", func(t *testing.T) { testDelete(t, factory(t)) })
+	t.Run("events", func(t *testing.T) { testEvents(t, factory(t)) })
+	t.Run("streaming", func(t *testing.T) { testStreaming(t, factory(t)) })
+}
+
+// at returns the SenML time of the milliseconds after the start
+func at(ms int) float64 {
+	return float64(start.UnixNano()+int64(ms)*int64(time.Millisecond)) / 1e9
+}
+
+// series creates data streams of the type and returns them in the order of the names
+func series(t *testing.T, storage data.Storage, dataType string, names ...string) []*registry.DataStream {
+	var sources []*registry.DataStream
+	for _, name := range names {
+		ds := &registry.DataStream{Name: name, Type: dataType}
+		if err := storage.CreateHandler(*ds); err != nil {
+			t.Fatalf("Error creating %s: %s", name, err)
+		}
+		sources = append(sources, ds)
+	}
+	return sources
+}
+
+// submit adds float values at the milliseconds after the start to the series
+func submit(t *testing.T, storage data.Storage, ds *registry.DataStream, ms ...int) {
+	t.Helper()
+	var pack senml.Pack
+	for _, m := range ms {
+		v := float64(m)
+		pack = append(pack, senml.Record{Name: ds.Name, Value: &v, Time: at(m)})
+	}
+	if err := storage.Submit(map[string]senml.Pack{ds.Name: pack}, map[string]*registry.DataStream{ds.Name: ds}); err != nil {
+		t.Fatalf("Error submitting to %s: %s", ds.Name, err)
+	}
+}
+
+// query parses the query arguments as done by the Data API, over the first hour after the start unless given
+func query(t *testing.T, args ...string) data.Query {
+	t.Helper()
+	form := url.Values{
+		common.ParamFrom: {start.Format(time.RFC3339Nano)},
+		common.ParamTo:   {start.Add(time.Hour).Format(time.RFC3339Nano)},
+		common.ParamSort: {common.ASC},
+	}
+	for i := 0; i+1 < len(args); i += 2 {
+		form.Set(args[i], args[i+1])
+	}
+	q, err := data.ParseQueryParameters(form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// nextQuery returns the query of the next page, with the cursor passed through its nextLink representation
+func nextQuery(t *testing.T, q data.Query, cursor data.Cursor) data.Query {
+	t.Helper()
+	positions := make([]string, len(cursor))
+	for i, c := range cursor {
+		if c != nil {
+			positions[i] = c.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	next := query(t, common.ParamFrom, q.From.Format(time.RFC3339Nano), common.ParamTo, q.To.Format(time.RFC3339Nano),
+		common.ParamSort, q.Sort, common.ParamCursor, strings.Join(positions, common.IDSeparator))
+	cursorQuery := q
+	cursorQuery.Cursor = next.Cursor
+	return cursorQuery
+}
+
+// queryAll queries all pages and returns the records of every page
+func queryAll(t *testing.T, storage data.Storage, q data.Query, sources ...*registry.DataStream) (pages []senml.Pack) {
+	t.Helper()
+	for {
+		pack, total, cursor, err := storage.Query(q, sources...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the total of aggregates is the number of intervals
+		if len(q.Aggregates) == 0 && total != len(pack) {
+			t.Fatalf("Expected the total of %d records, got %d", len(pack), total)
+		}
+		pages = append(pages, pack)
+		if cursor == nil {
+			return pages
+		}
+		if len(pages) > 1000 {
+			t.Fatalf("The query does not end, last cursor: %v", cursor)
+		}
+		q = nextQuery(t, q, cursor)
+	}
+}
+
+// flatten returns the records of all pages
+func flatten(pages []senml.Pack) (records senml.Pack) {
+	for _, page := range pages {
+		records = append(records, page...)
+	}
+	return records
+}
+
+// milliseconds returns the time of the record in milliseconds after the start
+func milliseconds(r senml.Record) int {
+	return int(math.Round((r.Time - float64(start.Unix())) * 1000))
+}
+
+// times returns the records as name@milliseconds after the start
+func times(records senml.Pack) string {
+	var s []string
+	for _, r := range records {
+		s = append(s, fmt.Sprintf("%s@%d", r.Name, milliseconds(r)))
+	}
+	return strings.Join(s, " ")
+}
+
+func testValueTypes(t *testing.T, storage data.Storage) {
+	types := []string{common.FLOAT, common.STRING, common.BOOL, common.DATA}
+	dsMap := make(map[string]*registry.DataStream)
+	for _, dataType := range types {
+		dsMap[dataType] = series(t, storage, dataType, "types/"+dataType)[0]
+	}
+	record := func(dataType string, i int) senml.Record {
+		r := senml.Record{Name: dsMap[dataType].Name, Time: at(i * 1000)}
+		switch dataType {
+		case common.FLOAT:
+			v := float64(i) + 0.25
+			r.Value, r.Unit = &v, "Cel"
+		case common.STRING:
+			r.StringValue = "on " + strconv.Itoa(i)
+		case common.BOOL:
+			b := i%2 == 0
+			r.BoolValue = &b
+		case common.DATA:
+			r.DataValue = "ZGF0YQ" + strconv.Itoa(i)
+		}
+		return r
+	}
+	submitted := make(map[string]senml.Pack)
+	sources := make(map[string]*registry.DataStream)
+	for _, dataType := range types {
+		ds := dsMap[dataType]
+		for i := 0; i < 3; i++ {
+			submitted[ds.Name] = append(submitted[ds.Name], record(dataType, i))
+		}
+		sources[ds.Name] = ds
+	}
+	if err := storage.Submit(submitted, sources); err != nil {
+		t.Fatal(err)
+	}
+	// overwrites the value at the same time
+	overwrite := record(common.FLOAT, 0)
+	*overwrite.Value = -1
+	if err := storage.Submit(map[string]senml.Pack{overwrite.Name: {overwrite}}, sources); err != nil {
+		t.Fatal(err)
+	}
+	submitted[overwrite.Name][0] = overwrite
+
+	for _, dataType := range types {
+		ds := dsMap[dataType]
+		records := flatten(queryAll(t, storage, query(t), ds))
+		if len(records) != len(submitted[ds.Name]) {
+			t.Fatalf("Expected %d %s records, got %v", len(submitted[ds.Name]), dataType, records)
+		}
+		for i, r := range records {
+			expected := submitted[ds.Name][i]
+			if r.Name != expected.Name || r.Time != expected.Time || r.Unit != expected.Unit ||
+				r.StringValue != expected.StringValue || r.DataValue != expected.DataValue ||
+				(r.Value == nil) != (expected.Value == nil) || r.Value != nil && *r.Value != *expected.Value ||
+				(r.BoolValue == nil) != (expected.BoolValue == nil) || r.BoolValue != nil && *r.BoolValue != *expected.BoolValue {
+				t.Fatalf("Expected %s record %+v, got %+v", dataType, expected, r)
+			}
+		}
+	}
+}
+
+func testSortOrder(t *testing.T, storage data.Storage) {
+	sources := series(t, storage, common.FLOAT, "sort/a", "sort/b", "sort/c")
+	submit(t, storage, sources[0], 0, 3000, 6000, 9000)
+	// out of order and in between the others
+	submit(t, storage, sources[1], 4500, 1500, 7500)
+	submit(t, storage, sources[2], 250)
+
+	asc := flatten(queryAll(t, storage, query(t), sources...))
+	if s := times(asc); s != "sort/a@0 sort/c@250 sort/b@1500 sort/a@3000 sort/b@4500 sort/a@6000 sort/b@7500 sort/a@9000" {
+		t.Fatalf("Unexpected ascending order: %s", s)
+	}
+	desc := flatten(queryAll(t, storage, query(t, common.ParamSort, common.DESC), sources...))
+	if s := times(desc); s != "sort/a@9000 sort/b@7500 sort/a@6000 sort/b@4500 sort/a@3000 sort/b@1500 sort/c@250 sort/a@0" {
+		t.Fatalf("Unexpected descending order: %s", s)
+	}
+	// the bounds of the time range are inclusive
+	bounded := flatten(queryAll(t, storage, query(t,
+		common.ParamFrom, start.Add(1500*time.Millisecond).Format(time.RFC3339Nano),
+		common.ParamTo, start.Add(6*time.Second).Format(time.RFC3339Nano)), sources...))
+	if s := times(bounded); s != "sort/b@1500 sort/a@3000 sort/b@4500 sort/a@6000" {
+		t.Fatalf("Unexpected records within the time range: %s", s)
+	}
+}
+
+func testLimit(t *testing.T, storage data.Storage) {
+	sources := series(t, storage, common.FLOAT, "limit/a", "limit/b")
+	submit(t, storage, sources[0], 0, 2000, 4000, 6000, 8000)
+	submit(t, storage, sources[1], 1000, 3000, 5000, 7000, 9000)
+
+	pack, _, _, err := storage.Query(query(t, common.ParamSort, common.DESC, common.ParamLimit, "3"), sources...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := times(pack); s != "limit/b@9000 limit/a@8000 limit/b@7000" {
+		t.Fatalf("Expected the latest 3 records, got %s", s)
+	}
+	pack, _, _, err = storage.Query(query(t, common.ParamLimit, "3"), sources[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := times(pack); s != "limit/a@0 limit/a@2000 limit/a@4000" {
+		t.Fatalf("Expected the earliest 3 records, got %s", s)
+	}
+}
+
+func testPagination(t *testing.T, storage data.Storage) {
+	sources := series(t, storage, common.FLOAT, "page/a", "page/b", "page/c")
+	var all []int
+	for ms := 0; ms < 5000; ms += 500 {
+		all = append(all, ms)
+	}
+	submit(t, storage, sources[0], all...)
+	submit(t, storage, sources[1], 250, 1250, 2250)
+	submit(t, storage, sources[2], 1000)
+
+	for _, order := range []string{common.ASC, common.DESC} {
+		t.Run(order, func(t *testing.T) {
+			expected := flatten(queryAll(t, storage, query(t, common.ParamSort, order), sources...))
+			if len(expected) != 14 {
+				t.Fatalf("Expected 14 records, got %s", times(expected))
+			}
+			for _, perPage := range []int{1, 3, 4, 7, 14, 15} {
+				q := query(t, common.ParamSort, order, common.ParamPerPage, strconv.Itoa(perPage))
+				var records senml.Pack
+				for page := 1; ; page++ {
+					pack, _, cursor, err := storage.Query(q, sources...)
+					if err != nil {
+						t.Fatal(err)
+					}
+					records = append(records, pack...)
+					remaining := expected[len(records):]
+					if cursor == nil {
+						if len(remaining) != 0 {
+							t.Fatalf("perPage=%d: no cursor after page %d, but %d records remain", perPage, page, len(remaining))
+						}
+						break
+					}
+					if len(pack) != perPage {
+						t.Fatalf("perPage=%d: expected a full page %d before the last one, got %s", perPage, page, times(pack))
+					}
+					if len(cursor) != len(sources) {
+						t.Fatalf("perPage=%d: expected a cursor position for each of the %d series, got %v", perPage, len(sources), cursor)
+					}
+					// the position of every series is the time of its next record
+					for i, ds := range sources {
+						var next *time.Time
+						for _, r := range remaining {
+							if r.Name == ds.Name {
+								nt := datastore.FromSenmlTime(r.Time)
+								next = &nt
+								break
+							}
+						}
+						switch {
+						case next == nil && cursor[i] != nil:
+							t.Fatalf("perPage=%d: expected no position for %s after page %d, got %v", perPage, ds.Name, page, cursor[i])
+						case next != nil && (cursor[i] == nil || !cursor[i].Equal(*next)):
+							t.Fatalf("perPage=%d: expected the position %v for %s after page %d, got %v", perPage, next.UTC(), ds.Name, page, cursor[i])
+						}
+					}
+					q = nextQuery(t, q, cursor)
+				}
+				if times(records) != times(expected) {
+					t.Fatalf("perPage=%d: expected the pages to make up %s, got %s", perPage, times(expected), times(records))
+				}
+			}
+		})
+	}
+}
+
+func testEmptyPages(t *testing.T, storage data.Storage) {
+	sources := series(t, storage, common.FLOAT, "empty/a", "empty/b")
+	pack, total, cursor, err := storage.Query(query(t), sources...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pack) != 0 || total != 0 || cursor != nil {
+		t.Fatalf("Expected no records of the new series, got %v (total %d, cursor %v)", pack, total, cursor)
+	}
+
+	submit(t, storage, sources[0], 0, 1000)
+	pack, _, cursor, err = storage.Query(query(t, common.ParamFrom, start.Add(time.Minute).Format(time.RFC3339Nano)), sources...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pack) != 0 || cursor != nil {
+		t.Fatalf("Expected no records after the last one, got %v (cursor %v)", pack, cursor)
+	}
+	// a page which ends exactly with the last record
+	pack, _, cursor, err = storage.Query(query(t, common.ParamPerPage, "2"), sources...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pack) != 2 || cursor != nil {
+		t.Fatalf("Expected both records without a cursor, got %v (cursor %v)", pack, cursor)
+	}
+}
+
+func testConcurrentSubmits(t *testing.T, storage data.Storage) {
+	const (
+		writers = 8
+		records = 50
+	)
+	own := series(t, storage, common.FLOAT, "concurrent/0", "concurrent/1", "concurrent/2", "concurrent/3",
+		"concurrent/4", "concurrent/5", "concurrent/6", "concurrent/7")
+	shared := series(t, storage, common.FLOAT, "concurrent/shared")[0]
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < records; i++ {
+				v := float64(i)
+				err := storage.Submit(map[string]senml.Pack{
+					own[w].Name: {{Name: own[w].Name, Value: &v, Time: at(i)}},
+					// distinct times for every writer
+					shared.Name: {{Name: shared.Name, Value: &v, Time: at(i*writers + w)}},
+				}, map[string]*registry.DataStream{own[w].Name: own[w], shared.Name: shared})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for _, ds := range own {
+		if n := len(flatten(queryAll(t, storage, query(t), ds))); n != records {
+			t.Fatalf("Expected %d records of %s, got %d", records, ds.Name, n)
+		}
+	}
+	sharedRecords := flatten(queryAll(t, storage, query(t), shared))
+	if len(sharedRecords) != writers*records {
+		t.Fatalf("Expected %d records of %s, got %d", writers*records, shared.Name, len(sharedRecords))
+	}
+	for i, r := range sharedRecords {
+		if milliseconds(r) != i {
+			t.Fatalf("Expected record %d of %s at %dms, got %dms", i, shared.Name, i, milliseconds(r))
+		}
+	}
+}
+
+func testAggregation(t *testing.T, storage data.Storage) {
+	ds := series(t, storage, common.FLOAT, "aggregation")[0]
+	var ms []int
+	for m := 0; m < 10; m++ {
+		ms = append(ms, m*60000)
+	}
+	submit(t, storage, ds, ms...)
+
+	q := query(t, common.ParamAggr, "count,max", common.ParamInterval, "5m")
+	if _, total, _, err := storage.Query(q, ds); err != nil || total != 2 {
+		t.Fatalf("Expected the total of two intervals, got %d (%v)", total, err)
+	}
+	records := flatten(queryAll(t, storage, q, ds))
+	if len(records) != 4 {
+		t.Fatalf("Expected the aggregates of two intervals, got %v", records)
+	}
+	values := make(map[string][]float64)
+	for _, r := range records {
+		if r.Value == nil {
+			t.Fatalf("Expected a value for the aggregate %+v", r)
+		}
+		values[r.Name] = append(values[r.Name], *r.Value)
+	}
+	count, max := values[data.AggregateName(ds.Name, "count")], values[data.AggregateName(ds.Name, "max")]
+	if len(count) != 2 || count[0] != 5 || count[1] != 5 || len(max) != 2 || max[0] != 240000 || max[1] != 540000 {
+		t.Fatalf("Unexpected aggregates: %v", values)
+	}
+}
+
+func testDelete(t *testing.T, storage data.Storage) {
+	sources := series(t, storage, common.FLOAT, "delete/a", "delete/b")
+	submit(t, storage, sources[0], 0, 1000, 2000, 3000, 4000)
+	submit(t, storage, sources[1], 500, 2500, 4500)
+
+	deleted, err := storage.Delete(sources, start.Add(time.Second), start.Add(3*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 4 {
+		t.Fatalf("Expected 4 deleted data points, got %d", deleted)
+	}
+	if s := times(flatten(queryAll(t, storage, query(t), sources...))); s != "delete/a@0 delete/b@500 delete/a@4000 delete/b@4500" {
+		t.Fatalf("Unexpected remaining records: %s", s)
+	}
+	deleted, err = storage.Delete(sources, start.Add(time.Second), start.Add(3*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 0 {
+		t.Fatalf("Expected nothing to be deleted again, got %d", deleted)
+	}
+}
+
+func testEvents(t *testing.T, storage data.Storage) {
+	sources := series(t, storage, common.FLOAT, "events/a", "events/b")
+	submit(t, storage, sources[0], 0, 1000)
+	submit(t, storage, sources[1], 0, 1000)
+
+	updated := *sources[0]
+	updated.Meta = map[string]interface{}{"updated": true}
+	if err := storage.UpdateHandler(*sources[0], updated); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(flatten(queryAll(t, storage, query(t), sources[0]))); n != 2 {
+		t.Fatalf("Expected the data to be kept after an update, got %d records", n)
+	}
+
+	// the data is gone when the data stream is created again
+	if err := storage.DeleteHandler(*sources[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.CreateHandler(*sources[0]); err != nil {
+		t.Fatal(err)
+	}
+	if records := flatten(queryAll(t, storage, query(t), sources[0])); len(records) != 0 {
+		t.Fatalf("Expected the series to be deleted, got %s", times(records))
+	}
+	if n := len(flatten(queryAll(t, storage, query(t), sources[1]))); n != 2 {
+		t.Fatalf("Expected the other series to be kept, got %d records", n)
+	}
+	submit(t, storage, sources[0], 2000)
+	if s := times(flatten(queryAll(t, storage, query(t), sources[0]))); s != "events/a@2000" {
+		t.Fatalf("Expected the series to be usable again, got %s", s)
+	}
+}
+
+func testStreaming(t *testing.T, storage data.Storage) {
+	streaming, ok := storage.(data.StreamingStorage)
+	if !ok {
+		t.Skip("The storage does not implement data.StreamingStorage")
+	}
+	ds := series(t, storage, common.FLOAT, "streaming")[0]
+	var ms []int
+	for i := 0; i < 25; i++ {
+		ms = append(ms, i*100)
+	}
+	submit(t, storage, ds, ms...)
+
+	for _, order := range []string{common.ASC, common.DESC} {
+		q := query(t, common.ParamSort, order, common.ParamPerPage, "10")
+		var streamed senml.Pack
+		err := streaming.QueryStream(q, ds, func(r senml.Record) error {
+			streamed = append(streamed, r)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := times(flatten(queryAll(t, storage, q, ds))); times(streamed) != expected {
+			t.Fatalf("Expected the %s stream %s, got %s", order, expected, times(streamed))
+		}
+	}
+}
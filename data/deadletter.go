@@ -0,0 +1,268 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+const (
+	defaultDeadLetterEntries = 10000
+)
+
+// Protocols of the rejected submissions
+const (
+	DeadLetterHTTP = "HTTP"
+	DeadLetterMQTT = "MQTT"
+	DeadLetterWAL  = "WAL"
+)
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is a submission, or the part of it, which was rejected on ingestion
+type DeadLetter struct {
+	ID       uint64    `json:"id"`
+	Time     time.Time `json:"time"`
+	Protocol string    `json:"protocol"`
+	// Source is the request path for HTTP, the broker and topic for MQTT, and the log directory for WAL
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+	// Names of the records, if the payload could be parsed
+	Names       []string `json:"names,omitempty"`
+	ContentType string   `json:"contentType,omitempty"`
+	Payload     []byte   `json:"payload"`
+}
+
+// DeadLetterList describes a page of the dead letters
+type DeadLetterList struct {
+	Letters []DeadLetter `json:"letters"`
+	Page    int          `json:"page"`
+	PerPage int          `json:"per_page"`
+	Total   int          `json:"total"`
+}
+
+// ReplayResult describes the result of replaying dead letters
+type ReplayResult struct {
+	Replayed int `json:"replayed"`
+	Failed   int `json:"failed"`
+}
+
+// DeadLetterStore keeps the latest rejected submissions, up to a maximum number of entries
+// A nil store discards all submissions
+type DeadLetterStore struct {
+	sync.Mutex
+	db         *leveldb.DB
+	maxEntries int
+	total      int
+	nextID     uint64
+}
+
+func NewDeadLetterStore(path string, maxEntries int, opts *opt.Options) (*DeadLetterStore, func() error, error) {
+	if maxEntries <= 0 {
+		maxEntries = defaultDeadLetterEntries
+	}
+	db, err := leveldb.OpenFile(path, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := &DeadLetterStore{
+		db:         db,
+		maxEntries: maxEntries,
+		nextID:     1,
+	}
+	// continue after the latest entry
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		s.total++
+	}
+	if iter.Last() {
+		s.nextID = binary.BigEndian.Uint64(iter.Key()) + 1
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("error loading dead letters: %v", err)
+	}
+
+	return s, db.Close, nil
+}
+
+func deadLetterKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// Add stores the letter and removes the oldest ones exceeding the maximum number of entries
+func (s *DeadLetterStore) Add(letter DeadLetter) error {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	letter.ID = s.nextID
+	if letter.Time.IsZero() {
+		letter.Time = time.Now().UTC()
+	}
+	b, err := json.Marshal(&letter)
+	if err != nil {
+		return err
+	}
+	err = s.db.Put(deadLetterKey(letter.ID), b, nil)
+	if err != nil {
+		return err
+	}
+	s.nextID++
+	s.total++
+
+	if s.total > s.maxEntries {
+		batch := new(leveldb.Batch)
+		iter := s.db.NewIterator(nil, nil)
+		for n := s.total - s.maxEntries; n > 0 && iter.Next(); n-- {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+		err = s.db.Write(batch, nil)
+		if err != nil {
+			return err
+		}
+		s.total -= batch.Len()
+	}
+	return nil
+}
+
+// Reject stores a rejected submission and logs the failures of the store
+func (s *DeadLetterStore) Reject(protocol, source, reason, contentType string, payload []byte, names ...string) {
+	if s == nil {
+		return
+	}
+	err := s.Add(DeadLetter{
+		Protocol:    protocol,
+		Source:      source,
+		Reason:      reason,
+		Names:       names,
+		ContentType: contentType,
+		Payload:     payload,
+	})
+	if err != nil {
+		log.Printf("Error storing dead letter: %v", err)
+	}
+}
+
+// RejectRecords stores the rejected records of a submission encoded as SenML JSON
+func (s *DeadLetterStore) RejectRecords(protocol, source, reason string, records senml.Pack) {
+	if s == nil || len(records) == 0 {
+		return
+	}
+	payload, err := records.Encode(senml.JSON, senml.OutputOptions{})
+	if err != nil {
+		log.Printf("Error encoding dead letter: %v", err)
+		return
+	}
+	s.Reject(protocol, source, reason, senml.MediaTypeSenmlJSON, payload, recordNames(records)...)
+}
+
+// GetMany returns a page of the letters, oldest first, and the total number of letters
+func (s *DeadLetterStore) GetMany(page, perPage int) ([]DeadLetter, int, error) {
+	letters := []DeadLetter{}
+	if s == nil {
+		return letters, 0, nil
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	offset := (page - 1) * perPage
+	iter := s.db.NewIterator(nil, nil)
+	for i := 0; iter.Next() && len(letters) < perPage; i++ {
+		if i < offset {
+			continue
+		}
+		var letter DeadLetter
+		err := json.Unmarshal(iter.Value(), &letter)
+		if err != nil {
+			iter.Release()
+			return nil, 0, err
+		}
+		letters = append(letters, letter)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, 0, err
+	}
+	return letters, s.total, nil
+}
+
+// Update replaces a stored letter
+func (s *DeadLetterStore) Update(letter DeadLetter) error {
+	if s == nil {
+		return ErrDeadLetterNotFound
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	key := deadLetterKey(letter.ID)
+	found, err := s.db.Has(key, nil)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrDeadLetterNotFound
+	}
+	b, err := json.Marshal(&letter)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(key, b, nil)
+}
+
+// Delete removes a letter
+func (s *DeadLetterStore) Delete(id uint64) error {
+	if s == nil {
+		return ErrDeadLetterNotFound
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	key := deadLetterKey(id)
+	found, err := s.db.Has(key, nil)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrDeadLetterNotFound
+	}
+	err = s.db.Delete(key, nil)
+	if err != nil {
+		return err
+	}
+	s.total--
+	return nil
+}
+
+// recordNames returns the distinct names of the records
+func recordNames(records senml.Pack) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, r := range records {
+		if !seen[r.Name] {
+			seen[r.Name] = true
+			names = append(names, r.Name)
+		}
+	}
+	return names
+}
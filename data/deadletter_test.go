@@ -0,0 +1,139 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+func TestDeadLetterStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestDeadLetterStore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, closeStore, err := NewDeadLetterStore(dir, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		store.Reject(DeadLetterHTTP, "POST /data", "test", "", []byte("[]"))
+	}
+	letters, total, err := store.GetMany(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || len(letters) != 3 || letters[0].ID != 3 || letters[2].ID != 5 {
+		t.Fatalf("Expected the latest 3 letters, got %d: %+v", total, letters)
+	}
+	if err := store.Delete(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(4); err != ErrDeadLetterNotFound {
+		t.Errorf("Expected %v, got %v", ErrDeadLetterNotFound, err)
+	}
+	closeStore()
+
+	// the IDs continue after reopening
+	store, closeStore, err = NewDeadLetterStore(dir, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeStore()
+	store.Reject(DeadLetterHTTP, "POST /data", "test", "", []byte("[]"))
+	letters, total, err = store.GetMany(2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || len(letters) != 1 || letters[0].ID != 6 {
+		t.Fatalf("Expected the letter 6 on the second page, got %d: %+v", total, letters)
+	}
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestDeadLetterReplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, closeStore, err := NewDeadLetterStore(dir, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeStore()
+
+	regStorage := registry.NewMemoryStorage(common.RegConf{})
+	api := NewAPI(regStorage, &dummyDataStorage{}, nil, store, false)
+	r := mux.NewRouter().StrictSlash(true).SkipClean(true)
+	r.Methods("POST").Path("/data/{id:.+}").HandlerFunc(api.Submit)
+	r.Methods("GET").Path("/deadletter").HandlerFunc(api.DeadLetters)
+	r.Methods("POST").Path("/deadletter/replay").HandlerFunc(api.ReplayDeadLetters)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	// a typo in the base name
+	payload := `[{"bn":"deadletter/sensr","n":"1","v":42}]`
+	res, err := http.Post(ts.URL+"/data/deadletter/sensor1", "application/senml+json", strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Server response is %v instead of %v", res.StatusCode, http.StatusNotFound)
+	}
+
+	res, err = http.Get(ts.URL + "/deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list DeadLetterList
+	err = json.NewDecoder(res.Body).Decode(&list)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 1 || string(list.Letters[0].Payload) != payload || list.Letters[0].Protocol != DeadLetterHTTP ||
+		len(list.Letters[0].Names) != 1 || list.Letters[0].Names[0] != "deadletter/sensr1" {
+		t.Fatalf("Unexpected dead letters: %+v", list)
+	}
+
+	replay := func() ReplayResult {
+		res, err := http.Post(ts.URL+"/deadletter/replay", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var result ReplayResult
+		if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	// still unknown
+	if result := replay(); result.Replayed != 0 || result.Failed != 1 {
+		t.Fatalf("Expected the replay to fail, got %+v", result)
+	}
+
+	// fix the registry
+	_, err = regStorage.Add(registry.DataStream{Name: "deadletter/sensr1", Type: common.FLOAT})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := replay(); result.Replayed != 1 || result.Failed != 0 {
+		t.Fatalf("Expected the letter to be replayed, got %+v", result)
+	}
+	if _, total, _ := store.GetMany(1, 10); total != 0 {
+		t.Errorf("Expected the replayed letter to be removed, %d left", total)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/farshidtz/senml"
+	"github.com/gorilla/mux"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+const (
+	exportFlushInterval = 1000 // records
+)
+
+// QueryStream sends the data points of a data source within the time range of the query in the order of the query
+// Storages which don't implement StreamingStorage are queried page by page.
+func QueryStream(storage Storage, q Query, ds *registry.DataStream, send func(senml.Record) error) error {
+	if s, ok := storage.(StreamingStorage); ok {
+		return s.QueryStream(q, ds, send)
+	}
+
+	q.Cursor, q.Limit, q.perPage = nil, -1, MaxPerPage
+	for {
+		pack, _, cursor, err := storage.Query(q, ds)
+		if err != nil {
+			return err
+		}
+		for _, r := range pack {
+			if err := send(r); err != nil {
+				return err
+			}
+		}
+		if cursor == nil {
+			return nil
+		}
+		q.Cursor = cursor
+	}
+}
+
+// exportEncoder writes records in an export format
+type exportEncoder interface {
+	encode(r senml.Record) error
+	flush() error
+}
+
+// jsonLinesEncoder writes every record as a SenML JSON object on its own line
+type jsonLinesEncoder struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func newJSONLinesEncoder(w io.Writer) *jsonLinesEncoder {
+	bw := bufio.NewWriter(w)
+	return &jsonLinesEncoder{bw, json.NewEncoder(bw)}
+}
+
+func (e *jsonLinesEncoder) encode(r senml.Record) error {
+	return e.enc.Encode(r)
+}
+
+func (e *jsonLinesEncoder) flush() error {
+	return e.w.Flush()
+}
+
+// csvEncoder writes the rows of name,time,value,unit as accepted by the import
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func newCSVEncoder(w io.Writer) (*csvEncoder, error) {
+	e := &csvEncoder{csv.NewWriter(w)}
+	return e, e.w.Write([]string{"name", "time", "value", "unit"})
+}
+
+func (e *csvEncoder) encode(r senml.Record) error {
+	var value string
+	switch {
+	case r.Value != nil:
+		value = strconv.FormatFloat(*r.Value, 'g', -1, 64)
+	case r.BoolValue != nil:
+		value = strconv.FormatBool(*r.BoolValue)
+	case r.StringValue != "":
+		value = r.StringValue
+	default:
+		value = r.DataValue
+	}
+	return e.w.Write([]string{r.Name, strconv.FormatFloat(r.Time, 'f', -1, 64), value, r.Unit})
+}
+
+func (e *csvEncoder) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// Export is a handler for streaming all data points of data sources within a time range
+// The data sources are exported one after another in JSON lines or CSV, based on the Accept header.
+// Expected parameters: id(s), from, to, sort
+func (api *API) Export(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	params := mux.Vars(r)
+
+	mediaType, acceptable := exportMediaType(r.Header.Get("Accept"))
+	if !acceptable {
+		common.ErrorResponse(http.StatusNotAcceptable, "Unsupported media type in Accept header: "+r.Header.Get("Accept"), w)
+		return
+	}
+
+	var sources []*registry.DataStream
+	for _, id := range strings.Split(params["id"], common.IDSeparator) {
+		ds, err := api.registry.Get(id)
+		if err != nil {
+			common.ErrorResponse(http.StatusNotFound,
+				fmt.Sprintf("Error retrieving data source %v from the registry: %v", id, err.Error()),
+				w)
+			return
+		}
+		sources = append(sources, ds)
+	}
+
+	if r.Form.Get(common.ParamAggr) != "" || r.Form.Get(common.ParamCursor) != "" {
+		common.ErrorResponse(http.StatusBadRequest,
+			fmt.Sprintf("%v and %v arguments are not supported by the export", common.ParamAggr, common.ParamCursor), w)
+		return
+	}
+	q, err := ParseQueryParameters(r.Form)
+	if err != nil {
+		common.ErrorResponse(http.StatusBadRequest, err.Error(), w)
+		return
+	}
+	if r.Form.Get(common.ParamSort) == "" {
+		q.Sort = common.ASC
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(http.StatusOK)
+	var encoder exportEncoder
+	if mediaType == MediaTypeCSV {
+		encoder, err = newCSVEncoder(w)
+	} else {
+		encoder = newJSONLinesEncoder(w)
+	}
+	flusher, _ := w.(http.Flusher)
+
+	count := 0
+	send := func(r senml.Record) error {
+		if err := encoder.encode(r); err != nil {
+			return err
+		}
+		count++
+		if count%exportFlushInterval == 0 {
+			if err := encoder.flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	}
+	for _, ds := range sources {
+		if err != nil {
+			break
+		}
+		err = QueryStream(api.storage, q, ds, send)
+	}
+	if err == nil {
+		err = encoder.flush()
+	}
+	if err != nil {
+		// the status is already sent, so the response is aborted for the client to notice the incomplete export
+		log.Printf("Export: aborted after %d records: %s", count, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// exportMediaType selects the export format based on the given Accept header value, defaulting to JSON lines
+func exportMediaType(accept string) (string, bool) {
+	if accept == "" {
+		return MediaTypeJSONLines, true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		switch strings.TrimSpace(strings.SplitN(part, ";", 2)[0]) {
+		case MediaTypeCSV:
+			return MediaTypeCSV, true
+		case MediaTypeJSONLines, "*/*", "application/*":
+			return MediaTypeJSONLines, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,125 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/gorilla/mux"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+func TestExport(t *testing.T) {
+	fileName := os.TempDir() + "/TestExport"
+	deleteFile(fileName)
+	defer deleteFile(fileName)
+	storage, disconnect, err := NewSenmlStorage(common.DataConf{Backend: common.DataBackendConf{Type: SENMLSTORE, DSN: fileName}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disconnect()
+	regStorage := registry.NewMemoryStorage(common.RegConf{}, storage)
+	ds, err := regStorage.Add(registry.DataStream{Name: "export/sensor", Type: common.FLOAT})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// spans multiple chunks of the storage
+	total := streamChunkSize*2 + 500
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	pack := make(senml.Pack, total)
+	for i := range pack {
+		v := float64(i)
+		pack[i] = senml.Record{Name: ds.Name, Value: &v, Time: float64(start.Add(time.Duration(i) * time.Second).Unix())}
+	}
+	if err := storage.Submit(map[string]senml.Pack{ds.Name: pack}, map[string]*registry.DataStream{ds.Name: ds}); err != nil {
+		t.Fatal(err)
+	}
+
+	api := NewAPI(regStorage, storage, nil, nil, false)
+	r := mux.NewRouter().StrictSlash(true).SkipClean(true)
+	r.Methods("GET").Path("/data/{id:.+}/export").HandlerFunc(api.Export)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	export := func(accept, query string) *http.Response {
+		req, err := http.NewRequest("GET", ts.URL+"/data/"+ds.Name+"/export"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Server response is %v instead of %v", res.StatusCode, http.StatusOK)
+		}
+		return res
+	}
+
+	t.Run("JSON lines", func(t *testing.T) {
+		res := export("", "?from="+start.Format(time.RFC3339))
+		defer res.Body.Close()
+		if res.Header.Get("Content-Type") != MediaTypeJSONLines {
+			t.Fatalf("Unexpected content type: %s", res.Header.Get("Content-Type"))
+		}
+		scanner := bufio.NewScanner(res.Body)
+		count := 0
+		for ; scanner.Scan(); count++ {
+			var r senml.Record
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				t.Fatal(err)
+			}
+			if r.Name != ds.Name || *r.Value != float64(count) {
+				t.Fatalf("Unexpected record %d: %s", count, scanner.Text())
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if count != total {
+			t.Fatalf("Exported %d records instead of %d", count, total)
+		}
+	})
+
+	t.Run("CSV descending", func(t *testing.T) {
+		res := export(MediaTypeCSV, "?sort=desc&to="+start.Add(time.Hour).Format(time.RFC3339))
+		defer res.Body.Close()
+		rows, err := csv.NewReader(res.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 3602 || rows[0][0] != "name" || rows[1][2] != "3600" || rows[3601][2] != "0" {
+			t.Fatalf("Unexpected export of %d rows: %v ... %v", len(rows), rows[:2], rows[len(rows)-1])
+		}
+	})
+
+	t.Run("paged", func(t *testing.T) {
+		// a storage without streaming support
+		q := Query{From: start, To: start.Add(time.Duration(total) * time.Second), Sort: common.ASC}
+		count := 0
+		err := QueryStream(struct{ Storage }{storage}, q, ds, func(r senml.Record) error {
+			if *r.Value != float64(count) {
+				t.Fatalf("Unexpected record %d: %v", count, *r.Value)
+			}
+			count++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != total {
+			t.Fatalf("Streamed %d records instead of %d", count, total)
+		}
+	})
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"bytes"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/farshidtz/senml"
+)
+
+// Media types which are not registered for SenML but supported by the Data API
+const (
+	MediaTypeJSON      = "application/json"
+	MediaTypeCSV       = "text/csv"
+	MediaTypeJSONLines = "application/x-ndjson"
+)
+
+// decodableFormats maps the media types accepted in the Content-Type header of submissions to SenML formats
+var decodableFormats = map[string]senml.Format{
+	MediaTypeJSON:             senml.JSON,
+	senml.MediaTypeSenmlJSON:  senml.JSON,
+	senml.MediaTypeSensmlJSON: senml.JSON,
+	senml.MediaTypeSenmlCBOR:  senml.CBOR,
+	senml.MediaTypeSensmlCBOR: senml.CBOR,
+	senml.MediaTypeSenmlXML:   senml.XML,
+	senml.MediaTypeSensmlXML:  senml.XML,
+	MediaTypeJSONLines:        senml.JSONLINE,
+}
+
+// encodableFormats maps the media types accepted in the Accept header of queries to SenML formats
+var encodableFormats = map[string]senml.Format{
+	senml.MediaTypeSenmlJSON:  senml.JSON,
+	senml.MediaTypeSensmlJSON: senml.JSON,
+	senml.MediaTypeSenmlCBOR:  senml.CBOR,
+	senml.MediaTypeSensmlCBOR: senml.CBOR,
+	senml.MediaTypeSenmlXML:   senml.XML,
+	senml.MediaTypeSensmlXML:  senml.XML,
+	MediaTypeCSV:              senml.CSV,
+	MediaTypeJSONLines:        senml.JSONLINE,
+}
+
+// decodingFormat returns the SenML format for the given Content-Type header value
+// An empty content type is treated as JSON for compatibility with older clients
+func decodingFormat(contentType string) (senml.Format, bool) {
+	if contentType == "" {
+		return senml.JSON, true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return 0, false
+	}
+	format, found := decodableFormats[mediaType]
+	return format, found
+}
+
+// negotiateFormat selects the response media type based on the given Accept header value
+// The returned media type is empty when the response should be a JSON RecordSet
+func negotiateFormat(accept string) (string, senml.Format, bool) {
+	if accept == "" {
+		return "", senml.JSON, true
+	}
+
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, found := params["q"]; found {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, mediaRange{mediaType, q})
+		}
+	}
+	// highest preference first, keeping the order of the header for equal preferences
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+
+	for _, r := range ranges {
+		switch r.mediaType {
+		case "*/*", "application/*", MediaTypeJSON:
+			return "", senml.JSON, true
+		}
+		if format, found := encodableFormats[r.mediaType]; found {
+			return r.mediaType, format, true
+		}
+	}
+	return "", 0, false
+}
+
+// encodeRecords encodes the records for a response of the given media type
+// CSV and JSON lines are written with the export encoders, since the SenML encoders of these formats drop non-float records.
+func encodeRecords(pack senml.Pack, mediaType string, format senml.Format) ([]byte, error) {
+	var buf bytes.Buffer
+	var encoder exportEncoder
+	switch mediaType {
+	case MediaTypeCSV:
+		e, err := newCSVEncoder(&buf)
+		if err != nil {
+			return nil, err
+		}
+		encoder = e
+	case MediaTypeJSONLines:
+		encoder = newJSONLinesEncoder(&buf)
+	default:
+		return pack.Encode(format, senml.OutputOptions{})
+	}
+	for _, r := range pack {
+		if err := encoder.encode(r); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// detectFormat guesses the SenML format of a payload which comes without a media type (e.g. over MQTT)
+func detectFormat(payload []byte) senml.Format {
+	for _, b := range payload {
+		switch {
+		case b == ' ' || b == '\t' || b == '\r' || b == '\n':
+			continue
+		case b == '{':
+			return senml.JSONLINE
+		case b == '<':
+			return senml.XML
+		case b >= 0x80 && b <= 0x9f: // CBOR array
+			return senml.CBOR
+		default:
+			return senml.JSON
+		}
+	}
+	return senml.JSON
+}
@@ -5,6 +5,7 @@ package data
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -17,22 +18,27 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/linksmart/historical-datastore/common"
 	"github.com/linksmart/historical-datastore/registry"
+	"golang.org/x/net/websocket"
 )
 
 const (
 	MaxPerPage = 1000
+	// retryAfter is the time after which the submissions rejected by a full ingest queue can be retried
+	retryAfter = 1 // seconds
 )
 
 // API describes the RESTful HTTP data API
 type API struct {
 	registry         registry.Storage
 	storage          Storage
+	streams          *StreamHub
+	deadLetters      *DeadLetterStore
 	autoRegistration bool
 }
 
 // NewAPI returns the configured Data API
-func NewAPI(registry registry.Storage, storage Storage, autoRegistration bool) *API {
-	return &API{registry, storage, autoRegistration}
+func NewAPI(registry registry.Storage, storage Storage, streams *StreamHub, deadLetters *DeadLetterStore, autoRegistration bool) *API {
+	return &API{registry, storage, streams, deadLetters, autoRegistration}
 }
 
 // Submit is a handler for submitting a new data point
@@ -42,6 +48,12 @@ func (api *API) Submit(w http.ResponseWriter, r *http.Request) {
 	data := make(map[string]senml.Pack)
 	sources := make(map[string]*registry.DataStream)
 
+	format, supported := decodingFormat(r.Header.Get("Content-Type"))
+	if !supported {
+		common.ErrorResponse(http.StatusUnsupportedMediaType, "Unsupported content type: "+r.Header.Get("Content-Type"), w)
+		return
+	}
+
 	// Read body
 	body, err := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
@@ -49,11 +61,12 @@ func (api *API) Submit(w http.ResponseWriter, r *http.Request) {
 		common.ErrorResponse(http.StatusBadRequest, err.Error(), w)
 		return
 	}
+	reject := api.rejecter(w, r, body)
 
 	// Parse payload
-	senmlPack, err := senml.Decode(body, senml.JSON)
+	senmlPack, err := senml.Decode(body, format)
 	if err != nil {
-		common.ErrorResponse(http.StatusBadRequest, "Error parsing message body: "+err.Error(), w)
+		reject(http.StatusBadRequest, "Error parsing message body: "+err.Error(), nil)
 		return
 	}
 
@@ -63,7 +76,7 @@ func (api *API) Submit(w http.ResponseWriter, r *http.Request) {
 	records := senmlPack.Normalize()
 	for _, r := range records {
 		if r.Name == "" {
-			common.ErrorResponse(http.StatusBadRequest, fmt.Sprintf("Data source name not specified."), w)
+			reject(http.StatusBadRequest, fmt.Sprintf("Data source name not specified."), records)
 			return
 		}
 		// Check if there is a data source for this entry
@@ -71,31 +84,16 @@ func (api *API) Submit(w http.ResponseWriter, r *http.Request) {
 		if !ok {
 			ds, err = api.registry.Get(r.Name)
 			if err != nil {
-				common.ErrorResponse(http.StatusNotFound, fmt.Sprintf("Data point for unknown data source %v.", r.Name), w)
+				reject(http.StatusNotFound, fmt.Sprintf("Data point for unknown data source %v.", r.Name), records)
 				return
 			}
 			dsResources[ds.Name] = ds
 		}
 
 		// Check if type of value matches the data source type in registry
-		typeError := false
-		switch ds.Type {
-		case common.FLOAT:
-			if r.Value == nil {
-				typeError = true
-			}
-		case common.STRING:
-			if r.StringValue == "" {
-				typeError = true
-			}
-		case common.BOOL:
-			if r.BoolValue == nil {
-				typeError = true
-			}
-		}
-		if typeError {
-			common.ErrorResponse(http.StatusBadRequest,
-				fmt.Sprintf("Value for %v is empty or has a type other than what is set in registry: %v", r.Name, ds.Type), w)
+		if !validType(ds, r) {
+			reject(http.StatusBadRequest,
+				fmt.Sprintf("Value for %v is empty or has a type other than what is set in registry: %v", r.Name, ds.Type), records)
 			return
 		}
 
@@ -110,9 +108,10 @@ func (api *API) Submit(w http.ResponseWriter, r *http.Request) {
 	// Add data to the storage
 	err = api.storage.Submit(data, sources)
 	if err != nil {
-		common.ErrorResponse(http.StatusInternalServerError, "Error writing data to the database: "+err.Error(), w)
+		submitErrorResponse(err, w)
 		return
 	}
+	countIngested(data, sourceHTTP)
 	w.Header().Set("Content-Type", common.DefaultMIMEType)
 	w.WriteHeader(http.StatusAccepted)
 	return
@@ -122,6 +121,12 @@ func (api *API) Submit(w http.ResponseWriter, r *http.Request) {
 // Expected parameters: none
 func (api *API) SubmitWithoutID(w http.ResponseWriter, r *http.Request) {
 
+	format, supported := decodingFormat(r.Header.Get("Content-Type"))
+	if !supported {
+		common.ErrorResponse(http.StatusUnsupportedMediaType, "Unsupported content type: "+r.Header.Get("Content-Type"), w)
+		return
+	}
+
 	// Read body
 	body, err := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
@@ -129,11 +134,12 @@ func (api *API) SubmitWithoutID(w http.ResponseWriter, r *http.Request) {
 		common.ErrorResponse(http.StatusBadRequest, err.Error(), w)
 		return
 	}
+	reject := api.rejecter(w, r, body)
 
 	// Parse payload
-	senmlPack, err := senml.Decode(body, senml.JSON)
+	senmlPack, err := senml.Decode(body, format)
 	if err != nil {
-		common.ErrorResponse(http.StatusBadRequest, "Error parsing message body: "+err.Error(), w)
+		reject(http.StatusBadRequest, "Error parsing message body: "+err.Error(), nil)
 		return
 	}
 
@@ -155,27 +161,15 @@ func (api *API) SubmitWithoutID(w http.ResponseWriter, r *http.Request) {
 			}
 			if ds == nil {
 				if !api.autoRegistration {
-					common.ErrorResponse(http.StatusNotFound, fmt.Sprintf("Data source with name %v is not registered.", r.Name), w)
+					reject(http.StatusNotFound, fmt.Sprintf("Data source with name %v is not registered.", r.Name), records)
 					return
 				}
 
 				// Register a data source with this name
 				log.Printf("Registering data source for %s", r.Name)
-				newDS := registry.DataStream{
-					Name: r.Name,
-				}
-				if r.Value != nil || r.Sum != nil {
-					newDS.Type = common.FLOAT
-				} else if r.StringValue != "" {
-					newDS.Type = common.STRING
-				} else if r.BoolValue != nil {
-					newDS.Type = common.BOOL
-				} else if r.DataValue != "" {
-					newDS.Type = common.DATA
-				}
-				addedDS, err := api.registry.Add(newDS)
+				addedDS, err := api.registry.Add(newDataStream(r))
 				if err != nil {
-					common.ErrorResponse(http.StatusBadRequest, fmt.Sprintf("Error registering %v in the registry: %v", r.Name, err.Error()), w)
+					reject(http.StatusBadRequest, fmt.Sprintf("Error registering %v in the registry: %v", r.Name, err.Error()), records)
 					return
 				}
 				ds = addedDS
@@ -184,24 +178,9 @@ func (api *API) SubmitWithoutID(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Check if type of value matches the data source type in registry
-		typeError := false
-		switch ds.Type {
-		case common.FLOAT:
-			if r.Value == nil {
-				typeError = true
-			}
-		case common.STRING:
-			if r.StringValue == "" {
-				typeError = true
-			}
-		case common.BOOL:
-			if r.BoolValue == nil {
-				typeError = true
-			}
-		}
-		if typeError {
-			common.ErrorResponse(http.StatusBadRequest,
-				fmt.Sprintf("Value for %v is empty or has a type other than what is set in registry: %v", r.Name, ds.Type), w)
+		if !validType(ds, r) {
+			reject(http.StatusBadRequest,
+				fmt.Sprintf("Value for %v is empty or has a type other than what is set in registry: %v", r.Name, ds.Type), records)
 			return
 		}
 
@@ -217,16 +196,17 @@ func (api *API) SubmitWithoutID(w http.ResponseWriter, r *http.Request) {
 	// Add data to the storage
 	err = api.storage.Submit(data, sources)
 	if err != nil {
-		common.ErrorResponse(http.StatusInternalServerError, "Error writing data to the database: "+err.Error(), w)
+		submitErrorResponse(err, w)
 		return
 	}
+	countIngested(data, sourceHTTP)
 	w.Header().Set("Content-Type", common.DefaultMIMEType)
 	w.WriteHeader(http.StatusAccepted)
 	return
 }
 
 func GetUrlFromQuery(q Query, id ...string) (url string) {
-	var sort, limit, start, end, perPage string
+	var sort, limit, start, end, cursor, perPage, aggr string
 	if q.Sort != "" {
 		sort = fmt.Sprintf("&%v=%v", common.ParamSort, q.Sort)
 	}
@@ -234,20 +214,34 @@ func GetUrlFromQuery(q Query, id ...string) (url string) {
 		limit = fmt.Sprintf("&%v=%v", common.ParamLimit, q.Limit)
 	}
 	if !q.From.IsZero() {
-		start = fmt.Sprintf("&%v=%v", common.ParamFrom, q.From.UTC().Format(time.RFC3339))
+		start = fmt.Sprintf("&%v=%v", common.ParamFrom, q.From.UTC().Format(time.RFC3339Nano))
 	}
 	if !q.To.IsZero() {
-		end = fmt.Sprintf("&%v=%v", common.ParamTo, q.To.UTC().Format(time.RFC3339))
+		end = fmt.Sprintf("&%v=%v", common.ParamTo, q.To.UTC().Format(time.RFC3339Nano))
+	}
+	if q.Cursor != nil {
+		positions := make([]string, len(q.Cursor))
+		for i, t := range q.Cursor {
+			if t != nil {
+				positions[i] = t.UTC().Format(time.RFC3339Nano)
+			}
+		}
+		cursor = fmt.Sprintf("&%v=%v", common.ParamCursor, strings.Join(positions, common.IDSeparator))
 	}
 
 	if q.perPage > 0 {
 		perPage = fmt.Sprintf("&%v=%v", common.ParamPerPage, q.perPage)
 	}
+	if len(q.Aggregates) > 0 {
+		aggr = fmt.Sprintf("&%v=%v&%v=%v",
+			common.ParamAggr, strings.Join(q.Aggregates, common.IDSeparator),
+			common.ParamInterval, common.FormatPeriod(q.Interval))
+	}
 
-	return fmt.Sprintf("%v?%s%s%s%s%s",
+	return fmt.Sprintf("%v?%s%s%s%s%s%s%s",
 		strings.Join(id, common.IDSeparator),
 		perPage,
-		sort, limit, start, end,
+		sort, limit, start, end, cursor, aggr,
 	)
 }
 
@@ -259,6 +253,12 @@ func (api *API) Query(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	var recordSet RecordSet
 
+	mediaType, format, acceptable := negotiateFormat(r.Header.Get("Accept"))
+	if !acceptable {
+		common.ErrorResponse(http.StatusNotAcceptable, "Unsupported media type in Accept header: "+r.Header.Get("Accept"), w)
+		return
+	}
+
 	// Parse id(s) and get sources from registry
 	ids := strings.Split(params["id"], common.IDSeparator)
 	sources := []*registry.DataStream{}
@@ -284,18 +284,33 @@ func (api *API) Query(w http.ResponseWriter, r *http.Request) {
 		common.ErrorResponse(http.StatusBadRequest, err.Error(), w)
 		return
 	}
+	if q.Cursor != nil && len(q.Cursor) != len(sources) {
+		common.ErrorResponse(http.StatusBadRequest,
+			fmt.Sprintf("%v argument must have a position for each of the %d data sources", common.ParamCursor, len(sources)), w)
+		return
+	}
+	if len(q.Aggregates) > 0 {
+		for _, ds := range sources {
+			if ds.Type != common.FLOAT {
+				common.ErrorResponse(http.StatusBadRequest,
+					fmt.Sprintf("Aggregation is only possible for data sources of type %s: %s", common.FLOAT, ds.Name), w)
+				return
+			}
+		}
+	}
 
-	data, total, nextLinkTS, err := api.storage.Query(q, sources...)
+	data, total, cursor, err := api.storage.Query(q, sources...)
 	if err != nil {
 		common.ErrorResponse(http.StatusInternalServerError, "Error retrieving data from the database: "+err.Error(), w)
 		return
 	}
+	queryDuration.Observe(time.Since(timeStart).Seconds())
 
 	curlink := common.DataAPILoc + "/" + GetUrlFromQuery(q, ids...)
 
 	nextlink := ""
 
-	if nextLinkTS != nil {
+	if cursor != nil {
 		nextQuery := q
 		lastPage := false
 		if q.Limit > 0 { //if Limit is given by user reduce the limit by total
@@ -308,15 +323,37 @@ func (api *API) Query(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if !lastPage {
-			if q.Sort == common.DESC {
-				nextQuery.To = *nextLinkTS
+			// continue all series from the same time if possible, otherwise from a position for each series
+			if next := cursor.uniform(); next != nil {
+				nextQuery.Cursor = nil
+				if q.Sort == common.DESC {
+					nextQuery.To = *next
+				} else {
+					nextQuery.From = *next
+				}
 			} else {
-				nextQuery.From = *nextLinkTS
+				nextQuery.Cursor = cursor
 			}
 			nextlink = common.DataAPILoc + "/" + GetUrlFromQuery(nextQuery, ids...)
 		}
 	}
 
+	// Respond with the plain SenML pack if a SenML media type is requested
+	if mediaType != "" {
+		b, err := encodeRecords(data, mediaType, format)
+		if err != nil {
+			common.ErrorResponse(http.StatusInternalServerError, "Error encoding data: "+err.Error(), w)
+			return
+		}
+		if nextlink != "" {
+			w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", nextlink))
+		}
+		w.Header().Set("Content-Type", mediaType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+		return
+	}
+
 	recordSet = RecordSet{
 		SelfLink: curlink,
 		TimeTook: time.Since(timeStart).Seconds(),
@@ -335,8 +372,380 @@ func (api *API) Query(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(csvStr))
 }
 
+// rejecter returns a function which responds with an error and stores the rejected submission as a dead letter
+func (api *API) rejecter(w http.ResponseWriter, r *http.Request, body []byte) func(code int, msg string, records senml.Pack) {
+	return func(code int, msg string, records senml.Pack) {
+		api.deadLetters.Reject(DeadLetterHTTP, r.Method+" "+r.URL.Path, msg, r.Header.Get("Content-Type"), body, recordNames(records)...)
+		common.ErrorResponse(code, msg, w)
+	}
+}
+
+// Stream is a handler for streaming the data accepted by the storage over Server-Sent Events or WebSocket
+// Every event or message is a SenML pack encoded as JSON
+// Expected parameters: id(s), optional: from (to replay the stored data since then)
+func (api *API) Stream(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	params := mux.Vars(r)
+
+	// Parse id(s) and get sources from registry
+	ids := strings.Split(params["id"], common.IDSeparator)
+	sources := []*registry.DataStream{}
+	for _, id := range ids {
+		ds, err := api.registry.Get(id)
+		if err != nil {
+			common.ErrorResponse(http.StatusNotFound,
+				fmt.Sprintf("Error retrieving data source %v from the registry: %v", id, err.Error()),
+				w)
+			return
+		}
+		sources = append(sources, ds)
+	}
+
+	var from *time.Time
+	if r.Form.Get(common.ParamFrom) != "" {
+		t, err := time.Parse(time.RFC3339, r.Form.Get(common.ParamFrom))
+		if err != nil {
+			common.ErrorResponse(http.StatusBadRequest, "Error parsing start argument: "+err.Error(), w)
+			return
+		}
+		from = &t
+	}
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		server := websocket.Server{Handler: func(ws *websocket.Conn) {
+			// the client only closes the connection
+			done := make(chan struct{})
+			go func() {
+				io.Copy(ioutil.Discard, ws)
+				close(done)
+			}()
+			send := func(pack senml.Pack) error {
+				return websocket.JSON.Send(ws, pack)
+			}
+			err := api.stream(sources, from, send, nil, done)
+			if err != nil {
+				log.Printf("Stream: %s", err)
+			}
+		}}
+		server.ServeHTTP(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		common.ErrorResponse(http.StatusInternalServerError, "Streaming is not supported by the server", w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(pack senml.Pack) error {
+		b, err := json.Marshal(pack)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+		flusher.Flush()
+		return err
+	}
+	keepAlive := func() error {
+		_, err := fmt.Fprint(w, ": keep-alive\n\n")
+		flusher.Flush()
+		return err
+	}
+	err := api.stream(sources, from, send, keepAlive, r.Context().Done())
+	if err != nil {
+		log.Printf("Stream: %s", err)
+	}
+}
+
+// stream sends the stored data since the given time followed by the data accepted by the storage until done
+func (api *API) stream(sources []*registry.DataStream, from *time.Time, send func(senml.Pack) error, keepAlive func() error, done <-chan struct{}) error {
+	names := make([]string, len(sources))
+	for i := range sources {
+		names[i] = sources[i].Name
+	}
+	// subscribe before replaying to not miss any data in between
+	sub := api.streams.subscribe(names...)
+	defer api.streams.unsubscribe(sub)
+
+	// latest replayed time of each data stream
+	replayed := make(map[string]float64)
+	if from != nil {
+		q := Query{From: *from, To: time.Now(), Sort: common.ASC, Limit: -1, perPage: MaxPerPage}
+		for {
+			pack, _, cursor, err := api.storage.Query(q, sources...)
+			if err != nil {
+				return fmt.Errorf("error replaying data: %s", err)
+			}
+			if len(pack) > 0 {
+				if err := send(pack); err != nil {
+					return err
+				}
+			}
+			for _, r := range pack {
+				replayed[r.Name] = r.Time
+			}
+			if cursor == nil {
+				break
+			}
+			q.Cursor = cursor
+		}
+	}
+
+	ticker := time.NewTicker(streamKeepAlive * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case pack, ok := <-sub.ch:
+			if !ok {
+				return fmt.Errorf("subscription to %s is closed", strings.Join(names, common.IDSeparator))
+			}
+			// skip what has been replayed
+			live := pack[:0:0]
+			for _, r := range pack {
+				if t, found := replayed[r.Name]; !found || r.Time > t {
+					live = append(live, r)
+				}
+			}
+			if len(live) > 0 {
+				if err := send(live); err != nil {
+					return err
+				}
+			}
+		case <-ticker.C:
+			if keepAlive != nil {
+				if err := keepAlive(); err != nil {
+					return err
+				}
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// Delete is a handler for deleting data points within a time range
+// Expected parameters: id(s), from, to
+func (api *API) Delete(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	params := mux.Vars(r)
+
+	// Parse id(s) and get sources from registry
+	ids := strings.Split(params["id"], common.IDSeparator)
+	sources := []*registry.DataStream{}
+	for _, id := range ids {
+		ds, err := api.registry.Get(id)
+		if err != nil {
+			common.ErrorResponse(http.StatusNotFound,
+				fmt.Sprintf("Error retrieving data source %v from the registry: %v", id, err.Error()),
+				w)
+			return
+		}
+		sources = append(sources, ds)
+	}
+
+	// Parse the time range, which must be given explicitly to avoid deleting everything by mistake
+	if r.Form.Get(common.ParamFrom) == "" || r.Form.Get(common.ParamTo) == "" {
+		common.ErrorResponse(http.StatusBadRequest,
+			fmt.Sprintf("%v and %v arguments are required", common.ParamFrom, common.ParamTo), w)
+		return
+	}
+	from, err := time.Parse(time.RFC3339, r.Form.Get(common.ParamFrom))
+	if err != nil {
+		common.ErrorResponse(http.StatusBadRequest, "Error parsing start argument: "+err.Error(), w)
+		return
+	}
+	to, err := time.Parse(time.RFC3339, r.Form.Get(common.ParamTo))
+	if err != nil {
+		common.ErrorResponse(http.StatusBadRequest, "Error parsing end argument: "+err.Error(), w)
+		return
+	}
+	if to.Before(from) {
+		common.ErrorResponse(http.StatusBadRequest, "end argument is before start", w)
+		return
+	}
+
+	deleted, err := api.storage.Delete(sources, from, to)
+	if err != nil {
+		common.ErrorResponse(http.StatusInternalServerError, "Error deleting data from the database: "+err.Error(), w)
+		return
+	}
+
+	b, err := json.Marshal(DeleteResult{Deleted: deleted})
+	if err != nil {
+		common.ErrorResponse(http.StatusInternalServerError, "Error marshalling result: "+err.Error(), w)
+		return
+	}
+	w.Header().Set("Content-Type", common.DefaultMIMEType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// DeadLetters is a handler for listing the rejected submissions
+// Expected parameters: optional: page, per_page
+func (api *API) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	page, perPage, err := common.ParsePagingParams(r.Form.Get(common.ParamPage), r.Form.Get(common.ParamPerPage), MaxPerPage)
+	if err != nil {
+		common.ErrorResponse(http.StatusBadRequest, err.Error(), w)
+		return
+	}
+
+	letters, total, err := api.deadLetters.GetMany(page, perPage)
+	if err != nil {
+		common.ErrorResponse(http.StatusInternalServerError, "Error retrieving dead letters: "+err.Error(), w)
+		return
+	}
+
+	b, err := json.Marshal(DeadLetterList{Letters: letters, Page: page, PerPage: perPage, Total: total})
+	if err != nil {
+		common.ErrorResponse(http.StatusInternalServerError, "Error marshalling dead letters: "+err.Error(), w)
+		return
+	}
+	w.Header().Set("Content-Type", common.DefaultMIMEType)
+	w.Write(b)
+}
+
+// ReplayDeadLetters is a handler for submitting the rejected submissions again, e.g. after fixing the registry
+// The replayed letters are removed and the others are updated with the reason of the new rejection
+// Expected parameters: optional: id (comma-separated)
+func (api *API) ReplayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	var ids map[uint64]bool
+	if r.Form.Get("id") != "" {
+		ids = make(map[uint64]bool)
+		for _, id := range strings.Split(r.Form.Get("id"), common.IDSeparator) {
+			parsed, err := strconv.ParseUint(id, 10, 64)
+			if err != nil {
+				common.ErrorResponse(http.StatusBadRequest, "Error parsing id: "+err.Error(), w)
+				return
+			}
+			ids[parsed] = true
+		}
+	}
+
+	var letters []DeadLetter
+	for page := 1; ; page++ {
+		batch, total, err := api.deadLetters.GetMany(page, MaxPerPage)
+		if err != nil {
+			common.ErrorResponse(http.StatusInternalServerError, "Error retrieving dead letters: "+err.Error(), w)
+			return
+		}
+		for _, letter := range batch {
+			if ids == nil || ids[letter.ID] {
+				letters = append(letters, letter)
+			}
+		}
+		if page*MaxPerPage >= total {
+			break
+		}
+	}
+
+	var result ReplayResult
+	for _, letter := range letters {
+		err := api.replay(letter)
+		if err != nil {
+			result.Failed++
+			letter.Reason = err.Error()
+			err = api.deadLetters.Update(letter)
+		} else {
+			result.Replayed++
+			err = api.deadLetters.Delete(letter.ID)
+		}
+		if err != nil && err != ErrDeadLetterNotFound {
+			common.ErrorResponse(http.StatusInternalServerError, "Error updating dead letters: "+err.Error(), w)
+			return
+		}
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		common.ErrorResponse(http.StatusInternalServerError, "Error marshalling result: "+err.Error(), w)
+		return
+	}
+	w.Header().Set("Content-Type", common.DefaultMIMEType)
+	w.Write(b)
+}
+
+// DeleteDeadLetter is a handler for discarding a rejected submission
+// Expected parameters: id
+func (api *API) DeleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.ParseUint(params["id"], 10, 64)
+	if err != nil {
+		common.ErrorResponse(http.StatusBadRequest, "Error parsing id: "+err.Error(), w)
+		return
+	}
+
+	err = api.deadLetters.Delete(id)
+	if err == ErrDeadLetterNotFound {
+		common.ErrorResponse(http.StatusNotFound, err.Error(), w)
+		return
+	} else if err != nil {
+		common.ErrorResponse(http.StatusInternalServerError, "Error deleting dead letter: "+err.Error(), w)
+		return
+	}
+}
+
+// replay submits the records of a letter if all of them are valid
+func (api *API) replay(letter DeadLetter) error {
+	format := detectFormat(letter.Payload)
+	if letter.ContentType != "" {
+		var supported bool
+		format, supported = decodingFormat(letter.ContentType)
+		if !supported {
+			return fmt.Errorf("Unsupported content type: %s", letter.ContentType)
+		}
+	}
+	senmlPack, err := senml.Decode(letter.Payload, format)
+	if err != nil {
+		return fmt.Errorf("Error parsing message body: %s", err)
+	}
+
+	data := make(map[string]senml.Pack)
+	sources := make(map[string]*registry.DataStream)
+	for _, r := range senmlPack.Normalize() {
+		ds, found := sources[r.Name]
+		if !found {
+			ds, err = api.registry.Get(r.Name)
+			if err != nil {
+				return fmt.Errorf("Data point for unknown data source %v.", r.Name)
+			}
+			sources[r.Name] = ds
+		}
+		if !validType(ds, r) {
+			return fmt.Errorf("Value for %v is empty or has a type other than what is set in registry: %v", r.Name, ds.Type)
+		}
+		data[ds.Name] = append(data[ds.Name], r)
+	}
+
+	err = submitWaiting(api.storage, data, sources)
+	if err != nil {
+		return fmt.Errorf("Error writing data to the database: %s", err)
+	}
+	if letter.Protocol == DeadLetterMQTT {
+		countIngested(data, sourceMQTT)
+	} else {
+		countIngested(data, sourceHTTP)
+	}
+	return nil
+}
+
 // Utility functions
 
+// submitErrorResponse writes the error of submitting data, asking the client to retry when the ingest queue is full
+func submitErrorResponse(err error, w http.ResponseWriter) {
+	if err == ErrQueueFull {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		common.ErrorResponse(http.StatusServiceUnavailable, "Error writing data to the database: "+err.Error(), w)
+		return
+	}
+	common.ErrorResponse(http.StatusInternalServerError, "Error writing data to the database: "+err.Error(), w)
+}
+
 func ParseQueryParameters(form url.Values) (Query, error) {
 	q := Query{}
 	var err error
@@ -386,12 +795,56 @@ func ParseQueryParameters(form url.Values) (Query, error) {
 		return Query{}, fmt.Errorf("Invalid sort argument: %v", q.Sort)
 	}
 
+	// aggregation
+	if form.Get(common.ParamAggr) != "" {
+		q.Aggregates = strings.Split(form.Get(common.ParamAggr), common.IDSeparator)
+		for _, aggr := range q.Aggregates {
+			if !common.SupportedAggregate(aggr) {
+				return Query{}, fmt.Errorf("Unsupported aggregate: %v", aggr)
+			}
+		}
+		if form.Get(common.ParamInterval) == "" {
+			return Query{}, fmt.Errorf("%v argument is required for aggregation", common.ParamInterval)
+		}
+		q.Interval, err = common.ParsePeriod(form.Get(common.ParamInterval))
+		if err != nil {
+			return Query{}, fmt.Errorf("Error parsing interval argument: %s", err)
+		}
+	} else if form.Get(common.ParamInterval) != "" {
+		return Query{}, fmt.Errorf("%v argument is only allowed with %v", common.ParamInterval, common.ParamAggr)
+	}
+
+	// cursor
+	if form.Get(common.ParamCursor) != "" {
+		if len(q.Aggregates) > 0 {
+			return Query{}, fmt.Errorf("%v argument is not allowed with %v", common.ParamCursor, common.ParamAggr)
+		}
+		for _, position := range strings.Split(form.Get(common.ParamCursor), common.IDSeparator) {
+			if position == "" { // no more entries in this series
+				q.Cursor = append(q.Cursor, nil)
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, position)
+			if err != nil {
+				return Query{}, fmt.Errorf("Error parsing cursor argument: %s", err)
+			}
+			q.Cursor = append(q.Cursor, &t)
+		}
+	}
+
 	if form.Get(common.ParamPerPage) == "" {
 		q.perPage = MaxPerPage
 	} else {
 		q.perPage, err = strconv.Atoi(form.Get(common.ParamPerPage))
 		if err != nil {
-			return Query{}, fmt.Errorf("Error parsing limit argument: %s", err)
+			return Query{}, fmt.Errorf("Error parsing %v argument: %s", common.ParamPerPage, err)
+		}
+		// an empty page would repeat the cursor of the query
+		if q.perPage < 1 {
+			return Query{}, fmt.Errorf("%v must be greater than or equal to 1", common.ParamPerPage)
+		}
+		if q.perPage > MaxPerPage {
+			q.perPage = MaxPerPage
 		}
 	}
 
@@ -10,9 +10,11 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"code.linksmart.eu/com/go-sec/auth/obtainer"
 	"code.linksmart.eu/sc/service-catalog/utils"
+	"github.com/linksmart/historical-datastore/common"
 	"github.com/linksmart/historical-datastore/registry"
 )
 
@@ -95,3 +97,42 @@ func (c *RemoteClient) Query(q Query, id ...string) (*RecordSet, error) {
 	return &rs, nil
 
 }
+
+// Delete data points within a time range (inclusive), where:
+// id... - ID (or array of IDs) of data sources for which the data is being deleted
+// Returns the number of deleted data points
+func (c *RemoteClient) Delete(from, to time.Time, id ...string) (int, error) {
+	path := fmt.Sprintf("%v/%v?%v=%v&%v=%v",
+		c.serverEndpoint,
+		strings.Join(id, common.IDSeparator),
+		common.ParamFrom, from.UTC().Format(time.RFC3339Nano),
+		common.ParamTo, to.UTC().Format(time.RFC3339Nano))
+	res, err := utils.HTTPRequest("DELETE",
+		path,
+		nil,
+		nil,
+		c.ticket,
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to read body of response: %v", err.Error())
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		return 0, registry.ErrNotFound
+	} else if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%v: %v", res.StatusCode, string(body))
+	}
+
+	var result DeleteResult
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return 0, err
+	}
+	return result.Deleted, nil
+}
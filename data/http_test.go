@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -48,11 +49,13 @@ func setupHTTPAPI() (*mux.Router, []string) {
 		testIDs = append(testIDs, created.Name)
 	}
 
-	api := NewAPI(regStorage, &dummyDataStorage{}, false)
+	storage := &dummyDataStorage{}
+	api := NewAPI(regStorage, storage, NewStreamHub(storage), nil, false)
 
 	r := mux.NewRouter().StrictSlash(true).SkipClean(true)
 	r.Methods("POST").Path("/data/{id:.+}").HandlerFunc(api.Submit)
 	r.Methods("GET").Path("/data/{id:.+}").HandlerFunc(api.Query)
+	r.Methods("DELETE").Path("/data/{id:.+}").HandlerFunc(api.Delete)
 
 	return r, testIDs
 }
@@ -95,9 +98,9 @@ func TestHttpSubmit(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	//if res.StatusCode != http.StatusUnsupportedMediaType {
-	//	t.Errorf("Server response is not %v but %v", http.StatusUnsupportedMediaType, res.StatusCode)
-	//}
+	if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Server response is not %v but %v", http.StatusUnsupportedMediaType, res.StatusCode)
+	}
 
 	// try bad payload
 	res, err = http.Post(ts.URL+"/data/"+all, "application/senml+json", bytes.NewReader([]byte{0xde, 0xad}))
@@ -145,6 +148,216 @@ func TestHttpQuery(t *testing.T) {
 	//t.Error("TODO: check response body")
 }
 
+func TestHttpSubmitCBOR(t *testing.T) {
+	router, testIDs := setupHTTPAPI()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	v := 42.0
+	pack := senml.Pack{{Name: testIDs[0], Unit: "degC", Value: &v}}
+	b, err := pack.Encode(senml.CBOR, senml.OutputOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Post(ts.URL+"/data/"+testIDs[0], senml.MediaTypeSenmlCBOR, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusAccepted {
+		t.Errorf("Server response is not %v but %v", http.StatusAccepted, res.StatusCode)
+	}
+
+	// JSON payload labeled as CBOR
+	b, _ = json.Marshal(pack)
+	res, err = http.Post(ts.URL+"/data/"+testIDs[0], senml.MediaTypeSenmlCBOR, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Server response is not %v but %v", http.StatusBadRequest, res.StatusCode)
+	}
+}
+
+func TestHttpQueryAccept(t *testing.T) {
+	router, testIDs := setupHTTPAPI()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	query := func(accept string) *http.Response {
+		req, err := http.NewRequest("GET", ts.URL+"/data/"+testIDs[0], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res := query("text/csv")
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Server response is not %v but %v", http.StatusOK, res.StatusCode)
+	}
+	if res.Header.Get("Content-Type") != MediaTypeCSV {
+		t.Errorf("Response content type is not %v but %v", MediaTypeCSV, res.Header.Get("Content-Type"))
+	}
+
+	res = query("application/xml;q=0.9, application/senml+cbor")
+	if res.Header.Get("Content-Type") != senml.MediaTypeSenmlCBOR {
+		t.Errorf("Response content type is not %v but %v", senml.MediaTypeSenmlCBOR, res.Header.Get("Content-Type"))
+	}
+
+	res = query("application/xml")
+	if res.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("Server response is not %v but %v", http.StatusNotAcceptable, res.StatusCode)
+	}
+}
+
+func TestHttpQueryFormats(t *testing.T) {
+	regStorage := registry.NewMemoryStorage(common.RegConf{})
+	storage, _, err := NewMemoryStorage(common.DataConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := regStorage.Add(registry.DataStream{Name: "query/status", Type: common.STRING})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack := senml.Pack{{Name: ds.Name, StringValue: "on", Time: 1}, {Name: ds.Name, StringValue: "off", Time: 2}}
+	if err := storage.Submit(map[string]senml.Pack{ds.Name: pack}, map[string]*registry.DataStream{ds.Name: ds}); err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPI(regStorage, storage, nil, nil, false)
+	r := mux.NewRouter().StrictSlash(true).SkipClean(true)
+	r.Methods("GET").Path("/data/{id:.+}").HandlerFunc(api.Query)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	query := func(accept string) string {
+		req, err := http.NewRequest("GET", ts.URL+"/data/"+ds.Name+"?sort=asc&from=1970-01-01T00:00:00Z", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Server response is %v instead of %v: %s", res.StatusCode, http.StatusOK, b)
+		}
+		return string(b)
+	}
+
+	// non-float records are encoded like in the export
+	if body := query(MediaTypeCSV); body != "name,time,value,unit\nquery/status,1,on,\nquery/status,2,off,\n" {
+		t.Fatalf("Unexpected CSV response: %q", body)
+	}
+	lines := strings.Split(strings.TrimSpace(query(MediaTypeJSONLines)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 JSON lines, got %q", lines)
+	}
+	var record senml.Record
+	if err := json.Unmarshal([]byte(lines[1]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.StringValue != "off" || record.Time != 2 {
+		t.Fatalf("Unexpected record: %v", lines[1])
+	}
+}
+
+func TestHttpQueryPerPage(t *testing.T) {
+	regStorage := registry.NewMemoryStorage(common.RegConf{})
+	storage, _, err := NewMemoryStorage(common.DataConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := regStorage.Add(registry.DataStream{Name: "query/perpage", Type: common.FLOAT})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPI(regStorage, storage, nil, nil, false)
+	r := mux.NewRouter().StrictSlash(true).SkipClean(true)
+	r.Methods("GET").Path("/data/{id:.+}").HandlerFunc(api.Query)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	// empty pages of aggregates would link to themselves
+	for perPage, expected := range map[string]int{"0": http.StatusBadRequest, "-1": http.StatusBadRequest, "1": http.StatusOK, "5000": http.StatusOK} {
+		res, err := http.Get(ts.URL + "/data/" + ds.Name + "?sort=asc&from=2019-01-01T00:00:00Z&aggr=mean&interval=1h&" + common.ParamPerPage + "=" + perPage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != expected {
+			t.Errorf("Expected %d for %s=%s, got %d", expected, common.ParamPerPage, perPage, res.StatusCode)
+		}
+	}
+
+	q, err := ParseQueryParameters(url.Values{common.ParamPerPage: {"5000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.perPage != MaxPerPage {
+		t.Errorf("Expected %s to be capped at %d, got %d", common.ParamPerPage, MaxPerPage, q.perPage)
+	}
+}
+
+func TestHttpDelete(t *testing.T) {
+	router, testIDs := setupHTTPAPI()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	del := func(path string) *http.Response {
+		req, err := http.NewRequest("DELETE", ts.URL+"/data/"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// without time range
+	res := del(testIDs[0])
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Server response is not %v but %v", http.StatusBadRequest, res.StatusCode)
+	}
+
+	// end before start
+	res = del(testIDs[0] + "?from=2019-01-02T00:00:00Z&to=2019-01-01T00:00:00Z")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Server response is not %v but %v", http.StatusBadRequest, res.StatusCode)
+	}
+
+	// unknown data source
+	res = del("unknown?from=2019-01-01T00:00:00Z&to=2019-01-02T00:00:00Z")
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Server response is not %v but %v", http.StatusNotFound, res.StatusCode)
+	}
+
+	res = del(strings.Join(testIDs, ",") + "?from=2019-01-01T00:00:00Z&to=2019-01-02T00:00:00Z")
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Server response is not %v but %v", http.StatusOK, res.StatusCode)
+	}
+	var result DeleteResult
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		t.Errorf("Error decoding response: %v", err)
+	}
+	res.Body.Close()
+}
+
 //TODO TEST limits
 
 // DUMMY DATA STORAGE
@@ -154,9 +367,12 @@ type dummyDataStorage struct{}
 func (s *dummyDataStorage) Submit(data map[string]senml.Pack, sources map[string]*registry.DataStream) error {
 	return nil
 }
-func (s *dummyDataStorage) Query(q Query, ds ...*registry.DataStream) (senml.Pack, int, *time.Time, error) {
+func (s *dummyDataStorage) Query(q Query, ds ...*registry.DataStream) (senml.Pack, int, Cursor, error) {
 	return senml.Pack{}, 0, nil, nil
 }
+func (s *dummyDataStorage) Delete(ds []*registry.DataStream, from time.Time, to time.Time) (int, error) {
+	return 0, nil
+}
 func (s *dummyDataStorage) Disconnect() error {
 	return nil
 }
@@ -0,0 +1,434 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+const (
+	DefaultImportBatchSize = 5000 // records
+	importMaxErrors        = 10
+	importLogInterval      = 5 // seconds
+	// MaxBufferedImportSize limits the payloads of the formats which are decoded at once, i.e. other than JSON and CSV
+	MaxBufferedImportSize = 32 << 20 // bytes
+)
+
+var (
+	errUnsupportedImport = errors.New("unsupported media type")
+	errImportStorage     = errors.New("error writing data to the database")
+	errImportTooLarge    = fmt.Errorf("payload exceeds %d bytes, import it in JSON, JSON lines or CSV instead", MaxBufferedImportSize)
+)
+
+// ImportProgress describes the progress of an import
+type ImportProgress struct {
+	Imported   int      `json:"imported"`
+	Rejected   int      `json:"rejected"`
+	Registered []string `json:"registered,omitempty"`
+	// Errors are the reasons of the first rejected records
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Importer submits large amounts of data to the storage in batches
+type Importer struct {
+	registry         registry.Storage
+	storage          Storage
+	autoRegistration bool
+	batchSize        int
+}
+
+// NewImporter returns an importer which optionally registers the unknown data streams
+func NewImporter(registry registry.Storage, storage Storage, autoRegistration bool, batchSize int) *Importer {
+	if batchSize <= 0 {
+		batchSize = DefaultImportBatchSize
+	}
+	return &Importer{
+		registry:         registry,
+		storage:          storage,
+		autoRegistration: autoRegistration,
+		batchSize:        batchSize,
+	}
+}
+
+// recordReader returns the next normalized record, or io.EOF at the end
+// A non-nil raw value is given for the records without a typed value, which is set based on the data stream
+type recordReader func() (r senml.Record, raw *string, err error)
+
+// Import reads the records of the given media type and submits them in batches, calling progress after each batch
+// The records which can't be stored are counted as rejected. Reading and storage errors stop the import.
+// CSV records have the columns name,time,value and optionally unit, with an optional header.
+// The time is either in seconds since the epoch or in RFC3339.
+func (imp *Importer) Import(r io.Reader, mediaType string, progress func(ImportProgress)) (*ImportProgress, error) {
+	next, err := newRecordReader(r, mediaType)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ImportProgress{}
+	dataStreams := make(map[string]*registry.DataStream)
+	data := make(map[string]senml.Pack)
+	sources := make(map[string]*registry.DataStream)
+	batched := 0
+	reject := func(reason string) {
+		p.Rejected++
+		if len(p.Errors) < importMaxErrors {
+			p.Errors = append(p.Errors, reason)
+		}
+	}
+	flush := func() error {
+		if batched == 0 {
+			return nil
+		}
+		// bulk imports wait for the ingest queue instead of failing when it is full
+		err := submitWaiting(imp.storage, data, sources)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errImportStorage, err)
+		}
+		countIngested(data, sourceImport)
+		p.Imported += batched
+		data = make(map[string]senml.Pack)
+		sources = make(map[string]*registry.DataStream)
+		batched = 0
+		if progress != nil {
+			progress(*p)
+		}
+		return nil
+	}
+
+	for line := 1; ; line++ {
+		record, raw, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if err := flush(); err != nil {
+				return p, err
+			}
+			return p, fmt.Errorf("error reading record %d: %v", line, err)
+		}
+		if record.Name == "" {
+			reject(fmt.Sprintf("record %d: data stream name not specified", line))
+			continue
+		}
+
+		ds, found := dataStreams[record.Name]
+		if !found {
+			ds, err = imp.dataStream(record, raw, p)
+			if err != nil {
+				reject(fmt.Sprintf("record %d: %s", line, err))
+				continue
+			}
+			dataStreams[record.Name] = ds
+		}
+
+		if raw != nil {
+			record, err = typedRecord(record, *raw, ds.Type)
+			if err != nil {
+				reject(fmt.Sprintf("record %d: invalid value for %s: %s", line, ds.Name, err))
+				continue
+			}
+		}
+		if !validType(ds, record) {
+			reject(fmt.Sprintf("record %d: value for %s is empty or has a type other than what is set in registry: %s", line, ds.Name, ds.Type))
+			continue
+		}
+
+		data[ds.Name] = append(data[ds.Name], record)
+		sources[ds.Name] = ds
+		batched++
+		if batched >= imp.batchSize {
+			if err := flush(); err != nil {
+				return p, err
+			}
+		}
+	}
+	return p, flush()
+}
+
+// dataStream returns the registered data stream of the record, registering it if enabled
+func (imp *Importer) dataStream(record senml.Record, raw *string, p *ImportProgress) (*registry.DataStream, error) {
+	ds, err := imp.registry.Get(record.Name)
+	if err == nil {
+		return ds, nil
+	}
+	if !registry.ErrType(err, registry.ErrNotFound) {
+		return nil, fmt.Errorf("error retrieving %s from the registry: %v", record.Name, err)
+	}
+	if !imp.autoRegistration {
+		return nil, fmt.Errorf("data stream %s is not registered", record.Name)
+	}
+
+	if raw != nil {
+		record = inferredRecord(record, *raw)
+	}
+	log.Printf("Registering data source for %s", record.Name)
+	ds, err = imp.registry.Add(newDataStream(record))
+	if err != nil {
+		return nil, fmt.Errorf("error registering %s in the registry: %v", record.Name, err)
+	}
+	p.Registered = append(p.Registered, ds.Name)
+	return ds, nil
+}
+
+// newDataStream returns a data stream for the record, with the type of its value
+func newDataStream(r senml.Record) registry.DataStream {
+	ds := registry.DataStream{
+		Name: r.Name,
+	}
+	if r.Value != nil || r.Sum != nil {
+		ds.Type = common.FLOAT
+	} else if r.StringValue != "" {
+		ds.Type = common.STRING
+	} else if r.BoolValue != nil {
+		ds.Type = common.BOOL
+	} else if r.DataValue != "" {
+		ds.Type = common.DATA
+	}
+	return ds
+}
+
+// typedRecord sets the raw value as the value of the given data type
+func typedRecord(r senml.Record, raw string, dataType string) (senml.Record, error) {
+	switch dataType {
+	case common.FLOAT:
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return r, err
+		}
+		r.Value = &v
+	case common.BOOL:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return r, err
+		}
+		r.BoolValue = &b
+	case common.DATA:
+		r.DataValue = raw
+	default:
+		r.StringValue = raw
+	}
+	return r, nil
+}
+
+// inferredRecord sets the raw value as a float or bool if possible, or as a string otherwise
+func inferredRecord(r senml.Record, raw string) senml.Record {
+	if v, err := strconv.ParseFloat(raw, 64); err == nil {
+		r.Value = &v
+	} else if b, err := strconv.ParseBool(raw); err == nil {
+		r.BoolValue = &b
+	} else {
+		r.StringValue = raw
+	}
+	return r
+}
+
+func newRecordReader(r io.Reader, mediaType string) (recordReader, error) {
+	if mediaType != "" {
+		parsed, _, err := mime.ParseMediaType(mediaType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid media type: %v", err)
+		}
+		mediaType = parsed
+	}
+
+	switch mediaType {
+	case MediaTypeCSV:
+		return csvRecords(r), nil
+	case "", MediaTypeJSON, senml.MediaTypeSenmlJSON, senml.MediaTypeSensmlJSON:
+		return jsonRecords(r)
+	case MediaTypeJSONLines:
+		return jsonLineRecords(r), nil
+	}
+
+	// the other formats are decoded at once, up to a limited size
+	format, supported := decodingFormat(mediaType)
+	if !supported {
+		return nil, fmt.Errorf("%w: %s", errUnsupportedImport, mediaType)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r, MaxBufferedImportSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MaxBufferedImportSize {
+		return nil, errImportTooLarge
+	}
+	pack, err := senml.Decode(body, format)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing records: %v", err)
+	}
+	records := pack.Normalize()
+	return func() (senml.Record, *string, error) {
+		if len(records) == 0 {
+			return senml.Record{}, nil, io.EOF
+		}
+		record := records[0]
+		records = records[1:]
+		return record, nil, nil
+	}, nil
+}
+
+// jsonRecords decodes the records of a SenML JSON array one by one, carrying the base fields to the following records
+func jsonRecords(r io.Reader) (recordReader, error) {
+	decoder := json.NewDecoder(r)
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, fmt.Errorf("error parsing records: %v", err)
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, fmt.Errorf("error parsing records: expected an array")
+	}
+
+	var base senml.Record
+	return func() (senml.Record, *string, error) {
+		for decoder.More() {
+			var record senml.Record
+			err := decoder.Decode(&record)
+			if err != nil {
+				return record, nil, err
+			}
+			normalized := withBase(&base, record)
+			if len(normalized) == 1 {
+				return normalized[0], nil, nil
+			}
+			// records without a value only set the base fields
+		}
+		return senml.Record{}, nil, io.EOF
+	}, nil
+}
+
+// jsonLineRecords decodes the records given as one JSON object per line
+func jsonLineRecords(r io.Reader) recordReader {
+	decoder := json.NewDecoder(r)
+	var base senml.Record
+	return func() (senml.Record, *string, error) {
+		for {
+			var record senml.Record
+			err := decoder.Decode(&record)
+			if err != nil {
+				return record, nil, err
+			}
+			normalized := withBase(&base, record)
+			if len(normalized) == 1 {
+				return normalized[0], nil, nil
+			}
+		}
+	}
+}
+
+// withBase updates the current base fields with the ones of the record and returns the normalized record
+func withBase(base *senml.Record, record senml.Record) senml.Pack {
+	if record.BaseName != "" {
+		base.BaseName = record.BaseName
+	}
+	if record.BaseTime != 0 {
+		base.BaseTime = record.BaseTime
+	}
+	if record.BaseUnit != "" {
+		base.BaseUnit = record.BaseUnit
+	}
+	if record.BaseVersion != 0 {
+		base.BaseVersion = record.BaseVersion
+	}
+	record.BaseName, record.BaseTime, record.BaseUnit, record.BaseVersion =
+		base.BaseName, base.BaseTime, base.BaseUnit, base.BaseVersion
+	return senml.Pack{record}.Normalize()
+}
+
+// csvRecords reads the rows of name,time,value[,unit]
+func csvRecords(r io.Reader) recordReader {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	first := true
+	return func() (senml.Record, *string, error) {
+		row, err := reader.Read()
+		if err != nil {
+			return senml.Record{}, nil, err
+		}
+		if first {
+			first = false
+			if strings.EqualFold(row[0], "name") {
+				row, err = reader.Read()
+				if err != nil {
+					return senml.Record{}, nil, err
+				}
+			}
+		}
+		if len(row) < 3 || len(row) > 4 {
+			return senml.Record{}, nil, fmt.Errorf("expected 3 or 4 columns, got %d", len(row))
+		}
+
+		record := senml.Record{Name: row[0]}
+		if len(row) == 4 {
+			record.Unit = row[3]
+		}
+		switch {
+		case row[1] == "":
+			record.Time = float64(time.Now().UnixNano()) / 1e9
+		default:
+			t, err := strconv.ParseFloat(row[1], 64)
+			if err != nil {
+				parsed, err := time.Parse(time.RFC3339, row[1])
+				if err != nil {
+					return record, nil, fmt.Errorf("invalid time %s", row[1])
+				}
+				t = float64(parsed.UnixNano()) / 1e9
+			}
+			record.Time = t
+		}
+		return record, &row[2], nil
+	}
+}
+
+// Import is a handler for importing large amounts of data in CSV or SenML formats
+// The unknown data streams are registered when auto registration is enabled
+func (api *API) Import(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	start := time.Now()
+	lastLog := start
+	importer := NewImporter(api.registry, api.storage, api.autoRegistration, DefaultImportBatchSize)
+	progress, err := importer.Import(r.Body, r.Header.Get("Content-Type"), func(p ImportProgress) {
+		if time.Since(lastLog) > importLogInterval*time.Second {
+			log.Printf("Import: %d records imported and %d rejected in %v", p.Imported, p.Rejected, time.Since(start))
+			lastLog = time.Now()
+		}
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnsupportedImport):
+			common.ErrorResponse(http.StatusUnsupportedMediaType, err.Error(), w)
+		case errors.Is(err, errImportTooLarge):
+			common.ErrorResponse(http.StatusRequestEntityTooLarge, err.Error(), w)
+		case progress == nil:
+			common.ErrorResponse(http.StatusBadRequest, err.Error(), w)
+		case errors.Is(err, errImportStorage):
+			common.ErrorResponse(http.StatusInternalServerError,
+				fmt.Sprintf("Import stopped after %d records: %s", progress.Imported, err), w)
+		default:
+			common.ErrorResponse(http.StatusBadRequest,
+				fmt.Sprintf("Import stopped after %d records: %s", progress.Imported, err), w)
+		}
+		return
+	}
+	log.Printf("Import: %d records imported and %d rejected in %v", progress.Imported, progress.Rejected, time.Since(start))
+
+	b, _ := json.Marshal(progress)
+	w.Header().Set("Content-Type", common.DefaultMIMEType)
+	w.Write(b)
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// batchStorage records the submitted batches
+type batchStorage struct {
+	dummyDataStorage
+	batches []map[string]senml.Pack
+}
+
+func (s *batchStorage) Submit(data map[string]senml.Pack, sources map[string]*registry.DataStream) error {
+	s.batches = append(s.batches, data)
+	return nil
+}
+
+func TestImportCSV(t *testing.T) {
+	regStorage := registry.NewMemoryStorage(common.RegConf{})
+	_, err := regStorage.Add(registry.DataStream{Name: "import/switch", Type: common.BOOL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := &batchStorage{}
+	importer := NewImporter(regStorage, storage, true, 2)
+
+	csv := `name,time,value,unit
+import/temperature,1546300800,21.5,Cel
+import/temperature,2019-01-01T00:01:00Z,22
+import/switch,1546300800,true
+import/switch,1546300860,maybe
+import/label,1546300800,kitchen
+`
+	progresses := 0
+	progress, err := importer.Import(strings.NewReader(csv), MediaTypeCSV, func(ImportProgress) { progresses++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Imported != 4 || progress.Rejected != 1 || len(progress.Errors) != 1 || progresses != 2 || len(storage.batches) != 2 {
+		t.Fatalf("Unexpected progress: %+v after %d batches", progress, len(storage.batches))
+	}
+	temperature := storage.batches[0]["import/temperature"]
+	if len(temperature) != 2 || *temperature[0].Value != 21.5 || temperature[0].Unit != "Cel" || temperature[1].Time != 1546300860 {
+		t.Errorf("Unexpected records: %+v", temperature)
+	}
+
+	// registered by the inferred types
+	for name, dataType := range map[string]string{"import/temperature": common.FLOAT, "import/label": common.STRING} {
+		ds, err := regStorage.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ds.Type != dataType {
+			t.Errorf("Expected %s to be registered as %s, got %s", name, dataType, ds.Type)
+		}
+	}
+}
+
+func TestImportSenML(t *testing.T) {
+	regStorage := registry.NewMemoryStorage(common.RegConf{})
+	storage := &batchStorage{}
+	importer := NewImporter(regStorage, storage, false, 0)
+	_, err := regStorage.Add(registry.DataStream{Name: "import/a", Type: common.FLOAT})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the base fields apply to the following records
+	pack := `[{"bn":"import/","bt":1546300800,"n":"a","v":1},{"n":"a","t":60,"v":2},{"n":"b","v":3}]`
+	progress, err := importer.Import(strings.NewReader(pack), senml.MediaTypeSenmlJSON, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Imported != 2 || progress.Rejected != 1 {
+		t.Fatalf("Unexpected progress: %+v", progress)
+	}
+	records := storage.batches[0]["import/a"]
+	if len(records) != 2 || records[1].Time != 1546300860 {
+		t.Errorf("Unexpected records: %+v", records)
+	}
+
+	// the import stops on invalid input
+	_, err = importer.Import(strings.NewReader(`[{"n":"import/a","v":1},{"n":`), senml.MediaTypeSenmlJSON, nil)
+	if err == nil {
+		t.Errorf("Expected an error for invalid JSON")
+	}
+}
+
+func TestImportHandler(t *testing.T) {
+	regStorage := registry.NewMemoryStorage(common.RegConf{})
+	api := NewAPI(regStorage, &batchStorage{}, nil, nil, true)
+
+	for contentType, expected := range map[string]int{
+		MediaTypeCSV:                     http.StatusOK,
+		"application/octet-stream":       http.StatusUnsupportedMediaType,
+		senml.MediaTypeSenmlJSON:         http.StatusBadRequest,
+		MediaTypeCSV + "; charset=utf-8": http.StatusOK,
+	} {
+		body := "import/handler," + time.Now().Format(time.RFC3339) + ",1\n"
+		r := httptest.NewRequest("POST", "/data/import", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		api.Import(w, r)
+		if w.Code != expected {
+			t.Errorf("Expected %d for %s, got %d: %s", expected, contentType, w.Code, w.Body)
+		}
+	}
+}
+
+func TestImportTooLarge(t *testing.T) {
+	regStorage := registry.NewMemoryStorage(common.RegConf{})
+	api := NewAPI(regStorage, &batchStorage{}, nil, nil, true)
+
+	body := bytes.NewReader(make([]byte, MaxBufferedImportSize+1))
+	r := httptest.NewRequest("POST", "/data/import", body)
+	r.Header.Set("Content-Type", senml.MediaTypeSenmlCBOR)
+	w := httptest.NewRecorder()
+	api.Import(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusRequestEntityTooLarge, w.Code, w.Body)
+	}
+}
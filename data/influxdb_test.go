@@ -0,0 +1,183 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/linksmart/historical-datastore/common"
+)
+
+// fakeInflux is a stand-in for the HTTP API of InfluxDB, which understands the statements of InfluxStorage
+type fakeInflux struct {
+	sync.Mutex
+	// fields and tags of the points by measurement and time
+	points map[string]map[int64]map[string]interface{}
+}
+
+var (
+	influxName      = `"((?:[^"\\]|\\.)*)"`
+	influxRange     = `time >= (-?\d+) AND time <= (-?\d+)`
+	influxSelect    = regexp.MustCompile(`^SELECT \* FROM ` + influxName + ` WHERE ` + influxRange + ` ORDER BY time (ASC|DESC)(?: LIMIT (\d+))?$`)
+	influxCount     = regexp.MustCompile(`^SELECT COUNT\(` + influxName + `\) FROM ` + influxName + ` WHERE ` + influxRange + `$`)
+	influxDelete    = regexp.MustCompile(`^DELETE FROM ` + influxName + ` WHERE ` + influxRange + `$`)
+	influxDrop      = regexp.MustCompile(`^DROP MEASUREMENT ` + influxName + `$`)
+	influxUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\,`, `,`, `\ `, ` `, `\=`, `=`)
+)
+
+func (f *fakeInflux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	if r.URL.Query().Get("db") != "hds" {
+		http.Error(w, `{"error":"database not found"}`, http.StatusNotFound)
+		return
+	}
+	switch r.URL.Path {
+	case "/write":
+		body, _ := ioutil.ReadAll(r.Body)
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			f.write(line)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "/query":
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": []interface{}{f.query(r.URL.Query().Get("q"))}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// write stores a point of the line protocol
+func (f *fakeInflux) write(line string) {
+	// split at the unescaped spaces outside of quotes
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\':
+			i++
+		case line[i] == '"':
+			quoted = !quoted
+		case line[i] == ' ' && !quoted:
+			parts = append(parts, line[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, line[start:])
+
+	point := make(map[string]interface{})
+	key := regexp.MustCompile(`^((?:[^,\\]|\\.)*)(?:,unit=(.*))?$`).FindStringSubmatch(parts[0])
+	measurement := influxUnescaper.Replace(key[1])
+	if key[2] != "" {
+		point[influxUnit] = influxUnescaper.Replace(key[2])
+	}
+	field := strings.SplitN(parts[1], "=", 2)
+	switch value := field[1]; {
+	case strings.HasPrefix(value, `"`):
+		point[field[0]] = influxUnescaper.Replace(value[1 : len(value)-1])
+	case value == "true" || value == "false":
+		point[field[0]] = value == "true"
+	default:
+		point[field[0]], _ = strconv.ParseFloat(value, 64)
+	}
+	t, _ := strconv.ParseInt(parts[2], 10, 64)
+	if f.points[measurement] == nil {
+		f.points[measurement] = make(map[int64]map[string]interface{})
+	}
+	f.points[measurement][t] = point
+}
+
+// inRange returns the times of the points of the measurement within the range in ascending order
+func (f *fakeInflux) inRange(measurement, from, to string) []int64 {
+	lower, _ := strconv.ParseInt(from, 10, 64)
+	upper, _ := strconv.ParseInt(to, 10, 64)
+	var times []int64
+	for t := range f.points[influxUnescaper.Replace(measurement)] {
+		if t >= lower && t <= upper {
+			times = append(times, t)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times
+}
+
+func (f *fakeInflux) query(q string) map[string]interface{} {
+	result := map[string]interface{}{"statement_id": 0}
+	switch {
+	case strings.HasPrefix(q, "CREATE DATABASE "):
+	case influxSelect.MatchString(q):
+		m := influxSelect.FindStringSubmatch(q)
+		times := f.inRange(m[1], m[2], m[3])
+		if m[4] == "DESC" {
+			sort.Slice(times, func(i, j int) bool { return times[i] > times[j] })
+		}
+		if limit, err := strconv.Atoi(m[5]); err == nil && limit < len(times) {
+			times = times[:limit]
+		}
+		if len(times) == 0 {
+			break
+		}
+		columns := []string{"time", influxBoolValue, influxDataValue, influxStringValue, influxUnit, influxValue}
+		var values [][]interface{}
+		for _, t := range times {
+			point := f.points[influxUnescaper.Replace(m[1])][t]
+			row := []interface{}{t}
+			for _, c := range columns[1:] {
+				row = append(row, point[c])
+			}
+			values = append(values, row)
+		}
+		result["series"] = []interface{}{map[string]interface{}{"name": m[1], "columns": columns, "values": values}}
+	case influxCount.MatchString(q):
+		m := influxCount.FindStringSubmatch(q)
+		count := 0
+		for _, t := range f.inRange(m[2], m[3], m[4]) {
+			if _, found := f.points[influxUnescaper.Replace(m[2])][t][m[1]]; found {
+				count++
+			}
+		}
+		if count > 0 {
+			result["series"] = []interface{}{map[string]interface{}{"name": m[2], "columns": []string{"time", "count"},
+				"values": [][]interface{}{{0, count}}}}
+		}
+	case influxDelete.MatchString(q):
+		m := influxDelete.FindStringSubmatch(q)
+		for _, t := range f.inRange(m[1], m[2], m[3]) {
+			delete(f.points[influxUnescaper.Replace(m[1])], t)
+		}
+	case influxDrop.MatchString(q):
+		delete(f.points, influxUnescaper.Replace(influxDrop.FindStringSubmatch(q)[1]))
+	default:
+		result["error"] = "unsupported statement: " + q
+	}
+	return result
+}
+
+// FakeInfluxStorage returns an InfluxStorage connected to a new fakeInflux, which is closed with the cleanup of the test
+func FakeInfluxStorage(t *testing.T) *InfluxStorage {
+	ts := httptest.NewServer(&fakeInflux{points: make(map[string]map[int64]map[string]interface{})})
+	t.Cleanup(ts.Close)
+
+	storage, _, err := NewInfluxStorage(common.DataConf{Backend: common.DataBackendConf{Type: INFLUXDB, DSN: ts.URL + "/hds"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func TestInfluxEscape(t *testing.T) {
+	if s := influxEscape(`a b,c=d`, ", "); s != `a\ b\,c=d` {
+		t.Errorf("Unexpected escaped measurement: %s", s)
+	}
+	if s := influxQuote(`say "hi" \o/`); s != `"say \"hi\" \\o/"` {
+		t.Errorf("Unexpected quoted string: %s", s)
+	}
+}
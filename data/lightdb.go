@@ -4,30 +4,38 @@ import (
 	"fmt"
 	"time"
 
-	datastore "github.com/dschowta/senml.datastore"
 	"github.com/farshidtz/senml"
 	"github.com/linksmart/historical-datastore/common"
 	"github.com/linksmart/historical-datastore/registry"
 )
 
+const (
+	streamChunkSize = 10000 // records per read transaction
+)
+
+func init() {
+	RegisterBackend(SENMLSTORE, func(conf common.DataConf) (Storage, func() error, error) {
+		return NewSenmlStorage(conf)
+	})
+}
+
 type LightdbStorage struct {
-	storage *datastore.SenmlDataStore
+	series *boltSeries
 }
 
 func NewSenmlStorage(conf common.DataConf) (storage *LightdbStorage, disconnect_func func() error, err error) {
-	datastore := new(datastore.SenmlDataStore)
-	err = datastore.Connect(conf.Backend.DSN)
+	series, err := openBoltSeries(conf.Backend.DSN)
 	if err != nil {
 		return nil, nil, err
 	}
 	storage = new(LightdbStorage)
-	storage.storage = datastore
+	storage.series = series
 	return storage, storage.Disconnect, nil
 }
 
 func (s *LightdbStorage) Submit(data map[string]senml.Pack, sources map[string]*registry.DataStream) error {
 	for _, dps := range data {
-		err := s.storage.Add(dps)
+		err := s.series.add(dps)
 		if err != nil {
 			return fmt.Errorf("error creating batch points: %s", err)
 		}
@@ -35,68 +43,80 @@ func (s *LightdbStorage) Submit(data map[string]senml.Pack, sources map[string]*
 	return nil
 }
 
-func (s *LightdbStorage) Query(q Query, sources ...*registry.DataStream) (senml.Pack, int, *time.Time, error) {
-	//TODO: Support multidimensional queries
-	/*Multi dimensional queries have problems with pagination:
-
-	1. Multinextlinks (each dimension in a multidimensional time series gives a next link)
-		1. +handles all the multidimensional scenarios
-		2. - overhead on client to keep track of time series
-	2. Combined response: (a combined list is given with a single next link)
-		1. +handles all the multidimensional scnarios
-		2. - overhead on server to combine the results and deduce the nextlink
-
-	*/
-	//TODO: Is this a right place to decide the maxentries? Should be at API level
-	maxEntries := q.perPage
-	if q.Limit > 0 && q.perPage > q.Limit { //if limit is provided by the user and it is less than perPage, then use the limit
-		maxEntries = q.Limit
-	}
-
-	senmlQuery := datastore.Query{
-		From:       datastore.ToSenmlTime(q.From),
-		To:         datastore.ToSenmlTime(q.To),
-		MaxEntries: maxEntries,
-		Series:     sources[0].Name,
-		Sort:       q.Sort,
-	}
-	retPack, nextlink, err := s.storage.Query(senmlQuery)
-	if err != nil {
-		return nil, 0, nil, err
+func (s *LightdbStorage) Query(q Query, sources ...*registry.DataStream) (senml.Pack, int, Cursor, error) {
+	if len(q.Aggregates) > 0 {
+		return aggregatePages(q, sources, s.querySeries)
 	}
+	return queryPages(q, sources, s.querySeries)
+}
 
-	var nextLinkTime *time.Time
+func (s *LightdbStorage) querySeries(ds *registry.DataStream, from, to time.Time, order string, max int) (senml.Pack, *time.Time, error) {
+	return s.series.query(ds.Name, from, to, order, max)
+}
 
-	if nextlink != nil {
-		t := datastore.FromSenmlTime(*nextlink)
-		nextLinkTime = &t
+// QueryStream reads the data points in chunks, each within a separate read transaction to not hold off the writers
+func (s *LightdbStorage) QueryStream(q Query, ds *registry.DataStream, send func(senml.Record) error) error {
+	from, to := q.From, q.To
+	for {
+		pack, next, err := s.series.query(ds.Name, from, to, q.Sort, streamChunkSize)
+		if err != nil {
+			return err
+		}
+		for _, r := range pack {
+			if err := send(r); err != nil {
+				return err
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		if q.Sort == common.DESC {
+			to = *next
+		} else {
+			from = *next
+		}
 	}
+}
 
-	return retPack, len(retPack), nextLinkTime, nil
+func (s *LightdbStorage) Delete(sources []*registry.DataStream, from time.Time, to time.Time) (int, error) {
+	total := 0
+	for _, ds := range sources {
+		count, err := s.series.deleteRange(ds.Name, from, to)
+		if err != nil {
+			return total, fmt.Errorf("error deleting data points of %s: %s", ds.Name, err)
+		}
+		total += count
+	}
+	return total, nil
 }
 
 func (s *LightdbStorage) Disconnect() error {
-	return s.storage.Disconnect()
+	return s.series.close()
+}
+
+// Snapshot calls f with a read-only copy of the data
+// The copy is written to disk within a read transaction, so that f may take long without holding off the writers.
+func (s *LightdbStorage) Snapshot(f func(snapshot Storage) error) error {
+	series, err := s.series.snapshot()
+	if err != nil {
+		return err
+	}
+	defer series.remove()
+	return f(&LightdbStorage{series: series})
 }
 
 // CreateHandler handles the creation of a new data source
 func (s *LightdbStorage) CreateHandler(ds registry.DataStream) error {
-	return s.storage.Create(ds.Name)
+	return s.series.create(ds.Name)
 }
 
 // UpdateHandler handles updates of a data source
+// Retention is enforced by the RetentionManager
 func (s *LightdbStorage) UpdateHandler(oldDS registry.DataStream, newDS registry.DataStream) error {
-	//TODO supporting retetion
-
 	return nil
 }
 
 // DeleteHandler handles deletion of a data source
 func (s *LightdbStorage) DeleteHandler(ds registry.DataStream) error {
-	err := s.storage.Delete(ds.Name)
-	if err != nil && err != datastore.ErrSeriesNotFound {
-		return err
-	}
-	//log.Println("LightdbStorage: dropped measurements for", ds.Name)
-	return nil
+	return s.series.drop(ds.Name)
 }
@@ -0,0 +1,242 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+	datastore "github.com/dschowta/senml.datastore"
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+)
+
+// boltSeries keeps the data points of every series in a BoltDB bucket
+// The layout is the one of github.com/dschowta/senml.datastore, so that existing databases can be read: the keys
+// are the times in nanoseconds as big-endian integers and the values are the JSON encoded datastore.SenMLDBRecord.
+type boltSeries struct {
+	db *bolt.DB
+}
+
+func openBoltSeries(path string) (*boltSeries, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &boltSeries{db}, nil
+}
+
+func (s *boltSeries) close() error {
+	return s.db.Close()
+}
+
+// snapshot copies the database within a read transaction into a temporary file next to it and opens the copy read-only
+func (s *boltSeries) snapshot() (*boltSeries, error) {
+	f, err := ioutil.TempFile(filepath.Dir(s.db.Path()), filepath.Base(s.db.Path())+".snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(f)
+		return err
+	})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("error copying database: %s", err)
+	}
+
+	db, err := bolt.Open(f.Name(), 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &boltSeries{db}, nil
+}
+
+// remove closes and deletes the database, e.g. of a snapshot
+func (s *boltSeries) remove() error {
+	path := s.db.Path()
+	s.db.Close()
+	return os.Remove(path)
+}
+
+// timeKey returns the key of the data point at the given time. The zero time is the start of the epoch.
+func timeKey(t time.Time) []byte {
+	var ns int64
+	if !t.IsZero() {
+		ns = t.UnixNano()
+	}
+	return nanoKey(ns)
+}
+
+func nanoKey(ns int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(ns))
+	return b
+}
+
+func keyTime(k []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+}
+
+// create adds the bucket of a series
+func (s *boltSeries) create(series string) error {
+	if series == "" {
+		return fmt.Errorf("series with empty name")
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte(series))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		return nil
+	})
+}
+
+// add stores the records of the pack, replacing the ones with the same time
+// The records of all series are written in a single transaction, which may be shared with concurrent calls.
+func (s *boltSeries) add(pack senml.Pack) error {
+	type entry struct {
+		key, value []byte
+	}
+	series := make(map[string][]entry)
+	for _, r := range pack.Normalize() {
+		if r.Name == "" {
+			return fmt.Errorf("SenML record with empty name")
+		}
+		b, err := json.Marshal(datastore.NewBoltSenMLRecord(r))
+		if err != nil {
+			return err
+		}
+		series[r.Name] = append(series[r.Name], entry{nanoKey(int64(r.Time * 1e9)), b})
+	}
+
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		for name, entries := range series {
+			b, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				err = b.Put(e.key, e.value)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// query reads up to max records of a series within the time range (inclusive) in the given order, returning the
+// time of the next record if there are more. A non-positive max means no limit.
+func (s *boltSeries) query(series string, from, to time.Time, order string, max int) (senml.Pack, *time.Time, error) {
+	pack := senml.Pack{}
+	var next *time.Time
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(series))
+		if b == nil {
+			return fmt.Errorf("series %s does not exist", series)
+		}
+		c := b.Cursor()
+		start, end := timeKey(from), timeKey(to)
+
+		var k, v []byte
+		var step func() ([]byte, []byte)
+		var within func(k []byte) bool
+		if order == common.DESC {
+			k, v = c.Seek(end)
+			if k == nil {
+				// the range ends after the last record
+				k, v = c.Last()
+			} else if bytes.Compare(k, end) > 0 {
+				// seeking lands on the first record after the range
+				k, v = c.Prev()
+			}
+			step = c.Prev
+			within = func(k []byte) bool { return bytes.Compare(k, start) >= 0 }
+		} else {
+			k, v = c.Seek(start)
+			step = c.Next
+			within = func(k []byte) bool { return bytes.Compare(k, end) <= 0 }
+		}
+
+		for ; k != nil && within(k); k, v = step() {
+			if max > 0 && len(pack) == max {
+				t := keyTime(k)
+				next = &t
+				break
+			}
+			var record datastore.SenMLDBRecord
+			err := json.Unmarshal(v, &record)
+			if err != nil {
+				return fmt.Errorf("error decoding record of %s: %s", series, err)
+			}
+			pack = append(pack, senml.Record{
+				Name:        series,
+				Unit:        record.Unit,
+				Time:        float64(int64(binary.BigEndian.Uint64(k))) / 1e9,
+				UpdateTime:  record.UpdateTime,
+				Value:       record.Value,
+				StringValue: record.StringValue,
+				DataValue:   record.DataValue,
+				BoolValue:   record.BoolValue,
+				Sum:         record.Sum,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return pack, next, nil
+}
+
+// deleteRange removes the records of a series within the time range (inclusive), returning the number of removed ones
+func (s *boltSeries) deleteRange(series string, from, to time.Time) (int, error) {
+	count := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(series))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		end := timeKey(to)
+		// deleting moves the cursor to the next record, hence seeking again
+		for k, _ := c.Seek(timeKey(from)); k != nil && bytes.Compare(k, end) <= 0; {
+			key := append([]byte{}, k...)
+			err := c.Delete()
+			if err != nil {
+				return err
+			}
+			count++
+			k, _ = c.Seek(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// drop removes the bucket of a series along with its records
+func (s *boltSeries) drop(series string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(series))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	datastore "github.com/dschowta/senml.datastore"
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+func TestLightdbMultiSeriesQuery(t *testing.T) {
+	fileName := os.TempDir() + "/TestLightdbMultiSeriesQuery"
+	deleteFile(fileName)
+	defer deleteFile(fileName)
+	storage, disconnect, err := NewSenmlStorage(common.DataConf{Backend: common.DataBackendConf{Type: SENMLSTORE, DSN: fileName}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disconnect()
+
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	// seconds after start at which each series has a value
+	seconds := map[string][]int{
+		"a": {0, 1, 2, 3},
+		"b": {1, 2},
+		"c": {2, 5},
+	}
+	var sources []*registry.DataStream
+	data := make(map[string]senml.Pack)
+	dsMap := make(map[string]*registry.DataStream)
+	for _, name := range []string{"a", "b", "c"} {
+		ds := &registry.DataStream{Name: name, Type: common.FLOAT}
+		if err := storage.CreateHandler(*ds); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range seconds[name] {
+			v := float64(s)
+			data[name] = append(data[name], senml.Record{Name: name, Value: &v, Time: float64(start.Add(time.Duration(s) * time.Second).Unix())})
+		}
+		sources = append(sources, ds)
+		dsMap[name] = ds
+	}
+	if err := storage.Submit(data, dsMap); err != nil {
+		t.Fatal(err)
+	}
+
+	// queries all pages and returns the entries as name@second
+	queryAll := func(q Query) (pages [][]string) {
+		for {
+			pack, _, cursor, err := storage.Query(q, sources...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var page []string
+			for _, r := range pack {
+				page = append(page, fmt.Sprintf("%s@%d", r.Name, int64(r.Time)-start.Unix()))
+			}
+			pages = append(pages, page)
+			if cursor == nil {
+				return pages
+			}
+			if len(pages) > 10 {
+				t.Fatalf("Too many pages: %v", pages)
+			}
+			q.Cursor = cursor
+		}
+	}
+
+	q := Query{
+		From:    start,
+		To:      start.Add(time.Minute),
+		Sort:    common.ASC,
+		Limit:   -1,
+		perPage: 4,
+	}
+	expected := fmt.Sprint([][]string{{"a@0", "a@1", "b@1", "a@2"}, {"b@2", "c@2", "a@3", "c@5"}})
+	if pages := fmt.Sprint(queryAll(q)); pages != expected {
+		t.Errorf("Expected ascending pages %s, got %s", expected, pages)
+	}
+
+	// the end of the range is between two entries of c
+	q.Sort = common.DESC
+	q.To = start.Add(4500 * time.Millisecond)
+	expected = fmt.Sprint([][]string{{"a@3", "a@2", "b@2", "c@2"}, {"a@1", "b@1", "a@0"}})
+	if pages := fmt.Sprint(queryAll(q)); pages != expected {
+		t.Errorf("Expected descending pages %s, got %s", expected, pages)
+	}
+}
+
+func TestLightdbExistingDatabase(t *testing.T) {
+	fileName := os.TempDir() + "/TestLightdbExistingDatabase"
+	deleteFile(fileName)
+	defer deleteFile(fileName)
+
+	// a database written by the senml.datastore package
+	legacy := new(datastore.SenmlDataStore)
+	if err := legacy.Connect(fileName); err != nil {
+		t.Fatal(err)
+	}
+	v, s, b := 1.5, "on", true
+	pack := senml.Pack{
+		{Name: "legacy/float", Value: &v, Unit: "degC", Time: 1546300800.5},
+		{Name: "legacy/string", StringValue: s, Time: 1546300801},
+		{Name: "legacy/bool", BoolValue: &b, Time: 1546300802},
+	}
+	if err := legacy.Add(pack); err != nil {
+		t.Fatal(err)
+	}
+	if err := legacy.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, disconnect, err := NewSenmlStorage(common.DataConf{Backend: common.DataBackendConf{Type: SENMLSTORE, DSN: fileName}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disconnect()
+	q := Query{From: time.Unix(0, 0), To: time.Now(), Sort: common.ASC, Limit: -1, perPage: MaxPerPage}
+	for _, expected := range pack {
+		got, _, _, err := storage.Query(q, &registry.DataStream{Name: expected.Name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0].Time != expected.Time || got[0].Unit != expected.Unit || got[0].StringValue != expected.StringValue ||
+			(expected.Value != nil) != (got[0].Value != nil) || (expected.BoolValue != nil) != (got[0].BoolValue != nil) {
+			t.Fatalf("Expected %v, got %v", expected, got)
+		}
+	}
+}
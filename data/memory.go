@@ -0,0 +1,236 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	datastore "github.com/dschowta/senml.datastore"
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+const (
+	defaultMemoryCapacity = 100000 // data points per series
+)
+
+func init() {
+	RegisterBackend(MEMORY, func(conf common.DataConf) (Storage, func() error, error) {
+		return NewMemoryStorage(conf)
+	})
+}
+
+// MemoryStorage keeps the latest data points of every series in memory, dropping the oldest ones when a series
+// exceeds the capacity. The capacity is set in the DSN, e.g. memory:?capacity=1000
+type MemoryStorage struct {
+	sync.RWMutex
+	capacity int
+	series   map[string]*ring
+}
+
+func NewMemoryStorage(conf common.DataConf) (*MemoryStorage, func() error, error) {
+	u, err := url.Parse(conf.Backend.DSN)
+	if err != nil {
+		return nil, nil, err
+	}
+	capacity := defaultMemoryCapacity
+	if v := u.Query().Get("capacity"); v != "" {
+		capacity, err = strconv.Atoi(v)
+		if err != nil || capacity <= 0 {
+			return nil, nil, fmt.Errorf("invalid capacity of the memory storage: %s", v)
+		}
+	}
+	s := &MemoryStorage{
+		capacity: capacity,
+		series:   make(map[string]*ring),
+	}
+	return s, func() error { return nil }, nil
+}
+
+// ring is a ring buffer of data points sorted by time, which grows up to its capacity
+type ring struct {
+	entries  []memoryEntry
+	start, n int
+	capacity int
+}
+
+type memoryEntry struct {
+	time   int64
+	record senml.Record
+}
+
+func (r *ring) at(i int) *memoryEntry {
+	return &r.entries[(r.start+i)%len(r.entries)]
+}
+
+// search returns the range of indices [lo, hi) of the entries within the time range (inclusive)
+func (r *ring) search(from, to time.Time) (lo, hi int) {
+	f, t := unixNano(from), unixNano(to)
+	lo = sort.Search(r.n, func(i int) bool {
+		return r.at(i).time >= f
+	})
+	hi = sort.Search(r.n, func(i int) bool {
+		return r.at(i).time > t
+	})
+	if hi < lo {
+		hi = lo
+	}
+	return lo, hi
+}
+
+// insert adds the entry in time order, replacing any at the same time
+func (r *ring) insert(e memoryEntry) {
+	pos := sort.Search(r.n, func(i int) bool {
+		return r.at(i).time >= e.time
+	})
+	if pos < r.n && r.at(pos).time == e.time {
+		*r.at(pos) = e
+		return
+	}
+	if r.n == r.capacity {
+		if pos == 0 { // older than everything kept
+			return
+		}
+		// drop the oldest
+		r.start = (r.start + 1) % len(r.entries)
+		r.n--
+		pos--
+	} else if r.n == len(r.entries) {
+		// not full yet, so the ring has not wrapped around
+		r.entries = append(r.entries, memoryEntry{})
+	}
+	for i := r.n; i > pos; i-- {
+		*r.at(i) = *r.at(i - 1)
+	}
+	*r.at(pos) = e
+	r.n++
+}
+
+// remove removes the entries in the range of indices [from, to)
+func (r *ring) remove(from, to int) {
+	for i := to; i < r.n; i++ {
+		*r.at(i - to + from) = *r.at(i)
+	}
+	r.n -= to - from
+}
+
+// unixNano returns the nanoseconds since the epoch, limited to the range of int64
+func unixNano(t time.Time) int64 {
+	switch {
+	case t.Before(time.Unix(0, math.MinInt64)):
+		return math.MinInt64
+	case t.After(time.Unix(0, math.MaxInt64)):
+		return math.MaxInt64
+	}
+	return t.UnixNano()
+}
+
+func (s *MemoryStorage) Submit(data map[string]senml.Pack, sources map[string]*registry.DataStream) error {
+	s.Lock()
+	defer s.Unlock()
+	for name, pack := range data {
+		series, found := s.series[name]
+		if !found {
+			series = &ring{capacity: s.capacity}
+			s.series[name] = series
+		}
+		for _, r := range pack {
+			// keyed like the cursors of the queries
+			series.insert(memoryEntry{datastore.FromSenmlTime(r.Time).UnixNano(), r})
+		}
+	}
+	return nil
+}
+
+// Atomic returns true, as submissions never fail
+func (s *MemoryStorage) Atomic() bool {
+	return true
+}
+
+func (s *MemoryStorage) Query(q Query, sources ...*registry.DataStream) (senml.Pack, int, Cursor, error) {
+	if len(q.Aggregates) > 0 {
+		return aggregatePages(q, sources, s.querySeries)
+	}
+	return queryPages(q, sources, s.querySeries)
+}
+
+func (s *MemoryStorage) querySeries(ds *registry.DataStream, from, to time.Time, order string, max int) (senml.Pack, *time.Time, error) {
+	s.RLock()
+	defer s.RUnlock()
+	pack := senml.Pack{}
+	series, found := s.series[ds.Name]
+	if !found {
+		return pack, nil, nil
+	}
+	lo, hi := series.search(from, to)
+	count := hi - lo
+	if max > 0 && count > max {
+		count = max
+	}
+
+	var next *time.Time
+	for i := 0; i < count; i++ {
+		if order == common.DESC {
+			pack = append(pack, series.at(hi-1-i).record)
+		} else {
+			pack = append(pack, series.at(lo+i).record)
+		}
+	}
+	if count < hi-lo {
+		var t time.Time
+		if order == common.DESC {
+			t = time.Unix(0, series.at(hi-1-count).time).UTC()
+		} else {
+			t = time.Unix(0, series.at(lo+count).time).UTC()
+		}
+		next = &t
+	}
+	return pack, next, nil
+}
+
+func (s *MemoryStorage) Delete(sources []*registry.DataStream, from time.Time, to time.Time) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	total := 0
+	for _, ds := range sources {
+		series, found := s.series[ds.Name]
+		if !found {
+			continue
+		}
+		lo, hi := series.search(from, to)
+		series.remove(lo, hi)
+		total += hi - lo
+	}
+	return total, nil
+}
+
+// CreateHandler handles the creation of a new data source
+func (s *MemoryStorage) CreateHandler(ds registry.DataStream) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, found := s.series[ds.Name]; !found {
+		s.series[ds.Name] = &ring{capacity: s.capacity}
+	}
+	return nil
+}
+
+// UpdateHandler handles updates of a data source
+// Retention is enforced by the RetentionManager
+func (s *MemoryStorage) UpdateHandler(oldDS registry.DataStream, newDS registry.DataStream) error {
+	return nil
+}
+
+// DeleteHandler handles deletion of a data source
+func (s *MemoryStorage) DeleteHandler(ds registry.DataStream) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.series, ds.Name)
+	return nil
+}
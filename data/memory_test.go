@@ -0,0 +1,69 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+func TestMemoryStorageCapacity(t *testing.T) {
+	storage, _, err := NewMemoryStorage(common.DataConf{Backend: common.DataBackendConf{Type: MEMORY, DSN: "memory:?capacity=3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := &registry.DataStream{Name: "ring", Type: common.FLOAT}
+	submit := func(seconds ...int) {
+		var pack senml.Pack
+		for _, s := range seconds {
+			v := float64(s)
+			pack = append(pack, senml.Record{Name: ds.Name, Value: &v, Time: float64(s)})
+		}
+		if err := storage.Submit(map[string]senml.Pack{ds.Name: pack}, map[string]*registry.DataStream{ds.Name: ds}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kept := func() (values []float64) {
+		q := Query{From: time.Unix(0, 0), To: time.Unix(100, 0), Sort: common.ASC, Limit: -1}
+		pack, _, _, err := storage.Query(q, ds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range pack {
+			values = append(values, *r.Value)
+		}
+		return values
+	}
+	equal := func(a []float64, b ...float64) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	submit(1, 2, 3, 4, 5)
+	if values := kept(); !equal(values, 3, 4, 5) {
+		t.Fatalf("Expected the latest 3 values, got %v", values)
+	}
+	// out of order, older than everything kept
+	submit(2, 7, 6)
+	if values := kept(); !equal(values, 5, 6, 7) {
+		t.Fatalf("Expected the values to be sorted, got %v", values)
+	}
+	if _, err := storage.Delete([]*registry.DataStream{ds}, time.Unix(6, 0), time.Unix(6, 0)); err != nil {
+		t.Fatal(err)
+	}
+	submit(8)
+	if values := kept(); !equal(values, 5, 7, 8) {
+		t.Fatalf("Expected the value to be added after the deletion, got %v", values)
+	}
+}
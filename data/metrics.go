@@ -0,0 +1,33 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/metrics"
+)
+
+// Sources of the ingested records
+const (
+	sourceHTTP   = "http"
+	sourceMQTT   = "mqtt"
+	sourceImport = "import"
+)
+
+var (
+	ingestedRecords = metrics.NewCounterVec("hds_ingested_records_total",
+		"Number of records stored per data stream and source protocol.", "stream", "source")
+	queryDuration = metrics.NewHistogramVec("hds_query_duration_seconds",
+		"Duration of the storage queries of the Data API.", metrics.DefBuckets)
+	batchRecords = metrics.NewHistogramVec("hds_ingest_batch_records",
+		"Number of records written per batch of the ingest queue.", []float64{1, 10, 100, 1000, 10000})
+	replicatedRecords = metrics.NewCounterVec("hds_replicated_records_total",
+		"Number of records forwarded to the remote Historical Datastore per data stream.", "stream")
+)
+
+// countIngested counts the records which are stored
+func countIngested(data map[string]senml.Pack, source string) {
+	for name, pack := range data {
+		ingestedRecords.Add(float64(len(pack)), name, source)
+	}
+}
@@ -3,8 +3,15 @@
 package data
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,7 +20,7 @@ import (
 	"net/http"
 
 	paho "github.com/eclipse/paho.mqtt.golang"
-	"github.com/linksmart/historical-datastore/common"
+	"github.com/farshidtz/mqtt-match"
 	"github.com/linksmart/historical-datastore/registry"
 )
 
@@ -23,39 +30,75 @@ const (
 
 type MQTTConnector struct {
 	sync.Mutex
-	registry registry.Storage
-	storage  Storage
-	clientID string
+	registry    registry.Storage
+	storage     Storage
+	deadLetters *DeadLetterStore
+	clientID    string
+	// directory of the persistent sessions
+	storeDir string
+	// managers by broker and client ID
 	managers map[string]*Manager
-	// cache of resource->ds
-	cache map[string]*registry.DataStream
+	// cache of resource->ds, which is accessed by the message handlers of all clients
+	cacheLock sync.RWMutex
+	cache     map[string]*registry.DataStream
 	// failed mqtt registrations
 	failedRegistrations map[string]*registry.MQTTSource
+	// statistics of the data streams and message counters of the managers
+	statsLock sync.Mutex
+	stats     map[string]*streamStats
+	// copies of the states of the managers and the failed registrations, guarded by the statsLock,
+	// to report the status without waiting for the lock which is held while talking to the brokers
+	managerStates map[string]managerState
+	pending       map[string]bool
+	// closed on Stop
+	stop chan struct{}
 }
 
 type Manager struct {
-	url    string
-	client paho.Client
-	// connector *MQTTConnector
-	// total subscriptions for each topic in this manager
+	url      string
+	clientID string
+	client   paho.Client
+	// session options shared by the subscriptions
+	cleanSession bool
+	keepAlive    int
+	connector    *MQTTConnector
+	// subscriptions for each topic filter in this manager
 	subscriptions map[string]*Subscription
+	// connection status
+	lastConnect    time.Time
+	lastDisconnect time.Time
+	lastError      string
+	// received messages, guarded by the statsLock of the connector
+	messages    uint64
+	lastMessage time.Time
 }
 
+// Subscription is a topic filter of one or more data streams
+// Only the filters which are not covered by other filters are subscribed to at the broker,
+// to avoid receiving overlapping messages more than once
 type Subscription struct {
-	connector *MQTTConnector
-	url       string
 	topic     string
 	qos       byte
 	receivers int
+	// subscribed at the broker
+	active bool
 }
 
-func NewMQTTConnector(storage Storage, clientID string) (*MQTTConnector, error) {
+// NewMQTTConnector returns a connector which subscribes to the MQTT sources of data streams
+// The state of persistent sessions (cleanSession=false) is stored under the given directory
+func NewMQTTConnector(storage Storage, deadLetters *DeadLetterStore, clientID, storeDir string) (*MQTTConnector, error) {
 	c := &MQTTConnector{
 		storage:             storage,
+		deadLetters:         deadLetters,
 		clientID:            clientID,
+		storeDir:            storeDir,
 		managers:            make(map[string]*Manager),
 		cache:               make(map[string]*registry.DataStream),
 		failedRegistrations: make(map[string]*registry.MQTTSource),
+		stats:               make(map[string]*streamStats),
+		managerStates:       make(map[string]managerState),
+		pending:             make(map[string]bool),
+		stop:                make(chan struct{}),
 	}
 	return c, nil
 }
@@ -76,6 +119,7 @@ func (c *MQTTConnector) Start(reg registry.Storage) error {
 				if err != nil {
 					log.Printf("MQTT: Error registering subscription: %v. Retrying in %ds", err, mqttRetryInterval)
 					c.failedRegistrations[ds.Name] = ds.Source.MQTTSource
+					c.streamError(ds.Name, err)
 				}
 			}
 		}
@@ -84,6 +128,7 @@ func (c *MQTTConnector) Start(reg registry.Storage) error {
 			break
 		}
 	}
+	c.snapshotStatus()
 
 	go c.retryRegistrations()
 
@@ -91,36 +136,101 @@ func (c *MQTTConnector) Start(reg registry.Storage) error {
 }
 
 func (c *MQTTConnector) flushCache() {
+	c.cacheLock.Lock()
 	c.cache = make(map[string]*registry.DataStream)
+	c.cacheLock.Unlock()
+}
+
+// cached returns the cached data stream of the resource
+func (c *MQTTConnector) cached(name string) (*registry.DataStream, bool) {
+	c.cacheLock.RLock()
+	defer c.cacheLock.RUnlock()
+	ds, exists := c.cache[name]
+	return ds, exists
+}
+
+func (c *MQTTConnector) cacheDataStream(name string, ds *registry.DataStream) {
+	c.cacheLock.Lock()
+	c.cache[name] = ds
+	c.cacheLock.Unlock()
 }
 
 func (c *MQTTConnector) retryRegistrations() {
 	for {
-		time.Sleep(mqttRetryInterval * time.Second)
+		select {
+		case <-time.After(mqttRetryInterval * time.Second):
+		case <-c.stop:
+			return
+		}
 		c.Lock()
 		for id, mqttSource := range c.failedRegistrations {
 			err := c.register(*mqttSource)
 			if err != nil {
 				log.Printf("MQTT: Error registering subscription: %v. Retrying in %ds", err, mqttRetryInterval)
+				c.streamError(id, err)
 				continue
 			}
 			delete(c.failedRegistrations, id)
 		}
+		c.snapshotStatus()
 		c.Unlock()
 	}
 }
 
+// Stop unsubscribes from all topics and disconnects from the brokers
+// Messages which are being processed are given up to the quiesce duration (in ms) to be stored
+func (c *MQTTConnector) Stop(quiesce uint) {
+	c.Lock()
+	defer c.Unlock()
+	defer c.snapshotStatus()
+	select {
+	case <-c.stop:
+		return
+	default:
+		close(c.stop)
+	}
+
+	for key, m := range c.managers {
+		// persistent sessions keep their subscriptions at the broker to receive the messages published in the meantime
+		if m.cleanSession {
+			for topic, s := range m.subscriptions {
+				if !s.active {
+					continue
+				}
+				if token := m.client.Unsubscribe(topic); token.WaitTimeout(time.Duration(quiesce)*time.Millisecond) && token.Error() != nil {
+					log.Printf("MQTT: %s: Error unsubscribing from %s: %v", m.url, topic, token.Error())
+				}
+			}
+		}
+		m.client.Disconnect(quiesce)
+		delete(c.managers, key)
+		log.Printf("MQTT: %s: Disconnected!", m.url)
+	}
+}
+
 func (c *MQTTConnector) register(source registry.MQTTSource) error {
+	// load the certificates even for existing clients to report invalid files
+	tlsConfig, err := newTLSConfig(source)
+	if err != nil {
+		return fmt.Errorf("MQTT: Error configuring TLS for broker %v: %v", source.BrokerURL, err)
+	}
 
-	if _, exists := c.managers[source.BrokerURL]; !exists { // NO CLIENT FOR THIS BROKER
+	clientID := c.sourceClientID(source)
+	cleanSession := source.CleanSession == nil || *source.CleanSession
+	key := managerKey(source.BrokerURL, clientID)
+
+	if _, exists := c.managers[key]; !exists { // NO CLIENT FOR THIS BROKER
 		manager := &Manager{
 			url:           source.BrokerURL,
+			clientID:      clientID,
+			cleanSession:  cleanSession,
+			keepAlive:     source.KeepAlive,
+			connector:     c,
 			subscriptions: make(map[string]*Subscription),
 		}
 
+		// subscribed once connected
 		manager.subscriptions[source.Topic] = &Subscription{
-			connector: c,
-			url:       source.BrokerURL,
 			topic:     source.Topic,
 			qos:       source.QoS,
 			receivers: 1,
@@ -128,40 +238,55 @@ func (c *MQTTConnector) register(source registry.MQTTSource) error {
 
 		opts := paho.NewClientOptions() // uses defaults: https://godoc.org/github.com/eclipse/paho.mqtt.golang#NewClientOptions
 		opts.AddBroker(source.BrokerURL)
-		opts.SetClientID(fmt.Sprintf("HDS-%s", c.clientID))
+		opts.SetClientID(clientID)
+		opts.SetCleanSession(cleanSession)
+		if source.KeepAlive > 0 {
+			opts.SetKeepAlive(time.Duration(source.KeepAlive) * time.Second)
+		}
+		if !cleanSession && c.storeDir != "" {
+			// keep the in-flight messages of the session across restarts
+			dir := filepath.Join(c.storeDir, url.PathEscape(clientID))
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return fmt.Errorf("MQTT: Error creating session store for client %v: %v", clientID, err)
+			}
+			opts.SetStore(paho.NewFileStore(dir))
+		}
 		opts.SetOnConnectHandler(manager.onConnectHandler)
 		opts.SetConnectionLostHandler(manager.onConnectionLostHandler)
+		// messages of all subscriptions are routed by their topic
+		opts.SetDefaultPublishHandler(manager.onMessage)
 		if source.Username != "" {
 			opts.SetUsername(source.Username)
 			opts.SetPassword(source.Password)
 		}
-		// TODO: add support for certificate auth
-		//
+		if tlsConfig != nil {
+			opts.SetTLSConfig(tlsConfig)
+		}
 		manager.client = paho.NewClient(opts)
 
 		if token := manager.client.Connect(); token.Wait() && token.Error() != nil {
 			return fmt.Errorf("MQTT: Error connecting to broker %v: %v", source.BrokerURL, token.Error())
 		}
-		c.managers[source.BrokerURL] = manager
+		c.managers[key] = manager
 
 	} else { // THERE IS A CLIENT FOR THIS BROKER
-		manager := c.managers[source.BrokerURL]
+		manager := c.managers[key]
+		if manager.cleanSession != cleanSession || manager.keepAlive != source.KeepAlive {
+			return fmt.Errorf("MQTT: Client %v of broker %v is connected with different session options (cleanSession=%v, keepAlive=%v)",
+				clientID, source.BrokerURL, manager.cleanSession, manager.keepAlive)
+		}
 
-		// TODO: check if another wildcard subscription matches the topic.
 		if _, exists := manager.subscriptions[source.Topic]; !exists { // NO SUBSCRIPTION FOR THIS TOPIC
-			subscription := &Subscription{
-				connector: c,
-				url:       source.BrokerURL,
+			manager.subscriptions[source.Topic] = &Subscription{
 				topic:     source.Topic,
 				qos:       source.QoS,
 				receivers: 1,
 			}
-			// Subscribe
-			if token := manager.client.Subscribe(subscription.topic, subscription.qos, subscription.onMessage); token.Wait() && token.Error() != nil {
-				return fmt.Errorf("MQTT: Error subscribing: %v", token.Error())
+			// Subscribe, unless covered by another subscription
+			if err := manager.sync(); err != nil {
+				delete(manager.subscriptions, source.Topic)
+				return err
 			}
-			manager.subscriptions[source.Topic] = subscription
-			log.Printf("MQTT: %s: Subscribed to %s", source.BrokerURL, source.Topic)
 
 		} else { // There is a subscription for this topic
 			//log.Printf("MQTT: %s: Already subscribed to %s", mqttConf.BrokerURL, mqttConf.Topic)
@@ -172,60 +297,191 @@ func (c *MQTTConnector) register(source registry.MQTTSource) error {
 	return nil
 }
 
+// sourceClientID returns the client ID of the source, which defaults to the one of the connector
+func (c *MQTTConnector) sourceClientID(source registry.MQTTSource) string {
+	if source.ClientID != "" {
+		return source.ClientID
+	}
+	return fmt.Sprintf("HDS-%s", c.clientID)
+}
+
+// managerKey returns the key of the manager of a client connected to a broker
+func managerKey(brokerURL, clientID string) string {
+	return brokerURL + " " + clientID
+}
+
+// newTLSConfig returns the TLS configuration with the CA and client certificates of the source
+// It returns nil if no certificate is given, in which case the system CAs are used for secure connections
+func newTLSConfig(source registry.MQTTSource) (*tls.Config, error) {
+	if source.CaFile == "" && source.CertFile == "" && source.KeyFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+
+	if source.CaFile != "" {
+		pem, err := ioutil.ReadFile(source.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", source.CaFile)
+		}
+	}
+
+	if source.CertFile != "" || source.KeyFile != "" {
+		// client certificate for mutual authentication
+		cert, err := tls.LoadX509KeyPair(source.CertFile, source.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
 func (c *MQTTConnector) unregister(mqttSource *registry.MQTTSource) error {
-	manager := c.managers[mqttSource.BrokerURL]
+	key := managerKey(mqttSource.BrokerURL, c.sourceClientID(*mqttSource))
+	manager := c.managers[key]
 	// There may be no subscriptions due to a failed registration when HDS is restarted
 	if manager == nil {
 		return nil
 	}
-	manager.subscriptions[mqttSource.Topic].receivers--
+	subscription := manager.subscriptions[mqttSource.Topic]
+	if subscription == nil {
+		return nil
+	}
+	subscription.receivers--
 
-	if manager.subscriptions[mqttSource.Topic].receivers == 0 {
+	if subscription.receivers == 0 {
+		delete(manager.subscriptions, mqttSource.Topic)
+		// Subscribe to the filters which were covered by this one
+		if err := manager.sync(); err != nil {
+			return err
+		}
 		// Unsubscribe
-		if token := manager.client.Unsubscribe(mqttSource.Topic); token.Wait() && token.Error() != nil {
-			return fmt.Errorf("MQTT: Error unsubscribing: %v", token.Error())
+		if subscription.active {
+			if token := manager.client.Unsubscribe(mqttSource.Topic); token.Wait() && token.Error() != nil {
+				return fmt.Errorf("MQTT: Error unsubscribing: %v", token.Error())
+			}
+			log.Printf("MQTT: %s: Unsubscribed from %s", mqttSource.BrokerURL, mqttSource.Topic)
 		}
-		delete(manager.subscriptions, mqttSource.Topic)
-		log.Printf("MQTT: %s: Unsubscribed from %s", mqttSource.BrokerURL, mqttSource.Topic)
 	}
 	if len(manager.subscriptions) == 0 {
 		// Disconnect
 		manager.client.Disconnect(250)
-		delete(c.managers, mqttSource.BrokerURL)
+		delete(c.managers, key)
 		log.Printf("MQTT: %s: Disconnected!", mqttSource.BrokerURL)
 	}
 
 	return nil
 }
 
+// sync subscribes to the filters which are not covered by other filters and unsubscribes from the covered ones
+func (m *Manager) sync() error {
+	var subscribe, unsubscribe []*Subscription
+	for _, subscription := range m.subscriptions {
+		covered := m.covered(subscription)
+		if !covered && !subscription.active {
+			subscribe = append(subscribe, subscription)
+		} else if covered && subscription.active {
+			unsubscribe = append(unsubscribe, subscription)
+		}
+	}
+
+	// subscribe first to not miss messages in between
+	for _, subscription := range subscribe {
+		if token := m.client.Subscribe(subscription.topic, subscription.qos, nil); token.Wait() && token.Error() != nil {
+			return fmt.Errorf("MQTT: Error subscribing: %v", token.Error())
+		}
+		subscription.active = true
+		log.Printf("MQTT: %s: Subscribed to %s", m.url, subscription.topic)
+	}
+	for _, subscription := range unsubscribe {
+		if token := m.client.Unsubscribe(subscription.topic); token.Wait() && token.Error() != nil {
+			return fmt.Errorf("MQTT: Error unsubscribing: %v", token.Error())
+		}
+		subscription.active = false
+		log.Printf("MQTT: %s: Unsubscribed from %s, covered by another subscription", m.url, subscription.topic)
+	}
+	return nil
+}
+
+// covered checks if the messages of the subscription are received through another subscription
+func (m *Manager) covered(subscription *Subscription) bool {
+	for _, other := range m.subscriptions {
+		if other != subscription && other.qos >= subscription.qos && covers(other.topic, subscription.topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers checks if every topic matching the second filter also matches the first one
+func covers(filter, other string) bool {
+	if !mqttmatch.Match(filter, other) {
+		return false
+	}
+	// a multi-level wildcard is only covered by another one
+	if other == "#" || strings.HasSuffix(other, "/#") {
+		return filter == "#" || strings.HasSuffix(filter, "/#")
+	}
+	return true
+}
+
 func (m *Manager) onConnectHandler(client paho.Client) {
+	m.connector.Lock()
+	defer m.connector.Unlock()
+	defer m.connector.snapshotStatus()
+
 	log.Printf("MQTT: %s: Connected.", m.url)
 	m.client = client
+	m.lastConnect = time.Now()
+	// the subscriptions are renewed on every connection
 	for _, subscription := range m.subscriptions {
-		if token := m.client.Subscribe(subscription.topic, subscription.qos, subscription.onMessage); token.Wait() && token.Error() != nil {
-			log.Printf("MQTT: %s: Error subscribing: %v", m.url, token.Error())
-		}
-		log.Printf("MQTT: %s: Subscribed to %s", m.url, subscription.topic)
+		subscription.active = false
+	}
+	if err := m.sync(); err != nil {
+		log.Printf("MQTT: %s: %v", m.url, err)
+		m.lastError = err.Error()
 	}
 }
 
 func (m *Manager) onConnectionLostHandler(client paho.Client, err error) {
+	m.connector.Lock()
+	defer m.connector.Unlock()
+	defer m.connector.snapshotStatus()
+
 	log.Printf("MQTT: %s: Connection lost: %v", m.url, err)
+	m.lastDisconnect = time.Now()
+	m.lastError = fmt.Sprintf("Connection lost: %v", err)
 }
 
-func (s *Subscription) onMessage(client paho.Client, msg paho.Message) {
+func (m *Manager) onMessage(client paho.Client, msg paho.Message) {
 	t1 := time.Now()
+	m.connector.messageReceived(m, t1)
 
 	logHeader := fmt.Sprintf("\"SUB %s MQTT/QOS%d\"", msg.Topic(), msg.Qos())
 	logMQTTError := func(code int, format string, v ...interface{}) {
 		log.Printf("%s %d %v %s", logHeader, code, time.Now().Sub(t1), fmt.Sprintf(format, v...))
 	}
+	// rejected records by the reason
+	source := m.url + " " + msg.Topic()
+	rejected := make(map[string]senml.Pack)
+	defer func() {
+		for reason, records := range rejected {
+			m.connector.deadLetters.RejectRecords(DeadLetterMQTT, source, reason, records)
+		}
+	}()
 
 	//log.Printf("MQTT: %s %s", msg.Topic(), msg.Payload())
 
-	senmlPack, err := senml.Decode(msg.Payload(), senml.JSON)
+	// MQTT messages carry no media type, the format is detected from the payload
+	senmlPack, err := senml.Decode(msg.Payload(), detectFormat(msg.Payload()))
 	if err != nil {
-		logMQTTError(http.StatusBadRequest, "Error parsing json: %s : %v", msg.Payload(), err)
+		logMQTTError(http.StatusBadRequest, "Error parsing message: %s : %v", msg.Payload(), err)
+		m.connector.deadLetters.Reject(DeadLetterMQTT, source, fmt.Sprintf("Error parsing message: %v", err), "", msg.Payload())
 		return
 	}
 
@@ -235,19 +491,21 @@ func (s *Subscription) onMessage(client paho.Client, msg paho.Message) {
 	sources := make(map[string]*registry.DataStream)
 	for _, r := range records {
 		// Find the data source for this entry
-		ds, exists := s.connector.cache[r.Name]
+		ds, exists := m.connector.cached(r.Name)
 		if !exists {
-			ds, err = s.connector.registry.Get(r.Name)
+			ds, err = m.connector.registry.Get(r.Name)
 			if err != nil {
 				if registry.ErrType(err, registry.ErrNotFound) {
 					logMQTTError(http.StatusNotFound, "Warning: Resource not found: %v", r.Name)
+					rejected["Resource not found"] = append(rejected["Resource not found"], r)
 					continue
 				}
 				logMQTTError(http.StatusInternalServerError, "Error finding resource: %v", r.Name)
+				rejected["Error finding resource"] = append(rejected["Error finding resource"], r)
 				continue
 			}
 
-			s.connector.cache[r.Name] = ds
+			m.connector.cacheDataStream(r.Name, ds)
 		}
 
 		// Check if the message is wanted
@@ -255,34 +513,22 @@ func (s *Subscription) onMessage(client paho.Client, msg paho.Message) {
 			logMQTTError(http.StatusNotAcceptable, "Ignoring unwanted message for resource: %v", r.Name)
 			continue
 		}
-		if ds.Source.MQTTSource.BrokerURL != s.url {
-			logMQTTError(http.StatusNotAcceptable, "Ignoring message from unwanted broker %v for data source: %v", s.url, r.Name)
+		if ds.Source.MQTTSource.BrokerURL != m.url {
+			logMQTTError(http.StatusNotAcceptable, "Ignoring message from unwanted broker %v for data source: %v", m.url, r.Name)
 			continue
 		}
-		if ds.Source.MQTTSource.Topic != s.topic {
-			logMQTTError(http.StatusNotAcceptable, "Ignoring message with unwanted topic %v for data source: %v", s.topic, r.Name)
+		if !mqttmatch.Match(ds.Source.MQTTSource.Topic, msg.Topic()) {
+			logMQTTError(http.StatusNotAcceptable, "Ignoring message with unwanted topic %v for data source: %v", msg.Topic(), r.Name)
 			continue
 		}
 
 		// Check if type of value matches the data source type in registry
-		typeError := false
-		switch ds.Type {
-		case common.FLOAT:
-			if r.Value == nil {
-				typeError = true
-			}
-		case common.STRING:
-			if r.StringValue == "" {
-				typeError = true
-			}
-		case common.BOOL:
-			if r.BoolValue == nil {
-				typeError = true
-			}
-		}
-		if typeError {
+		if !validType(ds, r) {
 			logMQTTError(http.StatusBadRequest,
 				"Value for %v is empty or has a type other than what is set in registry: %v", r.Name, ds.Type)
+			m.connector.streamError(ds.Name, fmt.Errorf("value is empty or has a type other than %v", ds.Type))
+			reason := fmt.Sprintf("Value is empty or has a type other than what is set in registry: %v", ds.Type)
+			rejected[reason] = append(rejected[reason], r)
 			continue
 		}
 
@@ -294,16 +540,34 @@ func (s *Subscription) onMessage(client paho.Client, msg paho.Message) {
 		data[ds.Name] = append(data[ds.Name], r)
 	}
 
-	if len(data) > 0 {
-		// Add data to the storage
-		err = s.connector.storage.Submit(data, sources)
+	if len(data) == 0 {
+		return
+	}
+	stored := func(err error) {
 		if err != nil {
 			logMQTTError(http.StatusInternalServerError, "Error writing data to the database: %v", err)
+			var records senml.Pack
+			for name, pack := range data {
+				m.connector.streamError(name, fmt.Errorf("error writing data to the database: %v", err))
+				records = append(records, pack...)
+			}
+			m.connector.deadLetters.RejectRecords(DeadLetterMQTT, source, "Error writing data to the database", records)
 			return
 		}
+		m.connector.dataAccepted(data, time.Now())
+		countIngested(data, sourceMQTT)
 
 		log.Printf("%s %d %v\n", logHeader, http.StatusAccepted, time.Now().Sub(t1))
 	}
+	// Add data to the storage
+	if queue, ok := m.connector.storage.(AsyncStorage); ok {
+		// holding off the handler while the queue is full holds off the broker
+		if err := queue.Enqueue(data, sources, stored, true); err != nil {
+			stored(err)
+		}
+		return
+	}
+	stored(m.connector.storage.Submit(data, sources))
 }
 
 // NOTIFICATION HANDLERS
@@ -312,6 +576,7 @@ func (s *Subscription) onMessage(client paho.Client, msg paho.Message) {
 func (c *MQTTConnector) CreateHandler(ds registry.DataStream) error {
 	c.Lock()
 	defer c.Unlock()
+	defer c.snapshotStatus()
 
 	if ds.Source.MQTTSource != nil {
 		err := c.register(*ds.Source.MQTTSource)
@@ -327,6 +592,7 @@ func (c *MQTTConnector) CreateHandler(ds registry.DataStream) error {
 func (c *MQTTConnector) UpdateHandler(oldDS registry.DataStream, newDS registry.DataStream) error {
 	c.Lock()
 	defer c.Unlock()
+	defer c.snapshotStatus()
 
 	if oldDS.Retention != newDS.Retention {
 		c.flushCache()
@@ -356,12 +622,13 @@ func (c *MQTTConnector) UpdateHandler(oldDS registry.DataStream, newDS registry.
 func (c *MQTTConnector) DeleteHandler(oldDS registry.DataStream) error {
 	c.Lock()
 	defer c.Unlock()
+	defer c.snapshotStatus()
 
 	c.flushCache()
+	c.removeStats(oldDS.Name)
 
 	// Remove old subscription
 	if oldDS.Source.MQTTSource != nil {
-		delete(c.cache, oldDS.Name)
 		err := c.unregister(oldDS.Source.MQTTSource)
 		if err != nil {
 			return fmt.Errorf("MQTT: Error removing subscription: %v", err)
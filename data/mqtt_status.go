@@ -0,0 +1,250 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// MQTTStatus describes the connections to the brokers and the ingestion of data streams with MQTT sources
+type MQTTStatus struct {
+	Brokers []BrokerStatus     `json:"brokers"`
+	Streams []MQTTStreamStatus `json:"streams"`
+}
+
+// BrokerStatus describes the connection of a client to a broker
+type BrokerStatus struct {
+	URL            string               `json:"url"`
+	ClientID       string               `json:"clientID"`
+	Connected      bool                 `json:"connected"`
+	LastConnect    *time.Time           `json:"lastConnect,omitempty"`
+	LastDisconnect *time.Time           `json:"lastDisconnect,omitempty"`
+	LastError      string               `json:"lastError,omitempty"`
+	Messages       uint64               `json:"messages"`
+	LastMessage    *time.Time           `json:"lastMessage,omitempty"`
+	Subscriptions  []SubscriptionStatus `json:"subscriptions"`
+}
+
+// SubscriptionStatus describes a topic filter of a client
+type SubscriptionStatus struct {
+	Topic     string `json:"topic"`
+	QoS       byte   `json:"qos"`
+	Receivers int    `json:"receivers"`
+	// Active is false when the messages are received through another subscription covering this one
+	Active bool `json:"active"`
+}
+
+// MQTTStreamStatus describes the ingestion of a data stream
+type MQTTStreamStatus struct {
+	Name         string     `json:"name"`
+	URL          string     `json:"url"`
+	ClientID     string     `json:"clientID"`
+	Topic        string     `json:"topic"`
+	Subscribed   bool       `json:"subscribed"`
+	RetryPending bool       `json:"retryPending"`
+	LastError    string     `json:"lastError,omitempty"`
+	Messages     uint64     `json:"messages"`
+	LastMessage  *time.Time `json:"lastMessage,omitempty"`
+}
+
+// managerState is a copy of the connection state and subscriptions of a manager
+type managerState struct {
+	manager        *Manager
+	client         paho.Client
+	lastConnect    time.Time
+	lastDisconnect time.Time
+	lastError      string
+	subscriptions  []SubscriptionStatus
+}
+
+// snapshotStatus copies the states of the managers and the failed registrations for the status
+// It is called while the connector is locked, after the managers or registrations are changed.
+func (c *MQTTConnector) snapshotStatus() {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	c.managerStates = make(map[string]managerState, len(c.managers))
+	for key, m := range c.managers {
+		state := managerState{
+			manager:        m,
+			client:         m.client,
+			lastConnect:    m.lastConnect,
+			lastDisconnect: m.lastDisconnect,
+			lastError:      m.lastError,
+			subscriptions:  []SubscriptionStatus{},
+		}
+		for _, s := range m.subscriptions {
+			state.subscriptions = append(state.subscriptions, SubscriptionStatus{s.topic, s.qos, s.receivers, s.active})
+		}
+		sort.Slice(state.subscriptions, func(i, j int) bool {
+			return state.subscriptions[i].Topic < state.subscriptions[j].Topic
+		})
+		c.managerStates[key] = state
+	}
+	c.pending = make(map[string]bool, len(c.failedRegistrations))
+	for name := range c.failedRegistrations {
+		c.pending[name] = true
+	}
+}
+
+// streamStats are the statistics of the messages of a data stream
+type streamStats struct {
+	// accepted records
+	messages    uint64
+	lastMessage time.Time
+	lastError   string
+}
+
+func (c *MQTTConnector) streamStats(name string) *streamStats {
+	stats, found := c.stats[name]
+	if !found {
+		stats = &streamStats{}
+		c.stats[name] = stats
+	}
+	return stats
+}
+
+func (c *MQTTConnector) streamError(name string, err error) {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	c.streamStats(name).lastError = err.Error()
+}
+
+func (c *MQTTConnector) dataAccepted(data map[string]senml.Pack, t time.Time) {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	for name, pack := range data {
+		stats := c.streamStats(name)
+		stats.messages += uint64(len(pack))
+		stats.lastMessage = t
+	}
+}
+
+func (c *MQTTConnector) messageReceived(m *Manager, t time.Time) {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	m.messages++
+	m.lastMessage = t
+}
+
+func (c *MQTTConnector) removeStats(name string) {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	delete(c.stats, name)
+}
+
+// Status returns the status of the brokers and data streams
+func (c *MQTTConnector) Status() (*MQTTStatus, error) {
+	// the registry is read first, as it notifies the connector while locked
+	var dataStreams []registry.DataStream
+	perPage := 100
+	for page := 1; ; page++ {
+		streams, total, err := c.registry.GetMany(page, perPage)
+		if err != nil {
+			return nil, fmt.Errorf("error getting data sources: %v", err)
+		}
+		for _, ds := range streams {
+			if ds.Source.SrcType == registry.MqttType && ds.Source.MQTTSource != nil {
+				dataStreams = append(dataStreams, ds)
+			}
+		}
+		if page*perPage >= total {
+			break
+		}
+	}
+
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	status := &MQTTStatus{
+		Brokers: c.brokers(),
+		Streams: []MQTTStreamStatus{},
+	}
+
+	for _, ds := range dataStreams {
+		source := ds.Source.MQTTSource
+		stream := MQTTStreamStatus{
+			Name:     ds.Name,
+			URL:      source.BrokerURL,
+			ClientID: c.sourceClientID(*source),
+			Topic:    source.Topic,
+		}
+		if state, found := c.managerStates[managerKey(stream.URL, stream.ClientID)]; found {
+			for _, s := range state.subscriptions {
+				if s.Topic == source.Topic {
+					stream.Subscribed = true
+				}
+			}
+		}
+		stream.RetryPending = c.pending[ds.Name]
+		if stats, found := c.stats[ds.Name]; found {
+			stream.LastError = stats.lastError
+			stream.Messages = stats.messages
+			stream.LastMessage = timeOrNil(stats.lastMessage)
+		}
+		status.Streams = append(status.Streams, stream)
+	}
+
+	return status, nil
+}
+
+// Brokers returns the status of the connections to the brokers
+func (c *MQTTConnector) Brokers() []BrokerStatus {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	return c.brokers()
+}
+
+func (c *MQTTConnector) brokers() []BrokerStatus {
+	brokers := []BrokerStatus{}
+	for _, state := range c.managerStates {
+		brokers = append(brokers, BrokerStatus{
+			URL:            state.manager.url,
+			ClientID:       state.manager.clientID,
+			Connected:      state.client != nil && state.client.IsConnected(),
+			LastConnect:    timeOrNil(state.lastConnect),
+			LastDisconnect: timeOrNil(state.lastDisconnect),
+			LastError:      state.lastError,
+			Messages:       state.manager.messages,
+			LastMessage:    timeOrNil(state.manager.lastMessage),
+			Subscriptions:  state.subscriptions,
+		})
+	}
+	sort.Slice(brokers, func(i, j int) bool {
+		return managerKey(brokers[i].URL, brokers[i].ClientID) < managerKey(brokers[j].URL, brokers[j].ClientID)
+	})
+	return brokers
+}
+
+// StatusHandler is a handler for the status of the MQTT connector
+func (c *MQTTConnector) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := c.Status()
+	if err != nil {
+		common.ErrorResponse(http.StatusInternalServerError, err.Error(), w)
+		return
+	}
+
+	b, err := json.Marshal(status)
+	if err != nil {
+		common.ErrorResponse(http.StatusInternalServerError, err.Error(), w)
+		return
+	}
+	w.Header().Set("Content-Type", common.DefaultMIMEType)
+	w.Write(b)
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
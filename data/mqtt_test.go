@@ -0,0 +1,247 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/internal/testutil"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+func TestMQTTTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMQTTTLSConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	testutil.WriteCertificate(t, certFile, keyFile, "hds-test")
+
+	tlsConfig, err := newTLSConfig(registry.MQTTSource{BrokerURL: "ssl://localhost:8883"})
+	if err != nil || tlsConfig != nil {
+		t.Fatalf("Expected no TLS config without certificates, got %v, %v", tlsConfig, err)
+	}
+
+	tlsConfig, err = newTLSConfig(registry.MQTTSource{CaFile: certFile, CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.RootCAs == nil {
+		t.Errorf("Expected the CA to be loaded")
+	}
+	if len(tlsConfig.Certificates) != 1 {
+		t.Errorf("Expected the client certificate to be loaded")
+	}
+
+	invalid := map[string]registry.MQTTSource{
+		"missing CA file":     {CaFile: filepath.Join(dir, "missing.pem")},
+		"CA file without PEM": {CaFile: keyFile},
+		"missing key file":    {CertFile: certFile, KeyFile: filepath.Join(dir, "missing.pem")},
+		"mismatching files":   {CertFile: keyFile, KeyFile: certFile},
+	}
+	for name, source := range invalid {
+		if _, err := newTLSConfig(source); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
+
+func TestMQTTCovers(t *testing.T) {
+	cases := []struct {
+		filter, other string
+		covers        bool
+	}{
+		{"sensors/+/temp", "sensors/a/temp", true},
+		{"sensors/#", "sensors/+/temp", true},
+		{"sensors/#", "sensors/a/#", true},
+		{"#", "sensors/#", true},
+		{"sensors/+/temp", "sensors/a/#", false},
+		{"sensors/+", "sensors/#", false},
+		{"sensors/a/temp", "sensors/+/temp", false},
+		{"sensors/+/temp", "sensors/+/humidity", false},
+	}
+	for _, c := range cases {
+		if covers(c.filter, c.other) != c.covers {
+			t.Errorf("Expected covers(%s, %s) to be %v", c.filter, c.other, c.covers)
+		}
+	}
+
+	m := &Manager{subscriptions: map[string]*Subscription{
+		"sensors/#":      {topic: "sensors/#", qos: 1},
+		"sensors/+/temp": {topic: "sensors/+/temp", qos: 1},
+		"sensors/a/temp": {topic: "sensors/a/temp", qos: 2},
+	}}
+	expected := map[string]bool{"sensors/#": false, "sensors/+/temp": true, "sensors/a/temp": false}
+	for topic, covered := range expected {
+		if m.covered(m.subscriptions[topic]) != covered {
+			t.Errorf("Expected covered(%s) to be %v", topic, covered)
+		}
+	}
+}
+
+func TestMQTTClientSessions(t *testing.T) {
+	c, err := NewMQTTConnector(nil, nil, "service", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := "tcp://localhost:1883"
+	if id := c.sourceClientID(registry.MQTTSource{BrokerURL: broker}); id != "HDS-service" {
+		t.Errorf("Expected the default client ID, got %s", id)
+	}
+	if id := c.sourceClientID(registry.MQTTSource{BrokerURL: broker, ClientID: "replica1"}); id != "replica1" {
+		t.Errorf("Expected the client ID of the source, got %s", id)
+	}
+
+	// a client with a persistent session
+	c.managers[managerKey(broker, "replica1")] = &Manager{
+		url:           broker,
+		clientID:      "replica1",
+		cleanSession:  false,
+		subscriptions: make(map[string]*Subscription),
+	}
+	cleanSession := true
+	err = c.register(registry.MQTTSource{BrokerURL: broker, Topic: "a", ClientID: "replica1", CleanSession: &cleanSession})
+	if err == nil {
+		t.Errorf("Expected an error for conflicting session options of the same client")
+	}
+}
+
+func TestMQTTStatus(t *testing.T) {
+	c, err := NewMQTTConnector(nil, nil, "service", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.registry = registry.NewMemoryStorage(common.RegConf{})
+	broker := "tcp://localhost:1883"
+	for _, name := range []string{"status/a", "status/b"} {
+		ds := registry.DataStream{Name: name, Type: common.FLOAT}
+		ds.Source.SrcType = registry.MqttType
+		ds.Source.MQTTSource = &registry.MQTTSource{BrokerURL: broker, Topic: "sensors/+/temp"}
+		if _, err := c.registry.Add(ds); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a is subscribed and b is waiting to be registered again
+	c.managers[managerKey(broker, "HDS-service")] = &Manager{
+		url:           broker,
+		clientID:      "HDS-service",
+		subscriptions: map[string]*Subscription{"sensors/+/temp": {topic: "sensors/+/temp", receivers: 1, active: true}},
+	}
+	c.failedRegistrations["status/b"] = &registry.MQTTSource{BrokerURL: broker, Topic: "sensors/+/temp"}
+	c.snapshotStatus()
+	c.streamError("status/b", fmt.Errorf("connection refused"))
+	v := 1.0
+	c.dataAccepted(map[string]senml.Pack{"status/a": {{Name: "status/a", Value: &v}, {Name: "status/a", Value: &v}}}, time.Now())
+
+	// the status is available while the connector is locked, e.g. waiting for an unresponsive broker
+	c.Lock()
+	defer c.Unlock()
+	var status *MQTTStatus
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		status, err = c.Status()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Status is blocked by the lock of the connector")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if brokers := c.Brokers(); len(brokers) != 1 || brokers[0].Messages != 0 {
+		t.Errorf("Unexpected brokers: %+v", brokers)
+	}
+	if len(status.Brokers) != 1 || status.Brokers[0].Connected || len(status.Brokers[0].Subscriptions) != 1 {
+		t.Errorf("Unexpected broker status: %+v", status.Brokers)
+	}
+	if len(status.Streams) != 2 {
+		t.Fatalf("Expected the status of 2 streams, got %d", len(status.Streams))
+	}
+	for _, s := range status.Streams {
+		switch s.Name {
+		case "status/a":
+			if s.Messages != 2 || s.LastMessage == nil || s.RetryPending || s.LastError != "" {
+				t.Errorf("Unexpected status of %s: %+v", s.Name, s)
+			}
+		case "status/b":
+			if !s.RetryPending || s.LastError != "connection refused" || s.Messages != 0 {
+				t.Errorf("Unexpected status of %s: %+v", s.Name, s)
+			}
+		}
+	}
+}
+
+// mqttMessage is a received message
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m mqttMessage) Duplicate() bool   { return false }
+func (m mqttMessage) Qos() byte         { return 1 }
+func (m mqttMessage) Retained() bool    { return false }
+func (m mqttMessage) Topic() string     { return m.topic }
+func (m mqttMessage) MessageID() uint16 { return 0 }
+func (m mqttMessage) Payload() []byte   { return m.payload }
+
+func TestMQTTConcurrentMessages(t *testing.T) {
+	storage, _, err := NewMemoryStorage(common.DataConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewMQTTConnector(storage, nil, "service", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.registry = registry.NewMemoryStorage(common.RegConf{})
+	broker := "tcp://localhost:1883"
+	ds := registry.DataStream{Name: "concurrent/a", Type: common.FLOAT}
+	ds.Source.SrcType = registry.MqttType
+	ds.Source.MQTTSource = &registry.MQTTSource{BrokerURL: broker, Topic: "sensors/a"}
+	added, err := c.registry.Add(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the clients of the source and the registry events share the cache of the connector
+	var wg sync.WaitGroup
+	for i, clientID := range []string{"replica1", "replica2"} {
+		m := &Manager{url: broker, clientID: clientID, connector: c, subscriptions: make(map[string]*Subscription)}
+		offset := 1546300800 + i*100
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				payload := fmt.Sprintf(`[{"n":"concurrent/a","v":1,"t":%d}]`, offset+i)
+				m.onMessage(nil, mqttMessage{"sensors/a", []byte(payload)})
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			c.flushCache()
+		}
+	}()
+	wg.Wait()
+
+	_, total, _, err := storage.Query(Query{From: time.Unix(1546300800, 0), To: time.Unix(1546301000, 0), Sort: common.ASC, Limit: -1}, added)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 100 {
+		t.Fatalf("Expected the 100 received records to be stored, got %d", total)
+	}
+}
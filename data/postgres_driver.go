@@ -0,0 +1,20 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+//go:build postgres
+// +build postgres
+
+package data
+
+import (
+	_ "github.com/lib/pq"
+	"github.com/linksmart/historical-datastore/common"
+)
+
+// the postgres and timescaledb backends are only available along with their driver
+func init() {
+	factory := func(conf common.DataConf) (Storage, func() error, error) {
+		return NewPostgresStorage(conf)
+	}
+	RegisterBackend(POSTGRES, factory)
+	RegisterBackend(TIMESCALEDB, factory)
+}
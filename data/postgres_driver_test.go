@@ -0,0 +1,39 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+//go:build postgres
+// +build postgres
+
+package data_test
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/linksmart/historical-datastore/data"
+	"github.com/linksmart/historical-datastore/data/datatest"
+)
+
+// TestPostgresDriver runs the suite against the database at HDS_POSTGRES_DSN, whose data is removed
+func TestPostgresDriver(t *testing.T) {
+	dsn := os.Getenv("HDS_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("HDS_POSTGRES_DSN is not set")
+	}
+	backend := os.Getenv("HDS_POSTGRES_BACKEND")
+	if backend == "" {
+		backend = data.POSTGRES
+	}
+	datatest.RunStorageSuite(t, func(t *testing.T) data.Storage {
+		storage := newStorage(t, backend, dsn)
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.Exec(`TRUNCATE hds_data`); err != nil {
+			t.Fatal(err)
+		}
+		return storage
+	})
+}
@@ -0,0 +1,176 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePostgres is a stand-in database/sql driver, which executes the statements of PostgresStorage in memory
+type fakePostgres struct {
+	sync.Mutex
+	created    bool
+	hypertable bool
+	// rows of the table by name and time
+	rows map[string]map[int64][]driver.Value
+}
+
+func (d *fakePostgres) Open(name string) (driver.Conn, error) {
+	return &fakePostgresConn{d}, nil
+}
+
+func (d *fakePostgres) Connect(context.Context) (driver.Conn, error) {
+	return d.Open("")
+}
+
+func (d *fakePostgres) Driver() driver.Driver {
+	return d
+}
+
+type fakePostgresConn struct {
+	db *fakePostgres
+}
+
+func (c *fakePostgresConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakePostgresStmt{c.db, query}, nil
+}
+
+func (c *fakePostgresConn) Close() error {
+	return nil
+}
+
+func (c *fakePostgresConn) Begin() (driver.Tx, error) {
+	return c, nil
+}
+
+func (c *fakePostgresConn) Commit() error {
+	return nil
+}
+
+func (c *fakePostgresConn) Rollback() error {
+	return nil
+}
+
+type fakePostgresStmt struct {
+	db    *fakePostgres
+	query string
+}
+
+func (s *fakePostgresStmt) Close() error {
+	return nil
+}
+
+func (s *fakePostgresStmt) NumInput() int {
+	return -1
+}
+
+// inRange returns the times of the rows of a series within the range (inclusive) in ascending order
+func (s *fakePostgresStmt) inRange(args []driver.Value) []int64 {
+	from, to := args[1].(time.Time).UnixNano(), args[2].(time.Time).UnixNano()
+	var times []int64
+	for t := range s.db.rows[args[0].(string)] {
+		if t >= from && t <= to {
+			times = append(times, t)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times
+}
+
+func (s *fakePostgresStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.Lock()
+	defer s.db.Unlock()
+	switch s.query {
+	case postgresCreateTable:
+		s.db.created = true
+	case postgresCreateHypertable:
+		s.db.hypertable = true
+	case postgresInsert:
+		name, t := args[0].(string), args[1].(time.Time).UnixNano()
+		if s.db.rows[name] == nil {
+			s.db.rows[name] = make(map[int64][]driver.Value)
+		}
+		s.db.rows[name][t] = append([]driver.Value{args[1]}, args[2:]...)
+		return driver.RowsAffected(1), nil
+	case postgresDeleteRange:
+		times := s.inRange(args)
+		for _, t := range times {
+			delete(s.db.rows[args[0].(string)], t)
+		}
+		return driver.RowsAffected(len(times)), nil
+	case postgresDeleteSeries:
+		count := len(s.db.rows[args[0].(string)])
+		delete(s.db.rows, args[0].(string))
+		return driver.RowsAffected(count), nil
+	default:
+		return nil, fmt.Errorf("unsupported statement: %s", s.query)
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (s *fakePostgresStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.Lock()
+	defer s.db.Unlock()
+	switch s.query {
+	case postgresSelectAsc, postgresSelectDesc:
+		times := s.inRange(args)
+		if s.query == postgresSelectDesc {
+			sort.Slice(times, func(i, j int) bool { return times[i] > times[j] })
+		}
+		if limit, ok := args[3].(int64); ok && int(limit) < len(times) {
+			times = times[:limit]
+		}
+		rows := &fakePostgresRows{columns: []string{"time", "value", "bool_value", "string_value", "data_value", "unit"}}
+		for _, t := range times {
+			rows.values = append(rows.values, s.db.rows[args[0].(string)][t])
+		}
+		return rows, nil
+	}
+	return nil, fmt.Errorf("unsupported query: %s", s.query)
+}
+
+type fakePostgresRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakePostgresRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakePostgresRows) Close() error {
+	return nil
+}
+
+func (r *fakePostgresRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// FakePostgresStorage returns a PostgresStorage with a TimescaleDB hypertable in a new fakePostgres
+func FakePostgresStorage(t *testing.T) *PostgresStorage {
+	fake := &fakePostgres{rows: make(map[string]map[int64][]driver.Value)}
+	db := sql.OpenDB(fake)
+	t.Cleanup(func() { db.Close() })
+
+	storage, err := newPostgresStorage(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fake.created || !fake.hypertable {
+		t.Fatalf("Expected the hypertable to be created")
+	}
+	return storage
+}
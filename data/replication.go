@@ -0,0 +1,319 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"code.linksmart.eu/com/go-sec/auth/obtainer"
+	"code.linksmart.eu/sc/service-catalog/utils"
+	datastore "github.com/dschowta/senml.datastore"
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+const (
+	defaultReplicationInterval  = 10   // seconds
+	defaultReplicationBatchSize = 1000 // records
+)
+
+// errBatchFull stops reading the records of a data stream after a batch
+var errBatchFull = errors.New("batch is full")
+
+// Replicator periodically forwards the new data of the selected data streams to a remote Historical Datastore
+// The data streams are registered remotely before their data is forwarded. The time of the latest forwarded
+// record of every data stream is persisted, so that forwarding resumes after it when the remote is back online
+// or the service is restarted. Meanwhile, the data is kept in the local storage, as the replicator holds it from
+// being purged by the retention.
+// Records which are stored later than newer ones of the same data stream have been forwarded are not forwarded.
+type Replicator struct {
+	registry   registry.Storage
+	storage    Storage
+	remoteData *RemoteClient
+	remoteReg  *registry.RemoteClient
+	streams    []string
+	filters    []common.FilterConf
+	interval   time.Duration
+	batchSize  int
+	// marks are the SenML times of the latest forwarded records by data stream
+	marks *leveldb.DB
+
+	sync.Mutex
+	// registered are the data streams which exist remotely
+	registered map[string]bool
+	stop       chan struct{}
+	// stopped is closed when forwarding in the background is stopped
+	stopped chan struct{}
+}
+
+// NewReplicator creates a replicator which keeps its progress in the directory
+func NewReplicator(storage Storage, conf common.ReplicationConf, dir string, opts *opt.Options) (*Replicator, error) {
+	var ticket *obtainer.Client
+	var err error
+	if conf.Auth != nil {
+		ticket, err = obtainer.NewClient(conf.Auth.Provider, conf.Auth.ProviderURL, conf.Auth.Username, conf.Auth.Password, conf.Auth.ServiceID)
+		if err != nil {
+			return nil, fmt.Errorf("error creating auth client: %s", err)
+		}
+	}
+	endpoint := strings.TrimSuffix(conf.Endpoint, "/")
+	remoteData, err := NewRemoteClient(endpoint+"/data", ticket)
+	if err != nil {
+		return nil, err
+	}
+	remoteReg, err := registry.NewRemoteClient(endpoint+"/registry", ticket)
+	if err != nil {
+		return nil, err
+	}
+	marks, err := leveldb.OpenFile(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Replicator{
+		storage:    storage,
+		remoteData: remoteData,
+		remoteReg:  remoteReg,
+		streams:    conf.Streams,
+		filters:    conf.Filters,
+		interval:   time.Duration(conf.Interval) * time.Second,
+		batchSize:  conf.BatchSize,
+		marks:      marks,
+		registered: make(map[string]bool),
+		stop:       make(chan struct{}),
+	}
+	if r.interval <= 0 {
+		r.interval = defaultReplicationInterval * time.Second
+	}
+	if r.batchSize <= 0 {
+		r.batchSize = defaultReplicationBatchSize
+	}
+	return r, nil
+}
+
+// Start forwards the data of the data streams in the given registry in the background
+func (r *Replicator) Start(reg registry.Storage) {
+	r.registry = reg
+	r.stopped = make(chan struct{})
+	go func() {
+		defer close(r.stopped)
+		for {
+			forwarded, err := r.Replicate()
+			if err != nil {
+				log.Println(err)
+			}
+			for name, count := range forwarded {
+				log.Printf("Replication: Forwarded %d data points of %s", count, name)
+			}
+			select {
+			case <-time.After(r.interval):
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops forwarding, waits for an ongoing round to finish and closes the store of the progress
+func (r *Replicator) Stop() error {
+	close(r.stop)
+	if r.stopped != nil {
+		<-r.stopped
+	}
+	return r.marks.Close()
+}
+
+// selected returns true if the data stream matches any of the name patterns or filters, or if there are none
+func (r *Replicator) selected(ds *registry.DataStream) bool {
+	if len(r.streams) == 0 && len(r.filters) == 0 {
+		return true
+	}
+	for _, pattern := range r.streams {
+		if matched, _ := path.Match(pattern, ds.Name); matched {
+			return true
+		}
+	}
+	for _, filter := range r.filters {
+		matched, err := utils.MatchObject(ds, strings.Split(filter.Path, "."), filter.Op, filter.Value)
+		if err != nil {
+			log.Printf("Replication: Error filtering %s: %v", ds.Name, err)
+			continue
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Replicate forwards the data of the selected data streams which is stored after the latest forwarded records
+// It returns the number of forwarded data points for every data stream that had new data
+func (r *Replicator) Replicate() (map[string]int, error) {
+	forwarded := make(map[string]int)
+
+	perPage := 100
+	for page := 1; ; page++ {
+		dataStreams, total, err := r.registry.GetMany(page, perPage)
+		if err != nil {
+			return forwarded, fmt.Errorf("Replication: Error getting data streams: %v", err)
+		}
+
+		for i := range dataStreams {
+			ds := &dataStreams[i]
+			if !r.selected(ds) {
+				continue
+			}
+			count, err := r.forward(ds)
+			if count > 0 {
+				forwarded[ds.Name] = count
+			}
+			if err != nil {
+				log.Printf("Replication: Error forwarding %s: %v", ds.Name, err)
+			}
+		}
+
+		if page*perPage >= total {
+			break
+		}
+	}
+	return forwarded, nil
+}
+
+// forward sends the new records of the data stream in batches, and returns the number of forwarded records
+func (r *Replicator) forward(ds *registry.DataStream) (int, error) {
+	mark, err := r.mark(ds.Name)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for {
+		var batch senml.Pack
+		q := Query{From: time.Unix(0, 0), To: time.Now(), Sort: common.ASC}
+		if mark != nil {
+			q.From = datastore.FromSenmlTime(*mark)
+		}
+		err := QueryStream(r.storage, q, ds, func(record senml.Record) error {
+			// the query range may include the latest forwarded record
+			if mark != nil && record.Time <= *mark {
+				return nil
+			}
+			record.Name = ds.Name
+			batch = append(batch, record)
+			if len(batch) == r.batchSize {
+				return errBatchFull
+			}
+			return nil
+		})
+		if err != nil && err != errBatchFull {
+			return count, err
+		}
+		if len(batch) == 0 {
+			return count, nil
+		}
+
+		if err := r.register(ds); err != nil {
+			return count, fmt.Errorf("error registering remotely: %v", err)
+		}
+		if err := r.submit(ds, batch); err != nil {
+			return count, err
+		}
+		last := batch[len(batch)-1].Time
+		if err := r.setMark(ds.Name, last); err != nil {
+			return count, err
+		}
+		mark = &last
+		count += len(batch)
+		replicatedRecords.Add(float64(len(batch)), ds.Name)
+		if len(batch) < r.batchSize {
+			return count, nil
+		}
+	}
+}
+
+// register adds the data stream to the remote registry, unless it exists
+// The source and function are not replicated, since the data is forwarded as is.
+func (r *Replicator) register(ds *registry.DataStream) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.registered[ds.Name] {
+		return nil
+	}
+	_, err := r.remoteReg.Get(ds.Name)
+	if err == registry.ErrNotFound {
+		remote := registry.DataStream{
+			Name:      ds.Name,
+			Type:      ds.Type,
+			Meta:      ds.Meta,
+			Retention: ds.Retention,
+		}
+		_, err = r.remoteReg.Add(&remote)
+		if err == nil {
+			log.Printf("Replication: Registered %s remotely", ds.Name)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	r.registered[ds.Name] = true
+	return nil
+}
+
+func (r *Replicator) submit(ds *registry.DataStream, batch senml.Pack) error {
+	payload, err := batch.Encode(senml.JSON, senml.OutputOptions{})
+	if err != nil {
+		return err
+	}
+	err = r.remoteData.Submit(payload, senml.MediaTypeSenmlJSON, ds.Name)
+	if err == registry.ErrNotFound {
+		// deleted remotely, to be registered again
+		r.Lock()
+		delete(r.registered, ds.Name)
+		r.Unlock()
+	}
+	return err
+}
+
+// Hold keeps the data of the selected data streams from being purged until it is forwarded
+// The data up to the latest forwarded record may be purged, and all of it is held if none is forwarded yet.
+func (r *Replicator) Hold(ds *registry.DataStream) (time.Time, bool, error) {
+	if !r.selected(ds) {
+		return time.Time{}, false, nil
+	}
+	mark, err := r.mark(ds.Name)
+	if err != nil {
+		return time.Time{}, true, err
+	}
+	if mark == nil {
+		return time.Time{}, true, nil
+	}
+	return datastore.FromSenmlTime(*mark), true, nil
+}
+
+// mark returns the time of the latest forwarded record of the data stream, or nil if none is forwarded
+func (r *Replicator) mark(name string) (*float64, error) {
+	b, err := r.marks.Get([]byte(name), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	mark := math.Float64frombits(binary.BigEndian.Uint64(b))
+	return &mark, nil
+}
+
+func (r *Replicator) setMark(name string, mark float64) error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(mark))
+	return r.marks.Put([]byte(name), b, &opt.WriteOptions{Sync: true})
+}
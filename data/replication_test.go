@@ -0,0 +1,180 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/gorilla/mux"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// remoteHDS serves the registry and data APIs which are used by the replicator
+func remoteHDS(t *testing.T, reg registry.Storage, storage Storage) *httptest.Server {
+	regAPI := registry.NewAPI(reg, false)
+	dataAPI := NewAPI(reg, storage, nil, nil, false)
+	router := mux.NewRouter()
+	router.Methods("POST").Path("/registry/").HandlerFunc(regAPI.Create)
+	router.Methods("GET").Path("/registry/{id:.+}").HandlerFunc(regAPI.Retrieve)
+	router.Methods("POST").Path("/data/{id:.+}").HandlerFunc(dataAPI.Submit)
+	return httptest.NewServer(router)
+}
+
+func TestReplicator(t *testing.T) {
+	dir := t.TempDir()
+	local, _, err := NewMemoryStorage(common.DataConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	localReg := registry.NewMemoryStorage(common.RegConf{})
+	streams := make(map[string]*registry.DataStream)
+	for name, site := range map[string]string{"factory/a": "", "factory/b": "f2", "other/c": "f1", "other/d": "f2"} {
+		ds := registry.DataStream{Name: name, Type: common.FLOAT, Meta: map[string]interface{}{"site": site}}
+		if _, err := localReg.Add(ds); err != nil {
+			t.Fatal(err)
+		}
+		streams[name] = &ds
+		if err := local.Submit(records(&ds, 1, 5)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	remote, _, err := NewMemoryStorage(common.DataConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteReg := registry.NewMemoryStorage(common.RegConf{})
+	server := remoteHDS(t, remoteReg, remote)
+	conf := common.ReplicationConf{
+		Endpoint:  server.URL,
+		Streams:   []string{"factory/*"},
+		Filters:   []common.FilterConf{{Path: "meta.site", Op: "equals", Value: "f1"}},
+		BatchSize: 2,
+	}
+	replicator, err := NewReplicator(local, conf, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicator.registry = localReg
+
+	// the selected data streams are registered and forwarded in batches
+	forwarded, err := replicator.Replicate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forwarded) != 3 || forwarded["factory/a"] != 5 || forwarded["factory/b"] != 5 || forwarded["other/c"] != 5 {
+		t.Fatalf("Expected 5 forwarded records of the 3 selected data streams, got %v", forwarded)
+	}
+	if _, err := remoteReg.Get("other/d"); !registry.ErrType(err, registry.ErrNotFound) {
+		t.Fatalf("Expected the unselected data stream not to be registered remotely, got %v", err)
+	}
+	for _, name := range []string{"factory/a", "factory/b", "other/c"} {
+		ds, err := remoteReg.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := count(t, remote, ds); n != 5 {
+			t.Fatalf("Expected 5 records of %s remotely, got %d", name, n)
+		}
+	}
+
+	// the new data is kept while the remote is offline
+	server.Close()
+	if err := local.Submit(records(streams["factory/a"], 6, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if forwarded, _ := replicator.Replicate(); len(forwarded) != 0 {
+		t.Fatalf("Expected nothing to be forwarded to the offline remote, got %v", forwarded)
+	}
+	if err := replicator.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// forwarding resumes after the latest forwarded records after a restart
+	server = remoteHDS(t, remoteReg, remote)
+	defer server.Close()
+	conf.Endpoint = server.URL
+	replicator, err = NewReplicator(local, conf, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replicator.Stop()
+	replicator.registry = localReg
+	forwarded, err = replicator.Replicate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forwarded) != 1 || forwarded["factory/a"] != 3 {
+		t.Fatalf("Expected the 3 new records to be forwarded, got %v", forwarded)
+	}
+	if n := count(t, remote, streams["factory/a"]); n != 8 {
+		t.Fatalf("Expected 8 records remotely, got %d", n)
+	}
+}
+
+func TestReplicatorRetentionHold(t *testing.T) {
+	storage, _, err := NewMemoryStorage(common.DataConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	regStorage := registry.NewMemoryStorage(common.RegConf{RetentionPeriods: []string{"1h"}}, storage)
+	replicator, err := NewReplicator(storage, common.ReplicationConf{Endpoint: "http://localhost", Streams: []string{"factory/*"}}, t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replicator.Stop()
+
+	now := time.Now().Truncate(time.Second)
+	sources := make(map[string]*registry.DataStream)
+	for _, name := range []string{"factory/a", "other/b"} {
+		ds := registry.DataStream{Name: name, Type: common.FLOAT}
+		ds.Retention.Max = "1h"
+		added, err := regStorage.Add(ds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[name] = added
+		var pack senml.Pack
+		for _, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, 30 * time.Minute} {
+			v := age.Hours()
+			pack = append(pack, senml.Record{Name: name, Value: &v, Time: float64(now.Add(-age).Unix())})
+		}
+		if err := storage.Submit(map[string]senml.Pack{name: pack}, map[string]*registry.DataStream{name: added}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manager := NewRetentionManager(storage, replicator)
+	manager.registry = regStorage
+
+	// the replicated data stream is held while none of its data is forwarded
+	purged, err := manager.Purge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || purged["other/b"] != 2 {
+		t.Fatalf("Expected only the 2 expired data points of other/b to be purged, got %v", purged)
+	}
+
+	// the forwarded data is purged once expired
+	if err := replicator.setMark("factory/a", float64(now.Add(-3*time.Hour).Unix())); err != nil {
+		t.Fatal(err)
+	}
+	purged, err = manager.Purge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || purged["factory/a"] != 1 {
+		t.Fatalf("Expected the forwarded data point of factory/a to be purged, got %v", purged)
+	}
+	_, total, _, err := storage.Query(Query{To: now, Sort: common.ASC, Limit: -1, perPage: MaxPerPage}, sources["factory/a"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 {
+		t.Fatalf("Expected the 2 data points after the forwarded one to be kept, got %d", total)
+	}
+}
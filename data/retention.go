@@ -0,0 +1,150 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+const (
+	retentionPurgeInterval = 60 // seconds
+)
+
+// RetentionHold keeps data points from being purged, e.g. until they are forwarded elsewhere
+type RetentionHold interface {
+	// Hold returns whether the data of the data stream is held, and the time up to which it may be purged if so
+	// The zero time holds all data points.
+	Hold(ds *registry.DataStream) (time.Time, bool, error)
+}
+
+// RetentionManager periodically purges the data points which are older than the maximum retention of their data streams
+type RetentionManager struct {
+	registry registry.Storage
+	storage  Storage
+	holds    []RetentionHold
+	stopOnce sync.Once
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// NewRetentionManager creates a retention manager which purges the storage, except for the data which is held
+func NewRetentionManager(storage Storage, holds ...RetentionHold) *RetentionManager {
+	return &RetentionManager{
+		storage: storage,
+		holds:   holds,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Start purges the expired data points of the data streams in the given registry in the background
+func (m *RetentionManager) Start(reg registry.Storage) {
+	m.registry = reg
+	go func() {
+		defer close(m.stopped)
+		for {
+			purged, err := m.Purge()
+			if err != nil {
+				log.Println(err)
+			}
+			for name, count := range purged {
+				log.Printf("Retention: Purged %d data points of %s", count, name)
+			}
+			select {
+			case <-time.After(retentionPurgeInterval * time.Second):
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops purging and waits for an ongoing purge to finish
+// It may be called more than once, e.g. by several shutdown paths.
+func (m *RetentionManager) Stop() {
+	m.stopOnce.Do(func() { close(m.stop) })
+	if m.registry != nil {
+		<-m.stopped
+	}
+}
+
+// Purge deletes the data points which are older than the maximum retention of their data streams
+// It returns the number of deleted data points for every data stream that had expired data
+func (m *RetentionManager) Purge() (map[string]int, error) {
+	purged := make(map[string]int)
+	now := time.Now()
+
+	perPage := 100
+	for page := 1; ; page++ {
+		dataStreams, total, err := m.registry.GetMany(page, perPage)
+		if err != nil {
+			return purged, fmt.Errorf("Retention: Error getting data streams: %v", err)
+		}
+
+		for i, ds := range dataStreams {
+			if ds.Retention.Max == "" {
+				continue
+			}
+			max, err := common.ParsePeriod(ds.Retention.Max)
+			if err != nil {
+				log.Printf("Retention: Skipping %s: %v", ds.Name, err)
+				continue
+			}
+			if ds.Retention.Min != "" {
+				min, err := common.ParsePeriod(ds.Retention.Min)
+				if err != nil || max < min {
+					log.Printf("Retention: Skipping %s: maximum retention %s violates the minimum %s", ds.Name, ds.Retention.Max, ds.Retention.Min)
+					continue
+				}
+			}
+
+			to, err := m.held(&dataStreams[i], now.Add(-max))
+			if err != nil {
+				log.Printf("Retention: Skipping %s: %v", ds.Name, err)
+				continue
+			}
+			if to.IsZero() {
+				continue
+			}
+
+			count, err := m.storage.Delete([]*registry.DataStream{&dataStreams[i]}, time.Time{}, to)
+			if err != nil {
+				log.Printf("Retention: Error purging %s: %v", ds.Name, err)
+				continue
+			}
+			if count > 0 {
+				purged[ds.Name] = count
+			}
+		}
+
+		if page*perPage >= total {
+			break
+		}
+	}
+	return purged, nil
+}
+
+// held returns the time up to which the data of the data stream may be purged, given the time it expires at
+// The zero time is returned if all data is held.
+func (m *RetentionManager) held(ds *registry.DataStream, expiry time.Time) (time.Time, error) {
+	to := expiry
+	for _, hold := range m.holds {
+		until, held, err := hold.Hold(ds)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if held && until.Before(to) {
+			to = until
+		}
+	}
+	if to.Before(expiry) {
+		log.Printf("Retention: Holding the expired data points of %s after %s", ds.Name, to.UTC().Format(time.RFC3339))
+	}
+	return to, nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+func TestRetentionPurge(t *testing.T) {
+	fileName := os.TempDir() + "/TestRetentionPurge"
+	deleteFile(fileName)
+	defer deleteFile(fileName)
+	storage, disconnect, err := NewSenmlStorage(common.DataConf{Backend: common.DataBackendConf{Type: SENMLSTORE, DSN: fileName}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disconnect()
+	regStorage := registry.NewMemoryStorage(common.RegConf{RetentionPeriods: []string{"1h"}}, storage)
+
+	expiring := registry.DataStream{Name: "retention/expiring", Type: common.FLOAT}
+	expiring.Retention.Max = "1h"
+	kept := registry.DataStream{Name: "retention/kept", Type: common.FLOAT}
+	data := make(map[string]senml.Pack)
+	sources := make(map[string]*registry.DataStream)
+	now := time.Now()
+	for _, ds := range []registry.DataStream{expiring, kept} {
+		added, err := regStorage.Add(ds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, 30 * time.Minute, 0} {
+			v := age.Hours()
+			data[ds.Name] = append(data[ds.Name], senml.Record{Name: ds.Name, Value: &v, Time: float64(now.Add(-age).Unix())})
+		}
+		sources[ds.Name] = added
+	}
+	if err := storage.Submit(data, sources); err != nil {
+		t.Fatal(err)
+	}
+
+	manager := NewRetentionManager(storage)
+	manager.registry = regStorage
+	purged, err := manager.Purge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || purged[expiring.Name] != 2 {
+		t.Errorf("Expected 2 purged data points of %s, got %v", expiring.Name, purged)
+	}
+
+	q := Query{To: now.Add(time.Minute), Sort: common.ASC, Limit: -1, perPage: MaxPerPage}
+	for ds, expected := range map[*registry.DataStream]int{sources[expiring.Name]: 2, sources[kept.Name]: 4} {
+		_, total, _, err := storage.Query(q, ds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != expected {
+			t.Errorf("Expected %d remaining data points of %s, got %d", expected, ds.Name, total)
+		}
+	}
+}
+
+func TestRetentionStop(t *testing.T) {
+	storage, _, err := NewMemoryStorage(common.DataConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := NewRetentionManager(storage)
+	manager.Start(registry.NewMemoryStorage(common.RegConf{}, storage))
+
+	// stopping again returns at once
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		manager.Stop()
+		manager.Stop()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stopping again is blocked")
+	}
+}
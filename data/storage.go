@@ -11,19 +11,21 @@ import (
 )
 
 const (
-	INFLUXDB   = "influxdb"
-	MONGODB    = "mongodb"
-	SENMLSTORE = "senmlstore"
+	INFLUXDB    = "influxdb"
+	MONGODB     = "mongodb"
+	SENMLSTORE  = "senmlstore"
+	MEMORY      = "memory"
+	POSTGRES    = "postgres"
+	TIMESCALEDB = "timescaledb"
 )
 
-// SupportedBackends returns true if the backend is listed as true
+// SupportedBackends returns true if a backend is registered with the name
+// Mongodb is not supported after HDS v0.5.3
 func SupportedBackends(name string) bool {
-	supportedBackends := map[string]bool{
-		INFLUXDB:   false, // Influxdb is not supported from HDS v1.0.0
-		MONGODB:    false, // Mongodb is not supported after HDS v0.5.3
-		SENMLSTORE: true,
-	}
-	return supportedBackends[strings.ToLower(name)]
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+	_, found := backends[strings.ToLower(name)]
+	return found
 }
 
 // Storage is an interface of a Data storage backend
@@ -34,9 +36,46 @@ type Storage interface {
 	Submit(data map[string]senml.Pack, sources map[string]*registry.DataStream) error
 
 	// Queries data for specified data sources
-	//Query(q Query, page, perPage int, sources ...*registry.DataSource) (senml.Pack, int, error)
-	Query(q Query, sources ...*registry.DataStream) (senml.Pack, int, *time.Time, error)
+	// The data of all sources is merged in the order of the query
+	// The returned cursor is nil when there are no more entries
+	Query(q Query, sources ...*registry.DataStream) (senml.Pack, int, Cursor, error)
+
+	// Deletes data points of specified data sources within a time range (inclusive)
+	// Returns the total number of deleted data points
+	Delete(sources []*registry.DataStream, from time.Time, to time.Time) (int, error)
 
 	// EventListener includes methods for event handling
 	registry.EventListener
 }
+
+// StreamingStorage is a Storage which sends query results as they are read instead of buffering pages
+type StreamingStorage interface {
+	Storage
+
+	// Sends the data points of a data source within the time range of the query in the order of the query
+	// Streaming stops at the first error returned by send
+	QueryStream(q Query, ds *registry.DataStream, send func(senml.Record) error) error
+}
+
+// AtomicStorage is a Storage which may store all or none of the data of a submission
+type AtomicStorage interface {
+	Storage
+
+	// Returns true if a failed submission stores none of its data
+	Atomic() bool
+}
+
+// IsAtomic returns true if the storage stores all or none of the data of a submission
+func IsAtomic(storage Storage) bool {
+	s, ok := storage.(AtomicStorage)
+	return ok && s.Atomic()
+}
+
+// AsyncStorage is a Storage which queues the submissions and writes them asynchronously
+type AsyncStorage interface {
+	Storage
+
+	// Queues the data and calls done with the result of writing it
+	// While the queue is full, it either blocks or returns ErrQueueFull.
+	Enqueue(data map[string]senml.Pack, sources map[string]*registry.DataStream, done func(error), block bool) error
+}
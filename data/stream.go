@@ -0,0 +1,137 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"sync"
+
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+const (
+	streamBufferSize = 100 // packs
+	streamKeepAlive  = 30  // seconds
+)
+
+// StreamHub publishes the data accepted by the storage to the subscribers of data streams
+type StreamHub struct {
+	Storage
+	sync.Mutex
+	// subscribers by data stream names
+	subscribers map[string]map[*subscriber]bool
+}
+
+// subscriber receives the data of one or more data streams
+// The channel is closed when the subscriber is dropped for not keeping up or when a data stream is deleted
+type subscriber struct {
+	names []string
+	ch    chan senml.Pack
+}
+
+func NewStreamHub(storage Storage) *StreamHub {
+	return &StreamHub{
+		Storage:     storage,
+		subscribers: make(map[string]map[*subscriber]bool),
+	}
+}
+
+// Submit stores the data and publishes it to the subscribers
+func (h *StreamHub) Submit(data map[string]senml.Pack, sources map[string]*registry.DataStream) error {
+	err := h.Storage.Submit(data, sources)
+	if err != nil {
+		return err
+	}
+	h.publish(data)
+	return nil
+}
+
+// Atomic returns true if the underlying storage is atomic, as failed submissions are not published
+func (h *StreamHub) Atomic() bool {
+	return IsAtomic(h.Storage)
+}
+
+// QueryStream streams the query results of the underlying storage
+func (h *StreamHub) QueryStream(q Query, ds *registry.DataStream, send func(senml.Record) error) error {
+	return QueryStream(h.Storage, q, ds, send)
+}
+
+func (h *StreamHub) publish(data map[string]senml.Pack) {
+	h.Lock()
+	defer h.Unlock()
+	for name, pack := range data {
+		for sub := range h.subscribers[name] {
+			select {
+			case sub.ch <- pack:
+			default:
+				// drop the subscriber instead of blocking the submission
+				h.remove(sub)
+			}
+		}
+	}
+}
+
+func (h *StreamHub) subscribe(names ...string) *subscriber {
+	h.Lock()
+	defer h.Unlock()
+	sub := &subscriber{
+		names: names,
+		ch:    make(chan senml.Pack, streamBufferSize),
+	}
+	for _, name := range names {
+		if h.subscribers[name] == nil {
+			h.subscribers[name] = make(map[*subscriber]bool)
+		}
+		h.subscribers[name][sub] = true
+	}
+	return sub
+}
+
+func (h *StreamHub) unsubscribe(sub *subscriber) {
+	h.Lock()
+	defer h.Unlock()
+	h.remove(sub)
+}
+
+// remove removes the subscriber and closes its channel, if not removed already
+func (h *StreamHub) remove(sub *subscriber) {
+	removed := false
+	for _, name := range sub.names {
+		if _, found := h.subscribers[name][sub]; found {
+			delete(h.subscribers[name], sub)
+			removed = true
+		}
+		if len(h.subscribers[name]) == 0 {
+			delete(h.subscribers, name)
+		}
+	}
+	if removed {
+		close(sub.ch)
+	}
+}
+
+// Close drops all subscribers, ending their streams
+func (h *StreamHub) Close() {
+	h.Lock()
+	defer h.Unlock()
+	for _, subs := range h.subscribers {
+		for sub := range subs {
+			h.remove(sub)
+		}
+	}
+}
+
+// DeleteHandler handles deletion of a data source
+func (h *StreamHub) DeleteHandler(ds registry.DataStream) error {
+	err := h.Storage.DeleteHandler(ds)
+	if err != nil {
+		return err
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	for sub := range h.subscribers[ds.Name] {
+		h.remove(sub)
+	}
+	return nil
+}
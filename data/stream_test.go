@@ -0,0 +1,171 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/gorilla/mux"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+	"golang.org/x/net/websocket"
+)
+
+func setupStream(t *testing.T, fileName string) (*httptest.Server, *StreamHub, *registry.DataStream, func()) {
+	deleteFile(fileName)
+	storage, disconnect, err := NewSenmlStorage(common.DataConf{Backend: common.DataBackendConf{Type: SENMLSTORE, DSN: fileName}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := NewStreamHub(storage)
+	regStorage := registry.NewMemoryStorage(common.RegConf{}, hub)
+	ds, err := regStorage.Add(registry.DataStream{Name: "stream/sensor", Type: common.FLOAT})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := NewAPI(regStorage, hub, hub, nil, false)
+	r := mux.NewRouter().StrictSlash(true).SkipClean(true)
+	r.Methods("GET").Path("/data/{id:.+}/stream").HandlerFunc(api.Stream)
+	ts := httptest.NewServer(r)
+
+	return ts, hub, ds, func() {
+		ts.Close()
+		disconnect()
+		deleteFile(fileName)
+	}
+}
+
+func submitValue(t *testing.T, hub *StreamHub, ds *registry.DataStream, v float64, at time.Time) {
+	err := hub.Submit(
+		map[string]senml.Pack{ds.Name: {{Name: ds.Name, Value: &v, Time: float64(at.Unix())}}},
+		map[string]*registry.DataStream{ds.Name: ds})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamSSE(t *testing.T) {
+	ts, hub, ds, teardown := setupStream(t, os.TempDir()+"/TestStreamSSE")
+	defer teardown()
+
+	now := time.Now()
+	submitValue(t, hub, ds, 1, now.Add(-time.Minute))
+
+	from := now.Add(-time.Hour).UTC().Format(time.RFC3339)
+	res, err := http.Get(ts.URL + "/data/" + ds.Name + "/stream?from=" + from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Server response is %v instead of %v", res.StatusCode, http.StatusOK)
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("Unexpected content type: %s", res.Header.Get("Content-Type"))
+	}
+
+	reader := bufio.NewReader(res.Body)
+	next := func() senml.Pack {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(line, "data: ") {
+				var pack senml.Pack
+				err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &pack)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return pack
+			}
+		}
+	}
+
+	// replayed
+	pack := next()
+	if len(pack) != 1 || *pack[0].Value != 1 {
+		t.Fatalf("Unexpected replayed data: %v", pack)
+	}
+	// live
+	submitValue(t, hub, ds, 2, now)
+	pack = next()
+	if len(pack) != 1 || *pack[0].Value != 2 {
+		t.Fatalf("Unexpected live data: %v", pack)
+	}
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	ts, hub, ds, teardown := setupStream(t, os.TempDir()+"/TestStreamWebSocket")
+	defer teardown()
+
+	now := time.Now()
+	submitValue(t, hub, ds, 1, now.Add(-time.Minute))
+
+	from := now.Add(-time.Hour).UTC().Format(time.RFC3339)
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/data/"+ds.Name+"/stream?from="+from, "", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// replayed
+	var pack senml.Pack
+	if err := websocket.JSON.Receive(ws, &pack); err != nil {
+		t.Fatal(err)
+	}
+	if len(pack) != 1 || *pack[0].Value != 1 {
+		t.Fatalf("Unexpected replayed data: %v", pack)
+	}
+	// live
+	submitValue(t, hub, ds, 2, now)
+	if err := websocket.JSON.Receive(ws, &pack); err != nil {
+		t.Fatal(err)
+	}
+	if len(pack) != 1 || *pack[0].Value != 2 {
+		t.Fatalf("Unexpected live data: %v", pack)
+	}
+}
+
+func TestStreamHubClose(t *testing.T) {
+	ts, hub, ds, teardown := setupStream(t, os.TempDir()+"/TestStreamHubClose")
+	defer teardown()
+
+	res, err := http.Get(ts.URL + "/data/" + ds.Name + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	// the headers are sent before subscribing
+	for subscribed := false; !subscribed; time.Sleep(10 * time.Millisecond) {
+		hub.Lock()
+		subscribed = len(hub.subscribers[ds.Name]) > 0
+		hub.Unlock()
+	}
+
+	hub.Close()
+	// the stream ends instead of waiting for the client
+	ended := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(res.Body)
+		ended <- err
+	}()
+	select {
+	case err := <-ended:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream did not end after closing the hub")
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/data"
+	"github.com/linksmart/historical-datastore/data/datatest"
+)
+
+// newStorage creates a storage of the backend, which is disconnected with the cleanup of the test
+func newStorage(t *testing.T, backend, dsn string) data.Storage {
+	storage, disconnect, err := data.NewStorage(common.DataConf{Backend: common.DataBackendConf{Type: backend, DSN: dsn}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { disconnect() })
+	return storage
+}
+
+func TestLightdbStorage(t *testing.T) {
+	datatest.RunStorageSuite(t, func(t *testing.T) data.Storage {
+		return newStorage(t, data.SENMLSTORE, filepath.Join(t.TempDir(), "data.db"))
+	})
+}
+
+func TestMemoryStorage(t *testing.T) {
+	datatest.RunStorageSuite(t, func(t *testing.T) data.Storage {
+		return newStorage(t, data.MEMORY, "")
+	})
+}
+
+func TestInfluxStorage(t *testing.T) {
+	datatest.RunStorageSuite(t, func(t *testing.T) data.Storage {
+		return data.FakeInfluxStorage(t)
+	})
+}
+
+func TestPostgresStorage(t *testing.T) {
+	datatest.RunStorageSuite(t, func(t *testing.T) data.Storage {
+		return data.FakePostgresStorage(t)
+	})
+}
+
+func TestStreamHubStorage(t *testing.T) {
+	datatest.RunStorageSuite(t, func(t *testing.T) data.Storage {
+		return data.NewStreamHub(newStorage(t, data.MEMORY, ""))
+	})
+}
+
+func TestBatchStorage(t *testing.T) {
+	datatest.RunStorageSuite(t, func(t *testing.T) data.Storage {
+		batch := data.NewBatchStorage(newStorage(t, data.MEMORY, ""), common.BatchConf{MaxLatency: 1})
+		t.Cleanup(batch.Close)
+		return batch
+	})
+}
+
+func TestWALStorage(t *testing.T) {
+	datatest.RunStorageSuite(t, func(t *testing.T) data.Storage {
+		wal, err := data.OpenWAL(t.TempDir(), common.WALConf{Sync: data.WALSyncNone})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { wal.Close() })
+		return data.NewWALStorage(newStorage(t, data.MEMORY, ""), wal, nil)
+	})
+}
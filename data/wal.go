@@ -0,0 +1,451 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// Sync modes of the WAL
+const (
+	// WALSyncNone leaves flushing the log to the operating system
+	WALSyncNone = "none"
+	// WALSyncBatch flushes the log once for the submissions which are appended concurrently
+	WALSyncBatch = "batch"
+	// WALSyncEvery flushes the log after every submission
+	WALSyncEvery = "every"
+)
+
+const (
+	defaultWALSegmentSize = 16 << 20 // bytes
+	walEntryHeader        = 8        // bytes
+	walMaxEntry           = 1 << 30  // bytes
+	walSegmentExt         = ".wal"
+)
+
+// SupportedWALSync returns true if the WAL supports the sync mode
+func SupportedWALSync(mode string) bool {
+	switch strings.ToLower(mode) {
+	case WALSyncNone, WALSyncBatch, WALSyncEvery:
+		return true
+	}
+	return false
+}
+
+// walSegment is a file of the log
+type walSegment struct {
+	id   uint64
+	file *os.File
+	size int64
+	// pending is the number of entries which are not committed
+	pending int
+}
+
+// WAL is an append-only log of the submissions, which are removed once they are committed
+// The log is split into segment files. A segment is removed when all of its entries are
+// committed, or truncated if it is the one being appended to. The segments which are left
+// from the previous run are replayed before they are removed.
+type WAL struct {
+	dir         string
+	mode        string
+	segmentSize int64
+
+	sync.Mutex
+	active   *walSegment
+	segments map[uint64]*walSegment
+	// recovered are the segments of the previous run, in order
+	recovered []string
+	// seq is the number of appended entries, and synced the number of those flushed to the disk
+	seq      uint64
+	syncLock sync.Mutex
+	synced   uint64
+}
+
+// OpenWAL opens the log in the directory and starts a new segment after the ones to be replayed
+func OpenWAL(dir string, conf common.WALConf) (*WAL, error) {
+	w := &WAL{
+		dir:         dir,
+		mode:        strings.ToLower(conf.Sync),
+		segmentSize: int64(conf.SegmentSize),
+		segments:    make(map[uint64]*walSegment),
+	}
+	if w.mode == "" {
+		w.mode = WALSyncBatch
+	}
+	if !SupportedWALSync(w.mode) {
+		return nil, fmt.Errorf("unsupported WAL sync mode: %s", conf.Sync)
+	}
+	if w.segmentSize <= 0 {
+		w.segmentSize = defaultWALSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var last uint64
+	for _, f := range files {
+		var id uint64
+		if _, err := fmt.Sscanf(f.Name(), "%016x"+walSegmentExt, &id); err != nil || f.IsDir() {
+			continue
+		}
+		w.recovered = append(w.recovered, filepath.Join(dir, f.Name()))
+		if id > last {
+			last = id
+		}
+	}
+	sort.Strings(w.recovered)
+
+	if err := w.startSegment(last + 1); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *WAL) segmentPath(id uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%016x%s", id, walSegmentExt))
+}
+
+// startSegment creates the segment to append to
+func (w *WAL) startSegment(id uint64) error {
+	f, err := os.OpenFile(w.segmentPath(id), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if w.mode != WALSyncNone {
+		// persist the new file in the directory
+		if err := syncDir(w.dir); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	w.active = &walSegment{id: id, file: f}
+	w.segments[id] = w.active
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Append logs the data and returns the segment which is passed to Commit after the data is stored
+// The data is flushed to the disk before returning, unless the sync mode is none.
+func (w *WAL) Append(data map[string]senml.Pack) (uint64, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return 0, err
+	}
+	entry := make([]byte, walEntryHeader+len(payload))
+	binary.BigEndian.PutUint32(entry[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(entry[4:8], crc32.ChecksumIEEE(payload))
+	copy(entry[walEntryHeader:], payload)
+
+	w.Lock()
+	if w.active.size > 0 && w.active.size+int64(len(entry)) > w.segmentSize {
+		if err := w.rotate(); err != nil {
+			w.Unlock()
+			return 0, err
+		}
+	}
+	segment := w.active
+	if _, err := segment.file.Write(entry); err != nil {
+		// drop the partial entry, which would hide the following ones from the replay
+		segment.file.Truncate(segment.size)
+		w.Unlock()
+		return 0, err
+	}
+	segment.size += int64(len(entry))
+	segment.pending++
+	w.seq++
+	seq := w.seq
+	if w.mode == WALSyncEvery {
+		err = segment.file.Sync()
+	}
+	w.Unlock()
+
+	if err == nil && w.mode == WALSyncBatch {
+		err = w.syncUpTo(seq)
+	}
+	if err != nil {
+		w.Commit(segment.id)
+		return 0, err
+	}
+	return segment.id, nil
+}
+
+// syncUpTo flushes the log, unless the entry is flushed along with others already
+func (w *WAL) syncUpTo(seq uint64) error {
+	w.syncLock.Lock()
+	defer w.syncLock.Unlock()
+	if w.synced >= seq {
+		return nil
+	}
+	w.Lock()
+	file, last := w.active.file, w.seq
+	w.Unlock()
+	// the segment may be rotated meanwhile, which flushes it before closing
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	w.synced = last
+	return nil
+}
+
+// rotate closes the active segment and starts the next one
+func (w *WAL) rotate() error {
+	old := w.active
+	if w.mode != WALSyncNone {
+		if err := old.file.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := w.startSegment(old.id + 1); err != nil {
+		return err
+	}
+	old.file.Close()
+	if old.pending == 0 {
+		w.remove(old)
+	}
+	return nil
+}
+
+func (w *WAL) remove(segment *walSegment) {
+	delete(w.segments, segment.id)
+	if err := os.Remove(w.segmentPath(segment.id)); err != nil {
+		log.Printf("WAL: Error removing segment: %s", err)
+	}
+}
+
+// Commit marks an entry of the segment as stored
+// The segment is removed, or truncated if it is being appended to, when all of its entries are committed.
+func (w *WAL) Commit(id uint64) {
+	w.Lock()
+	defer w.Unlock()
+	segment, found := w.segments[id]
+	if !found {
+		return
+	}
+	segment.pending--
+	if segment.pending > 0 {
+		return
+	}
+	if segment != w.active {
+		w.remove(segment)
+		return
+	}
+	if err := segment.file.Truncate(0); err != nil {
+		log.Printf("WAL: Error truncating segment: %s", err)
+		return
+	}
+	segment.size = 0
+}
+
+// Size returns the size of the log in bytes, excluding the segments to be replayed
+func (w *WAL) Size() int64 {
+	w.Lock()
+	defer w.Unlock()
+	var size int64
+	for _, segment := range w.segments {
+		size += segment.size
+	}
+	return size
+}
+
+// Replay passes the entries of the previous run to apply in order, and removes them afterwards
+func (w *WAL) Replay(apply func(data map[string]senml.Pack) error) error {
+	w.Lock()
+	recovered := w.recovered
+	w.recovered = nil
+	w.Unlock()
+
+	for _, path := range recovered {
+		entries, err := readSegment(path, apply)
+		if err != nil {
+			return fmt.Errorf("error replaying %s: %w", path, err)
+		}
+		if entries > 0 {
+			log.Printf("WAL: Replayed %d submissions of %s", entries, path)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSegment passes the entries of the segment to apply, until the end or a partially written entry
+func readSegment(path string, apply func(data map[string]senml.Pack) error) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, walEntryHeader)
+	for entries := 0; ; entries++ {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			log.Printf("WAL: Ignoring the incomplete entry after %d entries of %s", entries, path)
+			return entries, nil
+		}
+		length, checksum := binary.BigEndian.Uint32(header[0:4]), binary.BigEndian.Uint32(header[4:8])
+		if length > walMaxEntry {
+			log.Printf("WAL: Ignoring the corrupt entry after %d entries of %s", entries, path)
+			return entries, nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			log.Printf("WAL: Ignoring the incomplete entry after %d entries of %s", entries, path)
+			return entries, nil
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			log.Printf("WAL: Ignoring the corrupt entry after %d entries of %s", entries, path)
+			return entries, nil
+		}
+		var data map[string]senml.Pack
+		if err := json.Unmarshal(payload, &data); err != nil {
+			return entries, err
+		}
+		if err := apply(data); err != nil {
+			return entries, err
+		}
+	}
+}
+
+// Close flushes the log and closes it
+// The active segment is removed if all of its entries are committed.
+func (w *WAL) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	segment := w.active
+	if segment.pending == 0 {
+		segment.file.Close()
+		w.remove(segment)
+		return nil
+	}
+	if err := segment.file.Sync(); err != nil {
+		segment.file.Close()
+		return err
+	}
+	return segment.file.Close()
+}
+
+// WALStorage logs the submissions before passing them to the underlying storage
+// A submission is acknowledged once it is logged, if the storage queues it, and otherwise once
+// it is stored. The submissions which fail after being acknowledged are stored as dead letters.
+type WALStorage struct {
+	Storage
+	wal         *WAL
+	deadLetters *DeadLetterStore
+}
+
+// NewWALStorage passes the logged submissions to the storage
+func NewWALStorage(storage Storage, wal *WAL, deadLetters *DeadLetterStore) *WALStorage {
+	return &WALStorage{
+		Storage:     storage,
+		wal:         wal,
+		deadLetters: deadLetters,
+	}
+}
+
+// Submit logs the data and passes it to the underlying storage
+// ErrQueueFull is returned at once when the queue of the storage is full.
+func (s *WALStorage) Submit(data map[string]senml.Pack, sources map[string]*registry.DataStream) error {
+	return s.enqueue(data, sources, s.reject(data), false)
+}
+
+// Enqueue logs the data and passes it to the underlying storage, calling done with the result of storing it
+// While the queue of the storage is full, it either blocks or returns ErrQueueFull.
+func (s *WALStorage) Enqueue(data map[string]senml.Pack, sources map[string]*registry.DataStream, done func(error), block bool) error {
+	return s.enqueue(data, sources, done, block)
+}
+
+// QueryStream streams the query results of the underlying storage
+func (s *WALStorage) QueryStream(q Query, ds *registry.DataStream, send func(senml.Record) error) error {
+	return QueryStream(s.Storage, q, ds, send)
+}
+
+// enqueue returns the error of storing the data, unless the storage queues it
+func (s *WALStorage) enqueue(data map[string]senml.Pack, sources map[string]*registry.DataStream, done func(error), block bool) error {
+	segment, err := s.wal.Append(data)
+	if err != nil {
+		return fmt.Errorf("error writing to the WAL: %w", err)
+	}
+	async, ok := s.Storage.(AsyncStorage)
+	if !ok {
+		err = s.Storage.Submit(data, sources)
+		s.wal.Commit(segment)
+		return err
+	}
+	err = async.Enqueue(data, sources, func(err error) {
+		s.wal.Commit(segment)
+		done(err)
+	}, block)
+	if err != nil {
+		// not acknowledged, so there is nothing to recover
+		s.wal.Commit(segment)
+	}
+	return err
+}
+
+// reject returns a callback which stores the data as a dead letter if storing it fails
+func (s *WALStorage) reject(data map[string]senml.Pack) func(error) {
+	return func(err error) {
+		if err == nil {
+			return
+		}
+		log.Printf("WAL: Error writing logged data: %s", err)
+		for _, pack := range data {
+			s.deadLetters.RejectRecords(DeadLetterWAL, s.wal.dir, err.Error(), pack)
+		}
+	}
+}
+
+// Replay stores the submissions which were logged but not committed in the previous run
+// The records of the data streams which are no longer registered, or fail to be stored, are stored as dead letters.
+func (s *WALStorage) Replay(reg registry.Storage) error {
+	return s.wal.Replay(func(data map[string]senml.Pack) error {
+		sources := make(map[string]*registry.DataStream)
+		for name, pack := range data {
+			ds, err := reg.Get(name)
+			if err != nil {
+				s.deadLetters.RejectRecords(DeadLetterWAL, s.wal.dir, err.Error(), pack)
+				delete(data, name)
+				continue
+			}
+			sources[name] = ds
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		s.reject(data)(submitWaiting(s.Storage, data, sources))
+		return nil
+	})
+}
@@ -0,0 +1,219 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+func openWAL(t *testing.T, dir string, conf common.WALConf) *WAL {
+	wal, err := OpenWAL(dir, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wal
+}
+
+// segments returns the names of the segment files in the directory
+func segments(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	return names
+}
+
+// replayed returns the submissions which are replayed from the directory
+func replayed(t *testing.T, dir string) []map[string]senml.Pack {
+	wal := openWAL(t, dir, common.WALConf{})
+	defer wal.Close()
+	var submissions []map[string]senml.Pack
+	err := wal.Replay(func(data map[string]senml.Pack) error {
+		submissions = append(submissions, data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return submissions
+}
+
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+	wal := openWAL(t, dir, common.WALConf{Sync: WALSyncEvery})
+	defer wal.Close()
+	ds := &registry.DataStream{Name: "wal/replay", Type: common.FLOAT}
+	for i := 0; i < 3; i++ {
+		data, _ := records(ds, i*10, 10)
+		if _, err := wal.Append(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an entry which is cut off by a crash
+	files := segments(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("Expected one segment, got %v", files)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, files[0]), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 1, 0, 1, 2, 3, 4, '{'}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	submissions := replayed(t, dir)
+	if len(submissions) != 3 {
+		t.Fatalf("Expected the 3 complete submissions to be replayed, got %d", len(submissions))
+	}
+	for i, data := range submissions {
+		pack := data[ds.Name]
+		if len(pack) != 10 || pack[0].Time != float64(i*10) || *pack[9].Value != float64(i*10+9) {
+			t.Fatalf("Unexpected replayed submission %d: %v", i, pack)
+		}
+	}
+	if submissions := replayed(t, dir); len(submissions) != 0 {
+		t.Fatalf("Expected the replayed submissions to be removed, got %d", len(submissions))
+	}
+}
+
+func TestWALCommit(t *testing.T) {
+	dir := t.TempDir()
+	// every submission exceeds the segment size
+	wal := openWAL(t, dir, common.WALConf{SegmentSize: 1})
+	ds := &registry.DataStream{Name: "wal/commit", Type: common.FLOAT}
+
+	var ids []uint64
+	for i := 0; i < 3; i++ {
+		data, _ := records(ds, i, 1)
+		id, err := wal.Append(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if files := segments(t, dir); len(files) != 3 {
+		t.Fatalf("Expected a segment per submission, got %v", files)
+	}
+
+	// the committed segments are removed and the active one is truncated
+	wal.Commit(ids[0])
+	wal.Commit(ids[2])
+	if files := segments(t, dir); len(files) != 2 {
+		t.Fatalf("Expected the segment of the pending submission and the active one, got %v", files)
+	}
+	info, err := os.Stat(wal.segmentPath(ids[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Fatalf("Expected the active segment to be truncated, got %d bytes", info.Size())
+	}
+	wal.Commit(ids[1])
+	if size := wal.Size(); size != 0 {
+		t.Fatalf("Expected an empty log after committing all submissions, got %d bytes", size)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files := segments(t, dir); len(files) != 0 {
+		t.Fatalf("Expected no segments after closing, got %v", files)
+	}
+}
+
+func TestWALSyncModes(t *testing.T) {
+	for _, mode := range []string{WALSyncNone, WALSyncBatch, WALSyncEvery} {
+		t.Run(mode, func(t *testing.T) {
+			dir := t.TempDir()
+			wal := openWAL(t, dir, common.WALConf{Sync: mode, SegmentSize: 1024})
+			defer wal.Close()
+			ds := &registry.DataStream{Name: "wal/" + mode, Type: common.FLOAT}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					data, _ := records(ds, i, 1)
+					if _, err := wal.Append(data); err != nil {
+						t.Error(err)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			if n := len(replayed(t, dir)); n != 50 {
+				t.Fatalf("Expected 50 replayed submissions, got %d", n)
+			}
+		})
+	}
+	if _, err := OpenWAL(t.TempDir(), common.WALConf{Sync: "always"}); err == nil {
+		t.Fatal("Expected an error for an unsupported sync mode")
+	}
+}
+
+func TestWALStorage(t *testing.T) {
+	dir := t.TempDir()
+	ds := &registry.DataStream{Name: "wal/storage", Type: common.FLOAT}
+
+	// the submissions are acknowledged once logged, while the storage is held
+	inner := newGatedStorage(t, false)
+	batch := NewBatchStorage(inner, common.BatchConf{MaxLatency: 1})
+	storage := NewWALStorage(batch, openWAL(t, dir, common.WALConf{}), nil)
+	defer storage.wal.Close()
+	for i := 0; i < 5; i++ {
+		if err := storage.Submit(records(ds, i*2, 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := count(t, inner, ds); n != 0 {
+		t.Fatalf("Expected the storage to be held, got %d records", n)
+	}
+
+	// the logged submissions are stored after a crash
+	regStorage := registry.NewMemoryStorage(common.RegConf{})
+	if _, err := regStorage.Add(*ds); err != nil {
+		t.Fatal(err)
+	}
+	memory, _, err := NewMemoryStorage(common.DataConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered := NewWALStorage(memory, openWAL(t, dir, common.WALConf{}), nil)
+	defer recovered.wal.Close()
+	if err := recovered.Replay(regStorage); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, memory, ds); n != 10 {
+		t.Fatalf("Expected the 10 logged records to be replayed, got %d", n)
+	}
+
+	// the log is truncated once the submissions are stored
+	close(inner.gate)
+	batch.Close()
+	if n := count(t, inner, ds); n != 10 {
+		t.Fatalf("Expected the 10 records to be stored, got %d", n)
+	}
+	if size := storage.wal.Size(); size != 0 {
+		t.Fatalf("Expected the committed submissions to be truncated, got %d bytes", size)
+	}
+	if err := storage.Submit(records(ds, 10, 1)); err != ErrQueueClosed {
+		t.Fatalf("Expected %s, got %v", ErrQueueClosed, err)
+	}
+	if size := storage.wal.Size(); size != 0 {
+		t.Fatalf("Expected the rejected submission to be dropped, got %d bytes", size)
+	}
+}
@@ -4,21 +4,24 @@ require (
 	code.linksmart.eu/com/go-sec v1.0.0
 	code.linksmart.eu/sc/service-catalog v2.3.4+incompatible
 	github.com/ancientlore/go-avltree v1.0.1 // indirect
+	github.com/boltdb/bolt v1.3.1
 	github.com/codegangsta/negroni v0.2.0
 	github.com/dgrijalva/jwt-go v3.1.0+incompatible // indirect
 	github.com/dschowta/lite.tsdb v0.0.0-20190402134120-cd997efa39b6 // indirect
 	github.com/dschowta/senml.datastore v0.0.0-20190402134034-c6e697d815a4
 	github.com/eclipse/paho.mqtt.golang v1.1.1
 	github.com/farshidtz/elog v0.9.0 // indirect
-	github.com/farshidtz/mqtt-match v1.0.1 // indirect
+	github.com/farshidtz/mqtt-match v1.0.1
 	github.com/farshidtz/senml v1.0.2
 	github.com/gorilla/context v1.1.1
 	github.com/gorilla/mux v1.4.0
 	github.com/justinas/alice v0.0.0-20171023064455-03f45bd4b7da
+	github.com/lib/pq v1.10.9
 	github.com/onsi/ginkgo v1.8.0 // indirect
 	github.com/onsi/gomega v1.5.0 // indirect
 	github.com/rs/cors v1.6.0
 	github.com/satori/go.uuid v1.1.0
 	github.com/syndtr/goleveldb v1.0.0
+	golang.org/x/net v0.0.0-20180906233101-161cd47e91fd
 	golang.org/x/sys v0.0.0-20190322080309-f49334f85ddc // indirect
 )
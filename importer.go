@@ -0,0 +1,101 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/data"
+	"github.com/linksmart/historical-datastore/rollups"
+)
+
+const (
+	importLogInterval = 5 // seconds
+)
+
+// media types of the imported files by their extensions
+var importMediaTypes = map[string]string{
+	".csv":    data.MediaTypeCSV,
+	".json":   senml.MediaTypeSenmlJSON,
+	".jsonl":  data.MediaTypeJSONLines,
+	".ndjson": data.MediaTypeJSONLines,
+	".cbor":   senml.MediaTypeSenmlCBOR,
+	".xml":    senml.MediaTypeSenmlXML,
+}
+
+// importFiles imports the data of the files given as arguments of the import command, without starting any of the services
+// The storage must not be used by a running instance.
+func importFiles(conf *common.Config, dataStorage data.Storage, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	mediaType := flags.String("type", "", "Media type of the files, e.g. text/csv. Detected from the file extensions by default")
+	autoRegistration := flags.Bool("autoRegistration", conf.Data.AutoRegistration, "Register the unknown data streams")
+	batchSize := flags.Int("batch", data.DefaultImportBatchSize, "Number of records submitted at once")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [-conf <file>] import [flags] <file>...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("no files given")
+	}
+
+	// derived data streams are evaluated as usual
+	rollupStorage := rollups.NewStorage(dataStorage)
+	regStorage, closeReg, err := newRegistryStorage(conf.Reg, rollupStorage)
+	if err != nil {
+		return err
+	}
+	if closeReg != nil {
+		defer closeReg()
+	}
+	err = rollupStorage.Start(regStorage)
+	if err != nil {
+		return err
+	}
+	importer := data.NewImporter(regStorage, rollupStorage, *autoRegistration, *batchSize)
+
+	for _, path := range flags.Args() {
+		fileType := *mediaType
+		if fileType == "" {
+			fileType = importMediaTypes[strings.ToLower(filepath.Ext(path))]
+			if fileType == "" {
+				return fmt.Errorf("unknown type of %s, set the -type flag", path)
+			}
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Importing %s as %s", path, fileType)
+		start := time.Now()
+		lastLog := start
+		progress, err := importer.Import(f, fileType, func(p data.ImportProgress) {
+			if time.Since(lastLog) > importLogInterval*time.Second {
+				log.Printf("%s: %d records imported and %d rejected in %v", path, p.Imported, p.Rejected, time.Since(start))
+				lastLog = time.Now()
+			}
+		})
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		log.Printf("%s: %d records imported and %d rejected in %v", path, progress.Imported, progress.Rejected, time.Since(start))
+		for _, name := range progress.Registered {
+			log.Printf("%s: Registered %s", path, name)
+		}
+		for _, reason := range progress.Errors {
+			log.Printf("%s: Rejected %s", path, reason)
+		}
+	}
+	return nil
+}
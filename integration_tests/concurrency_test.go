@@ -37,7 +37,7 @@ func TestConcurrentCreates(t *testing.T) {
 			defer wg.Done()
 			_, err := registryClient.Add(thisDS)
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
 			}
 		}(entries[i])
 	}
@@ -106,7 +106,7 @@ func TestConcurrentUpdates(t *testing.T) {
 			thisDS.Retention.Min = ""
 			err := registryClient.Update(thisDS.Name, thisDS)
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
 			}
 		}(entries[i])
 	}
@@ -163,7 +163,7 @@ func TestConcurrentDeletes(t *testing.T) {
 			defer wg.Done()
 			err := registryClient.Delete(id)
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
 			}
 		}(entries[i].Name)
 	}
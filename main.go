@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -10,15 +11,24 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	_ "code.linksmart.eu/com/go-sec/auth/keycloak/validator"
 	"code.linksmart.eu/com/go-sec/auth/validator"
 	"github.com/linksmart/historical-datastore/common"
 	"github.com/linksmart/historical-datastore/data"
+	"github.com/linksmart/historical-datastore/metrics"
 	"github.com/linksmart/historical-datastore/registry"
+	"github.com/linksmart/historical-datastore/rollups"
 	uuid "github.com/satori/go.uuid"
 )
 
+const (
+	mqttQuiesce = 250 // ms
+)
+
 const LINKSMART = `
 ╦   ╦ ╔╗╔ ╦╔═  ╔═╗ ╔╦╗ ╔═╗ ╦═╗ ╔╦╗
 ║   ║ ║║║ ╠╩╗  ╚═╗ ║║║ ╠═╣ ╠╦╝  ║
@@ -29,6 +39,7 @@ var (
 	confPath    = flag.String("conf", "conf/historical-datastore.json", "Historical Datastore configuration file path")
 	profile     = flag.Bool("profile", false, "Enable the HTTP server for runtime profiling")
 	version     = flag.Bool("version", false, "Show the Historical Datastore API version")
+	restore     = flag.String("restore", "", "Restore the registry and data from a backup archive and exit")
 	Version     string // set with build flags
 	BuildNumber string // set with build flags
 )
@@ -60,99 +71,259 @@ func main() {
 	if err != nil {
 		log.Fatalf("Config File: %s\n", err)
 	}
+	if effective, err := maskedConfig(conf); err == nil {
+		log.Printf("Configuration: %s", effective)
+	}
 	if conf.ServiceID == "" {
 		conf.ServiceID = uuid.NewV4().String()
 		log.Printf("Service ID not set. Generated new UUID: %s", conf.ServiceID)
 	}
 
 	// Setup data and aggregation backends
-	var (
-		dataStorage data.Storage
-		//aggrStorage aggregation.Storage
-	)
-	switch conf.Data.Backend.Type {
-	case data.SENMLSTORE:
-		var disconnect_func func() error
-		dataStorage, disconnect_func, err = data.NewSenmlStorage(conf.Data)
+	dataStorage, closeData, err := data.NewStorage(conf.Data)
+	if err != nil {
+		log.Fatalf("Error creating %s storage: %s", conf.Data.Backend.Type, err)
+	}
+	// backups are only supported by the storages which can hold off the writes
+	snapshotStorage, _ := dataStorage.(data.SnapshotStorage)
+	if flag.Arg(0) == "import" {
+		err = importFiles(conf, dataStorage, flag.Args()[1:])
+		closeData()
 		if err != nil {
-			log.Fatalf("Error creating senml storage: %s", err)
+			log.Fatalf("Error importing data: %s", err)
 		}
-		defer disconnect_func()
+		return
+	}
+	if *restore != "" {
+		err = restoreBackup(conf, dataStorage, *restore)
+		closeData()
+		if err != nil {
+			log.Fatalf("Error restoring backup: %s", err)
+		}
+		log.Println("Restored backup.")
+		return
+	}
+	// Publish the stored data to the live streams, including the derived data
+	streamHub := data.NewStreamHub(dataStorage)
+	dataStorage = streamHub
+	// Evaluate the functions of derived data streams on submission
+	rollupStorage := rollups.NewStorage(dataStorage)
+	dataStorage = rollupStorage
+	// Coalesce the submissions into batches
+	var batchStorage *data.BatchStorage
+	if conf.Data.Batch.Enabled {
+		batchStorage = data.NewBatchStorage(dataStorage, conf.Data.Batch)
+		dataStorage = batchStorage
 	}
 	if conf.Data.AutoRegistration {
 		log.Println("Auto Registration is enabled: Data HTTP API will automatically create new data sources.")
 	}
+	// Store the rejected submissions next to the data
+	deadLetters, closeDeadLetters, err := data.NewDeadLetterStore(filepath.Join(conf.Data.Dir, "deadletter"), conf.Data.DeadLetter.MaxEntries, nil)
+	if err != nil {
+		log.Fatalf("Error opening dead letter store: %s", err)
+	}
+	// Log the submissions before acknowledging them, to store them after a crash
+	var wal *data.WAL
+	var walStorage *data.WALStorage
+	if conf.Data.WAL.Enabled {
+		wal, err = data.OpenWAL(filepath.Join(conf.Data.Dir, "wal"), conf.Data.WAL)
+		if err != nil {
+			log.Fatalf("Error opening WAL: %s", err)
+		}
+		walStorage = data.NewWALStorage(dataStorage, wal, deadLetters)
+		dataStorage = walStorage
+	}
 	// MQTT connector
-	mqttConn, err := data.NewMQTTConnector(dataStorage, conf.ServiceID)
+	// the persistent MQTT sessions are stored next to the data
+	mqttStoreDir := filepath.Join(conf.Data.Dir, "mqtt")
+	mqttConn, err := data.NewMQTTConnector(dataStorage, deadLetters, conf.ServiceID, mqttStoreDir)
 	if err != nil {
 		log.Fatalf("Error creating MQTT Connector: %s", err)
 	}
 
 	// Setup registry
-	var (
-		regStorage registry.Storage
-		closeReg   func() error
-	)
-	switch conf.Reg.Backend.Type {
-	case registry.MEMORY:
-		regStorage = registry.NewMemoryStorage(conf.Reg, dataStorage, mqttConn)
-	case registry.LEVELDB:
-		regStorage, closeReg, err = registry.NewLevelDBStorage(conf.Reg, nil, dataStorage, mqttConn)
-		if err != nil {
-			log.Fatalf("Failed to start LevelDB: %s\n", err)
-		}
+	regStorage, closeReg, err := newRegistryStorage(conf.Reg, dataStorage, mqttConn)
+	if err != nil {
+		log.Fatalf("Failed to start LevelDB: %s\n", err)
 	}
 
 	// Setup APIs
-	regAPI := registry.NewAPI(regStorage)
-	dataAPI := data.NewAPI(regStorage, dataStorage, conf.Data.AutoRegistration)
+	// with auth, the sensitive information is only exported to authorised users
+	regAPI := registry.NewAPI(regStorage, conf.Auth.Enabled)
+	dataAPI := data.NewAPI(regStorage, dataStorage, streamHub, deadLetters, conf.Data.AutoRegistration)
 	//aggrAPI := aggregation.NewAPI(regStorage, aggrStorage)
+	var backupAPI *data.BackupAPI
+	if snapshotStorage != nil {
+		// the credentials of the sources are only included when the backups are protected
+		backupAPI = data.NewBackupAPI(regStorage, snapshotStorage, conf.Auth.Enabled)
+	}
+
+	// Start evaluating the derived data streams
+	err = rollupStorage.Start(regStorage)
+	if err != nil {
+		log.Fatalf("Error starting rollups: %s", err)
+	}
+
+	// Store the submissions which were logged but not stored before the last shutdown
+	if walStorage != nil {
+		err = walStorage.Replay(regStorage)
+		if err != nil {
+			log.Fatalf("Error replaying WAL: %s", err)
+		}
+	}
 
 	// Start MQTT connector
-	// TODO: disconnect on shutdown
 	err = mqttConn.Start(regStorage)
 	if err != nil {
 		log.Fatalf("Error starting MQTT Connector: %s", err)
 	}
 
+	// Forward the selected data streams to the remote Historical Datastore
+	var replicator *data.Replicator
+	var holds []data.RetentionHold
+	if conf.Replication.Enabled {
+		replicator, err = data.NewReplicator(dataStorage, conf.Replication, filepath.Join(conf.Data.Dir, "replication"), nil)
+		if err != nil {
+			log.Fatalf("Error creating replicator: %s", err)
+		}
+		replicator.Start(regStorage)
+		// the data which is not forwarded yet is kept
+		holds = append(holds, replicator)
+	}
+
+	// Start purging the data that exceeds the retention periods
+	// The purges bypass the rollups, as derived data streams are purged by their own retention
+	retention := data.NewRetentionManager(streamHub, holds...)
+	retention.Start(regStorage)
+
 	// Register in the LinkSmart Service Catalog
+	var unregisterService func() error
 	if conf.ServiceCatalog != nil {
-		unregisterService, err := registerInServiceCatalog(conf)
+		unregisterService, err = registerInServiceCatalog(conf)
 		if err != nil {
 			log.Fatalf("Error registering service: %s", err)
 		}
-		// Unregister from the Service Catalog
-		defer unregisterService()
 	}
 
+	registerMetrics(conf, regStorage, mqttConn, batchStorage)
+
 	// Start servers
-	go startHTTPServer(conf, regAPI, dataAPI)
+	server := startHTTPServer(conf, regAPI, dataAPI, mqttConn, backupAPI)
+	// End the live streams, which would otherwise keep the server from shutting down
+	server.RegisterOnShutdown(streamHub.Close)
 
-	// Ctrl+C / Kill handling
+	// Ctrl+C / SIGTERM handling
 	handler := make(chan os.Signal, 1)
-	signal.Notify(handler, os.Interrupt, os.Kill)
+	signal.Notify(handler, os.Interrupt, syscall.SIGTERM)
 
 	<-handler
 	log.Println("Shutting down...")
 
-	// Close the DataStreamList Storage
-	if closeReg != nil {
-		err := closeReg()
-		if err != nil {
-			log.Println(err.Error())
+	timeout := time.Duration(conf.ShutdownTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		// Stop accepting requests and wait for the ongoing ones, e.g. submissions, to finish
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down HTTP server: %s", err)
+		}
+		// Unsubscribe and disconnect from the brokers
+		mqttConn.Stop(mqttQuiesce)
+		retention.Stop()
+		if replicator != nil {
+			if err := replicator.Stop(); err != nil {
+				log.Printf("Error stopping replication: %s", err)
+			}
+		}
+		// Write the queued submissions
+		if batchStorage != nil {
+			batchStorage.Close()
+		}
+		// Close the log, once the queued submissions are committed
+		if wal != nil {
+			if err := wal.Close(); err != nil {
+				log.Printf("Error closing WAL: %s", err)
+			}
+		}
+
+		// Unregister from the Service Catalog
+		if unregisterService != nil {
+			if err := unregisterService(); err != nil {
+				log.Println(err.Error())
+			}
+		}
+
+		// Close the storages
+		if closeData != nil {
+			if err := closeData(); err != nil {
+				log.Printf("Error closing data storage: %s", err)
+			}
 		}
+		if err := closeDeadLetters(); err != nil {
+			log.Printf("Error closing dead letter store: %s", err)
+		}
+		if closeReg != nil {
+			if err := closeReg(); err != nil {
+				log.Println(err.Error())
+			}
+		}
+	}()
+
+	select {
+	case <-stopped:
+		log.Println("Stopped.")
+	case <-handler:
+		log.Fatalln("Interrupted the shutdown.")
+	case <-time.After(timeout):
+		log.Fatalf("Shutdown did not complete within %s", timeout)
+	}
+}
+
+// newRegistryStorage creates the configured registry storage, notifying the given listeners of the changes
+func newRegistryStorage(conf common.RegConf, listeners ...registry.EventListener) (registry.Storage, func() error, error) {
+	switch conf.Backend.Type {
+	case registry.LEVELDB:
+		return registry.NewLevelDBStorage(conf, nil, listeners...)
+	default:
+		return registry.NewMemoryStorage(conf, listeners...), nil, nil
+	}
+}
+
+// restoreBackup restores the registry and data from the archive, without starting any of the services
+func restoreBackup(conf *common.Config, dataStorage data.Storage, archive string) error {
+	if conf.Reg.Backend.Type == registry.MEMORY {
+		return fmt.Errorf("the registry backend %s is not persistent", registry.MEMORY)
+	}
+	regStorage, closeReg, err := newRegistryStorage(conf.Reg, dataStorage)
+	if err != nil {
+		return err
 	}
+	defer closeReg()
 
-	log.Println("Stopped.")
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	log.Printf("Restoring backup from %s", archive)
+	return data.RestoreBackup(f, regStorage, dataStorage)
 }
 
-func startHTTPServer(conf *common.Config, reg *registry.API, data *data.API) {
+// startHTTPServer sets up the routes and serves the APIs in the background
+func startHTTPServer(conf *common.Config, reg *registry.API, data *data.API, mqtt *data.MQTTConnector, backup *data.BackupAPI) *http.Server {
 	router := newRouter()
 	// api root
 	router.handle(http.MethodGet, "/", indexHandler)
 	// registry api
 	router.handle(http.MethodGet, "/registry", reg.Index)
 	router.handle(http.MethodPost, "/registry", reg.Create)
+	router.handle(http.MethodGet, "/registry/export", reg.Export)
+	router.handle(http.MethodPost, "/registry/import", reg.Import)
 	router.handle(http.MethodGet, "/registry/{type}/{path}/{op}/{value:.*}", reg.Filter) //TODO: Re-ordered this to match filtering.
 	//Filter should go for separate endpoint?
 	router.handle(http.MethodGet, "/registry/{id:.+}", reg.Retrieve)
@@ -161,8 +332,29 @@ func startHTTPServer(conf *common.Config, reg *registry.API, data *data.API) {
 
 	// data api
 	router.handle(http.MethodPost, "/data", data.SubmitWithoutID)
+	router.handle(http.MethodPost, "/data/import", data.Import)
 	router.handle(http.MethodPost, "/data/{id:.+}", data.Submit)
+	router.handle(http.MethodGet, "/data/{id:.+}/stream", data.Stream)
+	router.handle(http.MethodGet, "/data/{id:.+}/export", data.Export)
 	router.handle(http.MethodGet, "/data/{id:.+}", data.Query)
+	router.handle(http.MethodDelete, "/data/{id:.+}", data.Delete)
+
+	// dead letters
+	router.handle(http.MethodGet, "/deadletter", data.DeadLetters)
+	router.handle(http.MethodPost, "/deadletter/replay", data.ReplayDeadLetters)
+	router.handle(http.MethodDelete, "/deadletter/{id}", data.DeleteDeadLetter)
+
+	// mqtt status
+	router.handle(http.MethodGet, "/mqtt", mqtt.StatusHandler)
+
+	// metrics
+	router.handle(http.MethodGet, "/metrics", metrics.Handler)
+
+	// administration
+	if backup != nil {
+		router.handle(http.MethodGet, "/admin/backup", backup.Backup)
+	}
+
 	// Append auth handler if enabled
 	if conf.Auth.Enabled {
 		// Setup ticket validator
@@ -171,13 +363,38 @@ func startHTTPServer(conf *common.Config, reg *registry.API, data *data.API) {
 			log.Fatalf(err.Error())
 		}
 
-		router.appendChain(v.Handler)
+		if conf.Auth.ExemptMetrics {
+			router.appendChain(exempt("/metrics", v.Handler))
+		} else {
+			router.appendChain(v.Handler)
+		}
 	}
 
 	// start http server
-	log.Printf("Listening on %s:%d", conf.HTTP.BindAddr, conf.HTTP.BindPort)
-	err := http.ListenAndServe(fmt.Sprintf("%s:%d", conf.HTTP.BindAddr, conf.HTTP.BindPort), router.chained())
-	if err != nil {
-		log.Fatalln(err)
+	server := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", conf.HTTP.BindAddr, conf.HTTP.BindPort),
+		Handler: router.chained(),
 	}
+	if conf.HTTP.TLS != nil {
+		reloader, err := newTLSReloader(*conf.HTTP.TLS)
+		if err != nil {
+			log.Fatalf("Error loading HTTP TLS configuration: %s", err)
+		}
+		server.TLSConfig = reloader.serverConfig()
+		go reloader.reloadOnHangup()
+	}
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			log.Printf("Listening on %s (HTTPS)", server.Addr)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Listening on %s", server.Addr)
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
+	return server
 }
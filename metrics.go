@@ -0,0 +1,65 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/data"
+	"github.com/linksmart/historical-datastore/metrics"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// registerMetrics registers the gauges which are collected from the components on every scrape
+func registerMetrics(conf *common.Config, regStorage registry.Storage, mqttConn *data.MQTTConnector, batchStorage *data.BatchStorage) {
+	metrics.NewGaugeFunc("hds_mqtt_connected",
+		"Connection state of the MQTT clients (1 for connected).", []string{"url", "client_id"},
+		func() []metrics.Sample {
+			var samples []metrics.Sample
+			for _, broker := range mqttConn.Brokers() {
+				connected := 0.0
+				if broker.Connected {
+					connected = 1
+				}
+				samples = append(samples, metrics.Sample{LabelValues: []string{broker.URL, broker.ClientID}, Value: connected})
+			}
+			return samples
+		})
+
+	metrics.NewGaugeFunc("hds_registry_streams",
+		"Number of data streams in the registry.", nil,
+		func() []metrics.Sample {
+			_, total, err := regStorage.GetMany(1, 1)
+			if err != nil {
+				log.Printf("Metrics: Error getting registry size: %s", err)
+				return nil
+			}
+			return []metrics.Sample{{Value: float64(total)}}
+		})
+
+	if batchStorage != nil {
+		metrics.NewGaugeFunc("hds_ingest_queue_records",
+			"Number of records in the ingest queue.", nil,
+			func() []metrics.Sample {
+				return []metrics.Sample{{Value: float64(batchStorage.Queued())}}
+			})
+	}
+
+	if !strings.EqualFold(conf.Data.Backend.Type, data.SENMLSTORE) {
+		// the other backends are not stored in a local file
+		return
+	}
+	metrics.NewGaugeFunc("hds_storage_file_bytes",
+		"Size of the data storage file.", nil,
+		func() []metrics.Sample {
+			info, err := os.Stat(conf.Data.Backend.DSN)
+			if err != nil {
+				log.Printf("Metrics: Error getting storage size: %s", err)
+				return nil
+			}
+			return []metrics.Sample{{Value: float64(info.Size())}}
+		})
+}
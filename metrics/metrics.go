@@ -0,0 +1,289 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+// Package metrics collects the metrics of the service and exposes them in the Prometheus text format
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the media type of the Prometheus text format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are the default upper bounds of histogram buckets, in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector writes the samples of a metric family
+type collector interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+var (
+	registryLock sync.Mutex
+	collectors   []collector
+)
+
+// register adds the collector, replacing any other with the same name
+func register(c collector) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	for i := range collectors {
+		if collectors[i].name() == c.name() {
+			collectors[i] = c
+			return
+		}
+	}
+	collectors = append(collectors, c)
+}
+
+// Handler writes all registered metrics
+func Handler(w http.ResponseWriter, r *http.Request) {
+	registryLock.Lock()
+	registered := append([]collector{}, collectors...)
+	registryLock.Unlock()
+
+	w.Header().Set("Content-Type", ContentType)
+	bw := bufio.NewWriter(w)
+	for _, c := range registered {
+		c.write(bw)
+	}
+	bw.Flush()
+}
+
+// Sample is a value of a metric with the given label values
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	sync.Mutex
+	desc   desc
+	values map[string]*Sample
+}
+
+// NewCounterVec registers a counter with the given labels
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name, help, "counter", labels},
+		values: make(map[string]*Sample),
+	}
+	register(c)
+	return c
+}
+
+// Add adds the value to the counter with the given label values
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	c.Lock()
+	defer c.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	s, found := c.values[key]
+	if !found {
+		s = &Sample{LabelValues: labelValues}
+		c.values[key] = s
+	}
+	s.Value += v
+}
+
+// Inc increments the counter with the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) name() string {
+	return c.desc.name
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.Lock()
+	samples := make([]Sample, 0, len(c.values))
+	for _, s := range c.values {
+		samples = append(samples, *s)
+	}
+	c.Unlock()
+	c.desc.writeSamples(w, samples)
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	sync.Mutex
+	desc    desc
+	buckets []float64
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// NewHistogramVec registers a histogram with the given bucket bounds and labels
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{name, help, "histogram", labels},
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+	register(h)
+	return h
+}
+
+// Observe adds the value to the histogram with the given label values
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	hist, found := h.values[key]
+	if !found {
+		hist = &histogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *HistogramVec) name() string {
+	return h.desc.name
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	hists := make([]*histogram, 0, len(h.values))
+	for _, hist := range h.values {
+		hists = append(hists, hist)
+	}
+	sort.Slice(hists, func(i, j int) bool {
+		return lessLabels(hists[i].labelValues, hists[j].labelValues)
+	})
+
+	h.desc.writeHeader(w)
+	bucketDesc := desc{name: h.desc.name + "_bucket", labels: withLabel(h.desc.labels, "le")}
+	sumDesc := desc{name: h.desc.name + "_sum", labels: h.desc.labels}
+	countDesc := desc{name: h.desc.name + "_count", labels: h.desc.labels}
+	for _, hist := range hists {
+		// buckets in the order of their bounds
+		buckets := make([]Sample, 0, len(h.buckets)+1)
+		for i, bound := range h.buckets {
+			buckets = append(buckets, Sample{withLabel(hist.labelValues, formatFloat(bound)), float64(hist.counts[i])})
+		}
+		buckets = append(buckets, Sample{withLabel(hist.labelValues, "+Inf"), float64(hist.count)})
+		bucketDesc.writeValues(w, buckets)
+		sumDesc.writeValues(w, []Sample{{hist.labelValues, hist.sum}})
+		countDesc.writeValues(w, []Sample{{hist.labelValues, float64(hist.count)}})
+	}
+}
+
+// withLabel returns a copy of the labels with an additional one
+func withLabel(labels []string, label string) []string {
+	return append(append(make([]string, 0, len(labels)+1), labels...), label)
+}
+
+// GaugeFunc is a gauge which is collected on every scrape
+type GaugeFunc struct {
+	desc    desc
+	collect func() []Sample
+}
+
+// NewGaugeFunc registers a gauge which samples are returned by collect
+func NewGaugeFunc(name, help string, labels []string, collect func() []Sample) *GaugeFunc {
+	g := &GaugeFunc{
+		desc:    desc{name, help, "gauge", labels},
+		collect: collect,
+	}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) name() string {
+	return g.desc.name
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.desc.writeSamples(w, g.collect())
+}
+
+// desc describes a metric family
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+// writeSamples writes the header and the samples sorted by their label values
+func (d desc) writeSamples(w *bufio.Writer, samples []Sample) {
+	sortSamples(samples)
+	d.writeHeader(w)
+	d.writeValues(w, samples)
+}
+
+func sortSamples(samples []Sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return lessLabels(samples[i].LabelValues, samples[j].LabelValues)
+	})
+}
+
+func lessLabels(a, b []string) bool {
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] != b[k] {
+			return a[k] < b[k]
+		}
+	}
+	return len(a) < len(b)
+}
+
+func (d desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+func (d desc) writeValues(w *bufio.Writer, samples []Sample) {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for _, s := range samples {
+		w.WriteString(d.name)
+		if len(d.labels) > 0 {
+			w.WriteByte('{')
+			for i, label := range d.labels {
+				if i > 0 {
+					w.WriteByte(',')
+				}
+				value := ""
+				if i < len(s.LabelValues) {
+					value = s.LabelValues[i]
+				}
+				fmt.Fprintf(w, `%s="%s"`, label, escape.Replace(value))
+			}
+			w.WriteByte('}')
+		}
+		fmt.Fprintf(w, " %s\n", formatFloat(s.Value))
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
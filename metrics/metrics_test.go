@@ -0,0 +1,48 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	counter := NewCounterVec("test_requests_total", "Requests.", "code")
+	counter.Inc("500")
+	counter.Add(2, "200")
+	histogram := NewHistogramVec("test_duration_seconds", "Durations.", []float64{0.1, 1}, "route")
+	histogram.Observe(0.5, "/data")
+	histogram.Observe(2, "/data")
+	NewGaugeFunc("test_connected", "Connected.", nil, func() []Sample {
+		return []Sample{{Value: 1}}
+	})
+
+	w := httptest.NewRecorder()
+	Handler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Header().Get("Content-Type") != ContentType {
+		t.Fatalf("Unexpected content type: %s", w.Header().Get("Content-Type"))
+	}
+	b, _ := ioutil.ReadAll(w.Body)
+
+	expected := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 2
+test_requests_total{code="500"} 1
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/data",le="0.1"} 0
+test_duration_seconds_bucket{route="/data",le="1"} 1
+test_duration_seconds_bucket{route="/data",le="+Inf"} 2
+test_duration_seconds_sum{route="/data"} 2.5
+test_duration_seconds_count{route="/data"} 2
+# HELP test_connected Connected.
+# TYPE test_connected gauge
+test_connected 1
+`
+	if !strings.Contains(string(b), expected) {
+		t.Fatalf("Unexpected metrics:\n%s", b)
+	}
+}
@@ -20,7 +20,7 @@ type DataStream struct {
 	Name string `json:"name"`
 	//Source is an Data Sources
 	Source Source `json:"source,omitempty"`
-	//Function to be performed on the data sources
+	//Function to be performed on the data of a Series source (e.g. mean(15m), max(1h) or diff)
 	Function string `json:"function,omitempty"`
 	//Type of the data (eg: string, float, bool, data)
 	Type string `json:"dataType"`
@@ -33,7 +33,7 @@ type DataStream struct {
 		//minimum requirement for the retention
 		Min string `json:"min,omitempty"`
 		//maximum requirement for the retention. This is useful for enforcing the data privacy
-		Max string `json:"max",omitempty`
+		Max string `json:"max,omitempty"`
 	} `json:"retain,omitempty"`
 	// DynamicChild TODO
 	keepSensitiveInfo bool
@@ -60,13 +60,57 @@ type MQTTSource struct {
 	CaFile   string `json:"caFile,omitempty"`
 	CertFile string `json:"certFile,omitempty"`
 	KeyFile  string `json:"keyFile,omitempty"`
+	// ClientID of the connection, which is shared by the sources with the same broker and client ID
+	ClientID string `json:"clientID,omitempty"`
+	// CleanSession set to false keeps the session, including the messages with QoS>0, across reconnections (default true)
+	CleanSession *bool `json:"cleanSession,omitempty"`
+	// KeepAlive interval in seconds (default 30)
+	KeepAlive int `json:"keepAlive,omitempty"`
 	//Avoid marshalling sensitive informations
 
 }
 
 type SeriesSource struct {
 	//name of the series
-	URL string `json:name`
+	URL string `json:"name"`
+}
+
+// legacySeriesKey is the key of the series name in the sources which are stored by earlier versions
+const legacySeriesKey = "URL"
+
+// UnmarshalJSON decodes the source, accepting the name of a series source also under the legacy key
+func (s *Source) UnmarshalJSON(b []byte) error {
+	type Alias Source
+	var alias Alias
+	err := json.Unmarshal(b, &alias)
+	if err != nil {
+		return err
+	}
+	*s = Source(alias)
+	if s.SrcType != SeriesType || s.SeriesSource != nil {
+		return nil
+	}
+
+	var keys map[string]json.RawMessage
+	err = json.Unmarshal(b, &keys)
+	if err != nil {
+		return err
+	}
+	raw, found := keys[legacySeriesKey]
+	if !found {
+		return nil
+	}
+	var name string
+	err = json.Unmarshal(raw, &name)
+	if err != nil {
+		return err
+	}
+	s.SeriesSource = &SeriesSource{URL: name}
+	// the legacy key is also matched case-insensitively to the broker URL
+	if s.MQTTSource != nil && *s.MQTTSource == (MQTTSource{BrokerURL: name}) {
+		s.MQTTSource = nil
+	}
+	return nil
 }
 
 func (ds DataStream) copy() DataStream {
@@ -79,8 +123,10 @@ func (ds DataStream) copy() DataStream {
 // MarshalJSON masks sensitive information when using the default marshaller
 func (ds DataStream) MarshalJSON() ([]byte, error) {
 	if !ds.keepSensitiveInfo {
-		if ds.Source.SrcType == MqttType {
-			// mask MQTT credentials and key paths
+		if ds.Source.SrcType == MqttType && ds.Source.MQTTSource != nil {
+			// mask MQTT credentials and key paths on a copy, as the source is shared with the stored data stream
+			mqttSource := *ds.Source.MQTTSource
+			ds.Source.MQTTSource = &mqttSource
 			if ds.Source.Username != "" {
 				ds.Source.Username = "*****"
 			}
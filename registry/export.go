@@ -0,0 +1,139 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Modes of importing data streams which already exist in the registry
+const (
+	ImportSkip      = "skip"
+	ImportOverwrite = "overwrite"
+	ImportFail      = "fail"
+)
+
+// ImportResult describes the names of the imported data streams by the outcome, and the errors of the failed ones
+type ImportResult struct {
+	Created []string          `json:"created"`
+	Updated []string          `json:"updated"`
+	Skipped []string          `json:"skipped"`
+	Failed  map[string]string `json:"failed"`
+}
+
+// Export returns all data streams in JSON, optionally including the sensitive information
+func Export(storage Storage, sensitive bool) ([]byte, error) {
+	streams := []json.RawMessage{}
+	perPage := 100
+	for page := 1; ; page++ {
+		dataStreams, total, err := storage.GetMany(page, perPage)
+		if err != nil {
+			return nil, fmt.Errorf("error getting data streams: %v", err)
+		}
+		for _, ds := range dataStreams {
+			var b []byte
+			if sensitive {
+				b, err = ds.MarshalSensitiveJSON()
+			} else {
+				b, err = json.Marshal(&ds)
+			}
+			if err != nil {
+				return nil, err
+			}
+			streams = append(streams, b)
+		}
+		if page*perPage >= total {
+			break
+		}
+	}
+	return json.Marshal(streams)
+}
+
+// Import adds the data streams to the storage, firing the events of the storage as usual
+// Existing data streams are skipped, overwritten, or fail the whole import with a conflict error, depending on the mode.
+// The derived data streams are added after their sources.
+func Import(storage Storage, dataStreams []DataStream, mode string) (*ImportResult, error) {
+	switch mode {
+	case ImportSkip, ImportOverwrite, ImportFail:
+	default:
+		return nil, fmt.Errorf("invalid import mode: %s", mode)
+	}
+
+	existing := make(map[string]bool)
+	var conflicts []string
+	for _, ds := range dataStreams {
+		_, err := storage.Get(ds.Name)
+		if err == nil {
+			existing[ds.Name] = true
+			conflicts = append(conflicts, ds.Name)
+		} else if !ErrType(err, ErrNotFound) {
+			return nil, fmt.Errorf("error getting data stream %s: %v", ds.Name, err)
+		}
+	}
+	if mode == ImportFail && len(conflicts) > 0 {
+		return nil, fmt.Errorf("%s: data streams exist already: %s", ErrConflict, strings.Join(conflicts, ", "))
+	}
+
+	result := &ImportResult{
+		Created: []string{},
+		Updated: []string{},
+		Skipped: []string{},
+		Failed:  make(map[string]string),
+	}
+	for _, ds := range sourcesFirst(dataStreams) {
+		switch {
+		case !existing[ds.Name]:
+			_, err := storage.Add(ds)
+			if err != nil {
+				result.Failed[ds.Name] = err.Error()
+				continue
+			}
+			result.Created = append(result.Created, ds.Name)
+		case mode == ImportOverwrite:
+			_, err := storage.Update(ds.Name, ds)
+			if err != nil {
+				result.Failed[ds.Name] = err.Error()
+				continue
+			}
+			result.Updated = append(result.Updated, ds.Name)
+		default:
+			result.Skipped = append(result.Skipped, ds.Name)
+		}
+	}
+	return result, nil
+}
+
+// sourcesFirst orders the data streams such that the series sources precede the derived data streams
+func sourcesFirst(dataStreams []DataStream) []DataStream {
+	pending := make(map[string]bool)
+	for _, ds := range dataStreams {
+		pending[ds.Name] = true
+	}
+	ordered := make([]DataStream, 0, len(dataStreams))
+	for len(ordered) < len(dataStreams) {
+		progress := false
+		for _, ds := range dataStreams {
+			if !pending[ds.Name] {
+				continue
+			}
+			if series := ds.Source.SeriesSource; series != nil && pending[series.URL] && series.URL != ds.Name {
+				continue
+			}
+			ordered = append(ordered, ds)
+			delete(pending, ds.Name)
+			progress = true
+		}
+		if !progress {
+			// circular references are left to the validation
+			for _, ds := range dataStreams {
+				if pending[ds.Name] {
+					ordered = append(ordered, ds)
+					delete(pending, ds.Name)
+				}
+			}
+		}
+	}
+	return ordered
+}
@@ -0,0 +1,96 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package registry
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/linksmart/historical-datastore/common"
+)
+
+// createdListener records the names of the created data streams
+type createdListener []string
+
+func (l *createdListener) CreateHandler(ds DataStream) error {
+	*l = append(*l, ds.Name)
+	return nil
+}
+func (l *createdListener) UpdateHandler(oldDS DataStream, newDS DataStream) error { return nil }
+func (l *createdListener) DeleteHandler(oldDS DataStream) error                   { return nil }
+
+func TestExportImport(t *testing.T) {
+	source := NewMemoryStorage(common.RegConf{})
+	mqtt := DataStream{Name: "export/mqtt", Type: common.FLOAT}
+	mqtt.Source.SrcType = MqttType
+	mqtt.Source.MQTTSource = &MQTTSource{BrokerURL: "tcp://localhost:1883", Topic: "sensors", Password: "secret"}
+	derived := DataStream{Name: "export/mean", Type: common.FLOAT, Function: "mean(1h)"}
+	derived.Source.SrcType = SeriesType
+	derived.Source.SeriesSource = &SeriesSource{URL: mqtt.Name}
+	for _, ds := range []DataStream{mqtt, derived} {
+		if _, err := source.Add(ds); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	masked, err := Export(source, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(masked), "secret") {
+		t.Fatalf("Expected the password to be masked: %s", masked)
+	}
+	b, err := Export(source, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exported []DataStream
+	if err := json.Unmarshal(b, &exported); err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 2 {
+		t.Fatalf("Expected 2 exported data streams, got %d", len(exported))
+	}
+
+	// the derived data stream is imported after its source
+	if exported[0].Name != derived.Name {
+		exported[0], exported[1] = exported[1], exported[0]
+	}
+	var created createdListener
+	target := NewMemoryStorage(common.RegConf{}, &created)
+	result, err := Import(target, exported, ImportFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Created) != 2 || len(created) != 2 || created[0] != mqtt.Name {
+		t.Fatalf("Unexpected import: %+v, created events: %v", result, created)
+	}
+	ds, err := target.Get(mqtt.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.Source.MQTTSource.Password != "secret" {
+		t.Errorf("Expected the password to be imported")
+	}
+
+	// conflicts
+	if _, err := Import(target, exported, ImportFail); err == nil || !ErrType(err, ErrConflict) {
+		t.Errorf("Expected a conflict error, got %v", err)
+	}
+	result, err = Import(target, exported, ImportSkip)
+	if err != nil || len(result.Skipped) != 2 || len(result.Created) != 0 {
+		t.Errorf("Expected the data streams to be skipped, got %+v: %v", result, err)
+	}
+	exported[1].Meta = map[string]interface{}{"updated": true}
+	if exported[1].Name != mqtt.Name {
+		t.Fatalf("Unexpected order of the exported data streams")
+	}
+	result, err = Import(target, exported, ImportOverwrite)
+	if err != nil || len(result.Updated) != 2 {
+		t.Fatalf("Expected the data streams to be updated, got %+v: %v", result, err)
+	}
+	if ds, _ := target.Get(mqtt.Name); ds.Meta["updated"] != true {
+		t.Errorf("Expected the data stream to be overwritten, got %+v", ds)
+	}
+}
@@ -20,6 +20,8 @@ const (
 	FTypeMany = "many"
 
 	MaxPerPage = 100
+
+	ParamMode = "mode"
 )
 
 var (
@@ -34,12 +36,16 @@ func ErrType(err, e error) bool {
 // RESTful HTTP API
 type API struct {
 	storage Storage
+	// exportSensitive includes the sensitive information in the exports
+	exportSensitive bool
 }
 
 // Returns the configured DataStreamList API
-func NewAPI(storage Storage) *API {
+// The sensitive information should only be exported when the access is restricted to authorised users
+func NewAPI(storage Storage, exportSensitive bool) *API {
 	return &API{
 		storage,
+		exportSensitive,
 	}
 }
 
@@ -211,6 +217,62 @@ func (api *API) Delete(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// Export is a handler for exporting all data streams
+func (api *API) Export(w http.ResponseWriter, r *http.Request) {
+	b, err := Export(api.storage, api.exportSensitive)
+	if err != nil {
+		common.ErrorResponse(http.StatusInternalServerError, err.Error(), w)
+		return
+	}
+
+	w.Header().Set("Content-Type", common.DefaultMIMEType)
+	w.Header().Set("Content-Disposition", `attachment; filename="registry.json"`)
+	w.Write(b)
+}
+
+// Import is a handler for importing data streams, such as the ones exported from another instance
+// Expected parameters: mode (skip, overwrite or fail on existing data streams, default fail)
+func (api *API) Import(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	mode := r.Form.Get(ParamMode)
+	switch mode {
+	case "":
+		mode = ImportFail
+	case ImportSkip, ImportOverwrite, ImportFail:
+	default:
+		common.ErrorResponse(http.StatusBadRequest, "Invalid import mode: "+mode, w)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		common.ErrorResponse(http.StatusBadRequest, err.Error(), w)
+		return
+	}
+
+	var dataStreams []DataStream
+	err = json.Unmarshal(body, &dataStreams)
+	if err != nil {
+		common.ErrorResponse(http.StatusBadRequest, "Error processing input: "+err.Error(), w)
+		return
+	}
+
+	result, err := Import(api.storage, dataStreams, mode)
+	if err != nil {
+		if ErrType(err, ErrConflict) {
+			common.ErrorResponse(http.StatusConflict, err.Error(), w)
+		} else {
+			common.ErrorResponse(http.StatusInternalServerError, "Error importing data streams: "+err.Error(), w)
+		}
+		return
+	}
+
+	b, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", common.DefaultMIMEType)
+	w.Write(b)
+}
+
 // Filter is a handler for registry filtering API
 // Expected parameters: path, type, op, value
 func (api *API) Filter(w http.ResponseWriter, r *http.Request) {
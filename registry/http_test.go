@@ -32,7 +32,7 @@ func setupRouter(regAPI *API) *mux.Router {
 
 func setupAPI() (*API, Storage) {
 	regStorage := setupMemStorage()
-	regAPI := NewAPI(regStorage)
+	regAPI := NewAPI(regStorage, false)
 
 	return regAPI, regStorage
 }
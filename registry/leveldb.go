@@ -19,10 +19,12 @@ import (
 
 // LevelDB storage
 type LevelDBStorage struct {
-	conf         common.RegConf
-	db           *leveldb.DB
-	event        eventHandler
-	wg           sync.WaitGroup
+	conf  common.RegConf
+	db    *leveldb.DB
+	event eventHandler
+	wg    sync.WaitGroup
+	// mutex serializes the changes, which are checked and notified before being written
+	mutex        sync.Mutex
 	lastModified time.Time
 }
 
@@ -85,18 +87,21 @@ func (s *LevelDBStorage) Add(ds DataStream) (*DataStream, error) {
 		return nil, err
 	}
 
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	if has, _ := s.db.Has([]byte(ds.Name), nil); has {
 		return nil, fmt.Errorf("%s: Resource name not unique: %s", ErrConflict, ds.Name)
 	}
 
-	// Add the new DataSource to database
-	err = s.db.Put([]byte(ds.Name), dsBytes, nil)
+	// Send a create event
+	err = s.event.created(&ds)
 	if err != nil {
 		return nil, err
 	}
 
-	// Send a create event
-	err = s.event.created(&ds)
+	// Add the new DataSource to database
+	err = s.db.Put([]byte(ds.Name), dsBytes, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -106,6 +111,8 @@ func (s *LevelDBStorage) Add(ds DataStream) (*DataStream, error) {
 }
 
 func (s *LevelDBStorage) Update(name string, ds DataStream) (*DataStream, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
 	oldDS, err := s.Get(name) // for comparison
 	if err == leveldb.ErrNotFound {
@@ -119,7 +126,7 @@ func (s *LevelDBStorage) Update(name string, ds DataStream) (*DataStream, error)
 		return nil, fmt.Errorf("%s: %s", ErrConflict, err)
 	}
 
-	tempDS := oldDS
+	tempDS := *oldDS
 
 	// Modify writable elements
 	tempDS.Function = ds.Function
@@ -128,7 +135,7 @@ func (s *LevelDBStorage) Update(name string, ds DataStream) (*DataStream, error)
 	tempDS.Meta = ds.Meta
 
 	// Send an update event
-	err = s.event.updated(oldDS, tempDS)
+	err = s.event.updated(oldDS, &tempDS)
 	if err != nil {
 		return nil, err
 	}
@@ -146,10 +153,12 @@ func (s *LevelDBStorage) Update(name string, ds DataStream) (*DataStream, error)
 	}
 
 	s.lastModified = time.Now()
-	return tempDS, nil
+	return &tempDS, nil
 }
 
 func (s *LevelDBStorage) Delete(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
 	ds, err := s.Get(name) // for notification
 	if err != nil {
@@ -221,7 +230,7 @@ func (s *LevelDBStorage) GetMany(page, perPage int) ([]DataStream, int, error) {
 
 	// page/registry is empty
 	if limit == 0 {
-		return []DataStream{}, 0, nil
+		return []DataStream{}, total, nil
 	}
 
 	datastreams := make([]DataStream, 0, limit)
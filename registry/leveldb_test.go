@@ -263,3 +263,30 @@ func TestLevelDBPathFilter(t *testing.T) {
 		t.Fatalf("Returned %d matches instead of %d", total, expected)
 	}
 }
+
+func TestLevelDBLegacySeriesSource(t *testing.T) {
+	storage, dbName, closeDB, err := setupLevelDB()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer clean(dbName)
+	defer closeDB()
+
+	// stored by a version which kept the name of the series under the URL key
+	legacy := `{"name":"legacy/mean","source":{"type":"Series","URL":"legacy/raw"},"function":"mean(1h)","dataType":"float"}`
+	err = storage.(*LevelDBStorage).db.Put([]byte("legacy/mean"), []byte(legacy), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ds, err := storage.Get("legacy/mean")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ds.Source.SeriesSource == nil || ds.Source.SeriesSource.URL != "legacy/raw" {
+		t.Fatalf("Expected the series source legacy/raw, got %+v", ds.Source)
+	}
+	if ds.Source.MQTTSource != nil {
+		t.Fatalf("Expected no MQTT source, got %+v", ds.Source.MQTTSource)
+	}
+}
@@ -40,8 +40,12 @@ func (ms *MemoryStorage) Add(ds DataStream) (*DataStream, error) {
 	if err != nil {
 		return nil, fmt.Errorf("%s: %s", ErrConflict, err)
 	}
-	ms.mutex.RLock()
-	defer ms.mutex.RUnlock()
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, exists := ms.resources[ds.Name]; exists {
+		return nil, fmt.Errorf("%s: Resource name not unique: %s", ErrConflict, ds.Name)
+	}
 
 	// Send a create event
 	err = ms.event.created(&ds)
@@ -49,10 +53,6 @@ func (ms *MemoryStorage) Add(ds DataStream) (*DataStream, error) {
 		return nil, err
 	}
 
-	if _, exists := ms.resources[ds.Name]; exists {
-		return nil, fmt.Errorf("%s: Resource name not unique: %s", ErrConflict, ds.Name)
-	}
-
 	// Add the new DataSource to the map
 	ms.data[ds.Name] = &ds
 	// Add secondary index
@@ -214,6 +214,9 @@ func (ms *MemoryStorage) Filter(path, op, value string, page, perPage int) ([]Da
 		}
 	}
 
+	// Sort the matches for consistent pages
+	sort.Strings(matchedIDs)
+
 	keys, err := utils.GetPageOfSlice(matchedIDs, page, perPage, MaxPerPage)
 	if err != nil {
 		return []DataStream{}, 0, err
@@ -41,7 +41,7 @@ func generateDummyData(quantity int, storage Storage) ([]string, error) {
 }
 
 func setupMemStorage() Storage {
-	return NewMemoryStorage(common.RegConf{})
+	return NewMemoryStorage(common.RegConf{RetentionPeriods: []string{"1h", "20w"}})
 }
 
 func TestMemstorageAdd(t *testing.T) {
@@ -98,6 +98,37 @@ func TestMemstorageUpdate(t *testing.T) {
 	}
 }
 
+func TestMemstorageUpdateRetention(t *testing.T) {
+	storage := setupMemStorage()
+
+	IDs, err := generateDummyData(1, storage)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ds, err := storage.Get(IDs[0])
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err.Error())
+	}
+
+	for _, retention := range []struct{ min, max string }{
+		{"", "2h"},   // not configured
+		{"1d", "1h"}, // max violates min
+		{"1x", ""},   // invalid period
+	} {
+		ds.Retention.Min, ds.Retention.Max = retention.min, retention.max
+		_, err = storage.Update(ds.Name, *ds)
+		if err == nil {
+			t.Errorf("Expected update with retention %+v to fail", retention)
+		}
+	}
+
+	ds.Retention.Min, ds.Retention.Max = "30m", "1h"
+	_, err = storage.Update(ds.Name, *ds)
+	if err != nil {
+		t.Errorf("Unexpected error on update: %v", err.Error())
+	}
+}
+
 func TestMemstorageDelete(t *testing.T) {
 	storage := setupMemStorage()
 
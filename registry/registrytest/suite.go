@@ -0,0 +1,416 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+// Package registrytest provides the conformance tests for implementations of registry.Storage
+package registrytest
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// StorageFactory returns a new and empty storage, which notifies the listeners in the given order
+// The storage should be closed and removed with the cleanup functions of the test.
+type StorageFactory func(t *testing.T, listeners ...registry.EventListener) registry.Storage
+
+// RunStorageSuite runs the tests which every registry storage must pass
+// Every test starts with a new storage created by the factory.
+func RunStorageSuite(t *testing.T, factory StorageFactory) {
+	t.Run("crud", func(t *testing.T) { testCRUD(t, factory) })
+	t.Run("validation", func(t *testing.T) { testValidation(t, factory) })
+	t.Run("events", func(t *testing.T) { testEvents(t, factory) })
+	t.Run("failing listener", func(t *testing.T) { testFailingListener(t, factory) })
+	t.Run("pagination", func(t *testing.T) { testPagination(t, factory) })
+	t.Run("filter", func(t *testing.T) { testFilter(t, factory) })
+	t.Run("concurrent adds", func(t *testing.T) { testConcurrentAdds(t, factory) })
+}
+
+// recorder is an event listener which appends the events to a log shared by the listeners
+type recorder struct {
+	id string
+	*eventLog
+	// fail makes the handler of the event (create, update or delete) return an error
+	fail string
+}
+
+type eventLog struct {
+	sync.Mutex
+	events []string
+}
+
+func (l *eventLog) String() string {
+	l.Lock()
+	defer l.Unlock()
+	return strings.Join(l.events, ", ")
+}
+
+func (r *recorder) record(event, entry string) error {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, r.id+" "+entry)
+	if r.fail == event {
+		return fmt.Errorf("listener %s failed to handle the %s event", r.id, event)
+	}
+	return nil
+}
+
+func (r *recorder) CreateHandler(new registry.DataStream) error {
+	return r.record("create", "create "+new.Name)
+}
+
+func (r *recorder) UpdateHandler(old registry.DataStream, new registry.DataStream) error {
+	return r.record("update", fmt.Sprintf("update %s %v->%v", new.Name, old.Meta["v"], new.Meta["v"]))
+}
+
+func (r *recorder) DeleteHandler(old registry.DataStream) error {
+	return r.record("delete", "delete "+old.Name)
+}
+
+// dataStream returns a data stream with the value v in its meta data
+func dataStream(name, v string) registry.DataStream {
+	return registry.DataStream{Name: name, Type: common.FLOAT, Meta: map[string]interface{}{"v": v}}
+}
+
+// names returns the names of the data streams
+func names(streams []registry.DataStream) string {
+	var s []string
+	for _, ds := range streams {
+		s = append(s, ds.Name)
+	}
+	return strings.Join(s, " ")
+}
+
+// expectError fails the test unless the error starts with the prefix
+func expectError(t *testing.T, err error, prefix, action string) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("Expected an error on %s", action)
+	}
+	if !strings.HasPrefix(err.Error(), prefix) {
+		t.Fatalf("Expected a %q error on %s, got: %s", prefix, action, err)
+	}
+}
+
+func testCRUD(t *testing.T, factory StorageFactory) {
+	storage := factory(t)
+	ds := dataStream("crud/a", "1")
+	ds.Source = registry.Source{SrcType: registry.MqttType,
+		MQTTSource: &registry.MQTTSource{BrokerURL: "tcp://localhost:1883", Topic: "crud/a", QoS: 1}}
+	added, err := storage.Add(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.Name != ds.Name || added.Type != ds.Type {
+		t.Fatalf("Expected the added data stream %+v, got %+v", ds, added)
+	}
+
+	got, err := storage.Get(ds.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != ds.Name || got.Type != ds.Type || !reflect.DeepEqual(got.Meta, ds.Meta) ||
+		got.Source.MQTTSource == nil || *got.Source.MQTTSource != *ds.Source.MQTTSource {
+		t.Fatalf("Expected the stored data stream %+v, got %+v", ds, got)
+	}
+
+	updated, err := storage.Update(ds.Name, dataStream(ds.Name, "2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Meta["v"] != "2" {
+		t.Fatalf("Expected the updated meta data, got %+v", updated)
+	}
+	if got, err = storage.Get(ds.Name); err != nil || got.Meta["v"] != "2" || got.Source.MQTTSource != nil {
+		t.Fatalf("Expected the stored data stream to be updated, got %+v (%v)", got, err)
+	}
+
+	if err := storage.Delete(ds.Name); err != nil {
+		t.Fatal(err)
+	}
+	_, err = storage.Get(ds.Name)
+	expectError(t, err, registry.ErrNotFound.Error(), "getting a deleted data stream")
+	_, err = storage.Update(ds.Name, ds)
+	expectError(t, err, registry.ErrNotFound.Error(), "updating a deleted data stream")
+	err = storage.Delete(ds.Name)
+	expectError(t, err, registry.ErrNotFound.Error(), "deleting a deleted data stream")
+
+	// the name is free again
+	if _, err := storage.Add(ds); err != nil {
+		t.Fatalf("Error adding a data stream again after deleting it: %s", err)
+	}
+}
+
+func testValidation(t *testing.T, factory StorageFactory) {
+	log := &eventLog{}
+	storage := factory(t, &recorder{id: "1", eventLog: log})
+	if _, err := storage.Add(dataStream("valid", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := storage.Add(dataStream("valid", "2"))
+	expectError(t, err, registry.ErrConflict.Error(), "adding a duplicate")
+	_, err = storage.Add(dataStream("", "1"))
+	expectError(t, err, registry.ErrConflict.Error(), "adding without a name")
+	_, err = storage.Add(registry.DataStream{Name: "invalid/type", Type: "complex"})
+	expectError(t, err, registry.ErrConflict.Error(), "adding an unsupported type")
+	changed := dataStream("valid", "2")
+	changed.Type = common.STRING
+	_, err = storage.Update("valid", changed)
+	expectError(t, err, registry.ErrConflict.Error(), "changing the type")
+
+	if events := log.String(); events != "1 create valid" {
+		t.Fatalf("Expected no events for rejected changes, got: %s", events)
+	}
+	if got, err := storage.Get("valid"); err != nil || got.Meta["v"] != "1" || got.Type != common.FLOAT {
+		t.Fatalf("Expected the data stream to be unchanged, got %+v (%v)", got, err)
+	}
+	if _, total, err := storage.GetMany(1, 10); err != nil || total != 1 {
+		t.Fatalf("Expected one data stream, got %d (%v)", total, err)
+	}
+}
+
+func testEvents(t *testing.T, factory StorageFactory) {
+	log := &eventLog{}
+	storage := factory(t, &recorder{id: "1", eventLog: log}, &recorder{id: "2", eventLog: log})
+
+	if _, err := storage.Add(dataStream("events/a", "1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Add(dataStream("events/b", "1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Update("events/a", dataStream("events/a", "2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Delete("events/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Delete("events/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "1 create events/a, 2 create events/a, 1 create events/b, 2 create events/b, " +
+		"1 update events/a 1->2, 2 update events/a 1->2, " +
+		"1 delete events/b, 2 delete events/b, 1 delete events/a, 2 delete events/a"
+	if events := log.String(); events != expected {
+		t.Fatalf("Expected the events\n%s\ngot\n%s", expected, events)
+	}
+}
+
+func testFailingListener(t *testing.T, factory StorageFactory) {
+	log := &eventLog{}
+	failing := &recorder{id: "1", eventLog: log}
+	storage := factory(t, failing, &recorder{id: "2", eventLog: log})
+
+	// the listeners after the failing one are not notified and nothing is changed
+	failing.fail = "create"
+	_, err := storage.Add(dataStream("failing", "1"))
+	if err == nil {
+		t.Fatal("Expected the error of the listener on add")
+	}
+	if _, err := storage.Get("failing"); err == nil {
+		t.Fatal("Expected the data stream not to be stored after a failed create event")
+	}
+
+	failing.fail = ""
+	if _, err := storage.Add(dataStream("failing", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	failing.fail = "update"
+	if _, err := storage.Update("failing", dataStream("failing", "2")); err == nil {
+		t.Fatal("Expected the error of the listener on update")
+	}
+	if got, err := storage.Get("failing"); err != nil || got.Meta["v"] != "1" {
+		t.Fatalf("Expected the data stream not to be updated after a failed update event, got %+v (%v)", got, err)
+	}
+
+	failing.fail = "delete"
+	if err := storage.Delete("failing"); err == nil {
+		t.Fatal("Expected the error of the listener on delete")
+	}
+	if _, err := storage.Get("failing"); err != nil {
+		t.Fatalf("Expected the data stream to be kept after a failed delete event: %s", err)
+	}
+
+	expected := "1 create failing, 1 create failing, 2 create failing, 1 update failing 1->2, 1 delete failing"
+	if events := log.String(); events != expected {
+		t.Fatalf("Expected the events\n%s\ngot\n%s", expected, events)
+	}
+}
+
+func testPagination(t *testing.T, factory StorageFactory) {
+	storage := factory(t)
+
+	streams, total, err := storage.GetMany(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 0 || total != 0 {
+		t.Fatalf("Expected an empty registry, got %d of %d", len(streams), total)
+	}
+
+	var all []string
+	add := func(n int) {
+		for _, i := range rand.Perm(n) {
+			name := fmt.Sprintf("page/%02d", len(all)+i)
+			if _, err := storage.Add(dataStream(name, "1")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < n; i++ {
+			all = append(all, fmt.Sprintf("page/%02d", len(all)))
+		}
+	}
+	// expectPages checks that the pages make up all data streams in the order of their names
+	expectPages := func(perPage int) {
+		t.Helper()
+		var listed []string
+		pages := (len(all) + perPage - 1) / perPage
+		for page := 1; page <= pages+1; page++ {
+			streams, total, err := storage.GetMany(page, perPage)
+			if err != nil {
+				t.Fatalf("Error getting page %d of %d: %s", page, perPage, err)
+			}
+			if total != len(all) {
+				t.Fatalf("Expected the total %d on page %d of %d, got %d", len(all), page, perPage, total)
+			}
+			expected := perPage
+			if page == pages {
+				expected = len(all) - (pages-1)*perPage
+			} else if page > pages {
+				expected = 0
+			}
+			if len(streams) != expected {
+				t.Fatalf("Expected %d data streams on page %d of %d, got: %s", expected, page, perPage, names(streams))
+			}
+			for _, ds := range streams {
+				listed = append(listed, ds.Name)
+			}
+		}
+		if strings.Join(listed, " ") != strings.Join(all, " ") {
+			t.Fatalf("Expected the pages of %d to list\n%s\ngot\n%s", perPage, all, listed)
+		}
+	}
+
+	add(20)
+	for _, perPage := range []int{1, 7, 10, 20, registry.MaxPerPage} {
+		expectPages(perPage)
+	}
+	add(5)
+	for _, perPage := range []int{10, 25} {
+		expectPages(perPage)
+	}
+
+	for _, params := range [][2]int{{0, 10}, {1, 0}, {1, registry.MaxPerPage + 1}} {
+		if _, _, err := storage.GetMany(params[0], params[1]); err == nil {
+			t.Fatalf("Expected an error for page %d of %d", params[0], params[1])
+		}
+	}
+}
+
+func testFilter(t *testing.T, factory StorageFactory) {
+	storage := factory(t)
+	var matching []string
+	for i := 0; i < 15; i++ {
+		v := "b"
+		if i%3 == 0 {
+			v = "a" + fmt.Sprint(i)
+			matching = append(matching, fmt.Sprintf("filter/%02d", i))
+		}
+		if _, err := storage.Add(dataStream(fmt.Sprintf("filter/%02d", i), v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ds, err := storage.FilterOne("name", "equals", "filter/04")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds == nil || ds.Name != "filter/04" {
+		t.Fatalf("Expected to find filter/04, got %+v", ds)
+	}
+	ds, err = storage.FilterOne("name", "equals", "filter/99")
+	if err != nil || ds != nil {
+		t.Fatalf("Expected no match and no error, got %+v (%v)", ds, err)
+	}
+
+	var listed []string
+	for page := 1; page <= 3; page++ {
+		streams, total, err := storage.Filter("meta.v", "prefix", "a", page, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != len(matching) {
+			t.Fatalf("Expected the total %d of matches, got %d", len(matching), total)
+		}
+		for _, ds := range streams {
+			listed = append(listed, ds.Name)
+		}
+	}
+	sort.Strings(listed)
+	if strings.Join(listed, " ") != strings.Join(matching, " ") {
+		t.Fatalf("Expected the pages of matches to list %v, got %v", matching, listed)
+	}
+	streams, total, err := storage.Filter("meta.v", "equals", "c", 1, 10)
+	if err != nil || len(streams) != 0 || total != 0 {
+		t.Fatalf("Expected no matches, got %d of %d (%v)", len(streams), total, err)
+	}
+}
+
+func testConcurrentAdds(t *testing.T, factory StorageFactory) {
+	const distinct, duplicates = 20, 10
+	log := &eventLog{}
+	storage := factory(t, &recorder{id: "1", eventLog: log})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, distinct+duplicates)
+	for i := 0; i < distinct; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := storage.Add(dataStream(fmt.Sprintf("concurrent/%02d", i), "1")); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	for i := 0; i < duplicates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := storage.Add(dataStream("concurrent/duplicate", "1")); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	conflicts := 0
+	for err := range errs {
+		if !strings.HasPrefix(err.Error(), registry.ErrConflict.Error()) {
+			t.Fatalf("Unexpected error on concurrent add: %s", err)
+		}
+		conflicts++
+	}
+	if conflicts != duplicates-1 {
+		t.Fatalf("Expected %d conflicts of the duplicates, got %d", duplicates-1, conflicts)
+	}
+	streams, total, err := storage.GetMany(1, registry.MaxPerPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != distinct+1 || len(streams) != distinct+1 {
+		t.Fatalf("Expected %d data streams, got %d of %d", distinct+1, len(streams), total)
+	}
+	if events := strings.Count(log.String(), "create"); events != distinct+1 {
+		t.Fatalf("Expected %d create events, got %d", distinct+1, events)
+	}
+}
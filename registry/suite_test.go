@@ -0,0 +1,31 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package registry_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+	"github.com/linksmart/historical-datastore/registry/registrytest"
+)
+
+func TestMemoryStorageSuite(t *testing.T) {
+	registrytest.RunStorageSuite(t, func(t *testing.T, listeners ...registry.EventListener) registry.Storage {
+		return registry.NewMemoryStorage(common.RegConf{}, listeners...)
+	})
+}
+
+func TestLevelDBStorageSuite(t *testing.T) {
+	registrytest.RunStorageSuite(t, func(t *testing.T, listeners ...registry.EventListener) registry.Storage {
+		// Replace Windows-based backslashes with slash (not parsed as Path by net/url)
+		dsn := filepath.ToSlash(filepath.Join(t.TempDir(), "registry.ldb"))
+		storage, closeDB, err := registry.NewLevelDBStorage(common.RegConf{Backend: common.RegBackendConf{DSN: dsn}}, nil, listeners...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { closeDB() })
+		return storage
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/linksmart/historical-datastore/common"
 )
@@ -16,7 +17,9 @@ import (
 // data: readonly
 // resource: mandatory, fixed
 // meta: n/a
-// retention: n/a
+// retention: optional
+// source: optional
+// function: mandatory for Series sources
 // aggregation: id/data readonly
 // type: mandatory, fixed
 // format: mandatory
@@ -40,6 +43,9 @@ func validateCreation(ds DataStream, conf common.RegConf) error {
 	if !common.SupportedType(ds.Type) {
 		e.invalid = append(e.invalid, "type")
 	}
+
+	validateRetention(ds, conf, &e)
+	validateSource(ds, &e)
 	/*
 		var e validationError
 		//TODO: add validation logics
@@ -140,6 +146,9 @@ func validateUpdate(ds DataStream, oldDS DataStream, conf common.RegConf) error
 	if ds.Type != oldDS.Type {
 		e.readOnly = append(e.readOnly, "type")
 	}
+
+	validateRetention(ds, conf, &e)
+	validateSource(ds, &e)
 	//TODO: add validation logics
 	/*
 
@@ -207,6 +216,67 @@ func validateUpdate(ds DataStream, oldDS DataStream, conf common.RegConf) error
 	return nil
 }
 
+// validateRetention checks that the retention periods are valid and the maximum does not violate the minimum
+func validateRetention(ds DataStream, conf common.RegConf, e *validationError) {
+	var min, max time.Duration
+	var err error
+	if ds.Retention.Min != "" {
+		min, err = common.ParsePeriod(ds.Retention.Min)
+		if err != nil {
+			e.invalid = append(e.invalid, "retain.min")
+		}
+	}
+	if ds.Retention.Max != "" {
+		max, err = common.ParsePeriod(ds.Retention.Max)
+		if err != nil {
+			e.invalid = append(e.invalid, "retain.max")
+		} else if !conf.ConfiguredRetention(ds.Retention.Max) {
+			e.other = append(e.other, fmt.Sprintf("retain.max must be empty or one of the configured periods: %s", strings.Join(conf.RetentionPeriods, ", ")))
+		}
+	}
+	if min != 0 && max != 0 && max < min {
+		e.other = append(e.other, fmt.Sprintf("retain.max (%s) must not be shorter than retain.min (%s)", ds.Retention.Max, ds.Retention.Min))
+	}
+}
+
+// validateSource checks the source and function of derived data streams
+func validateSource(ds DataStream, e *validationError) {
+	switch ds.Source.SrcType {
+	case "", MqttType:
+		if ds.Function != "" {
+			e.other = append(e.other, fmt.Sprintf("function is only supported for data streams with a %s source", SeriesType))
+		}
+		if mqtt := ds.Source.MQTTSource; mqtt != nil {
+			// client certificate and key are needed together
+			if mqtt.CertFile != "" && mqtt.KeyFile == "" {
+				e.mandatory = append(e.mandatory, "source.keyFile")
+			}
+			if mqtt.KeyFile != "" && mqtt.CertFile == "" {
+				e.mandatory = append(e.mandatory, "source.certFile")
+			}
+			if mqtt.KeepAlive < 0 {
+				e.invalid = append(e.invalid, "source.keepAlive")
+			}
+		}
+	case SeriesType:
+		if ds.Source.SeriesSource == nil || ds.Source.SeriesSource.URL == "" {
+			e.mandatory = append(e.mandatory, "source.name")
+		} else if ds.Source.SeriesSource.URL == ds.Name {
+			e.other = append(e.other, "data stream cannot be derived from itself")
+		}
+		if ds.Function == "" {
+			e.mandatory = append(e.mandatory, "function")
+		} else if _, _, err := common.ParseFunction(ds.Function); err != nil {
+			e.invalid = append(e.invalid, "function")
+		}
+		if ds.Type != common.FLOAT {
+			e.other = append(e.other, fmt.Sprintf("data streams with a %s source must be of %s type", SeriesType, common.FLOAT))
+		}
+	default:
+		e.invalid = append(e.invalid, "source.type")
+	}
+}
+
 // Custom error formatting
 type validationError struct {
 	readOnly  []string
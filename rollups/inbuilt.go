@@ -1,5 +1,174 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
 package rollups
 
-//func MeanFloat(session, inputStream []stream, outputStream stream) {
-//get the input data from the session
-//}
+import (
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/data"
+)
+
+// maxTime is the upper bound for queries of values following a given time
+var maxTime = time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// aggregate updates the intervals of the given values and returns the aggregate of each of them
+// The aggregate of an interval is updated with every value and stored at the beginning of the interval
+func (s *session) aggregate(values senml.Pack, storage data.Storage) (senml.Pack, error) {
+	var derived senml.Pack
+	for i := 0; i < len(values); {
+		bucket := toTime(values[i].Time).Truncate(s.interval)
+		j := i
+		for j < len(values) && toTime(values[j].Time).Truncate(s.interval).Equal(bucket) {
+			j++
+		}
+		group := values[i:j]
+		i = j
+
+		acc := s.acc
+		if acc != nil && bucket.Equal(s.bucket) && toTime(group[0].Time).After(toTime(s.latest.Time)) {
+			// the values follow the current state
+			for _, r := range group {
+				acc.Add(*r.Value)
+			}
+			latest := group[len(group)-1]
+			s.latest = &latest
+		} else {
+			// rebuild the interval from the storage, which already includes the given values
+			pack, err := s.query(storage, bucket, bucket.Add(s.interval), common.ASC, 0)
+			if err != nil {
+				return nil, err
+			}
+			acc = data.NewAccumulator([]string{s.function})
+			var latest *senml.Record
+			for k := range pack {
+				if toTime(pack[k].Time).Truncate(s.interval).Equal(bucket) {
+					acc.Add(*pack[k].Value)
+					latest = &pack[k]
+				}
+			}
+			if acc.Count() == 0 {
+				continue
+			}
+			// keep the state for the latest interval only
+			if s.acc == nil || !bucket.Before(s.bucket) {
+				s.acc, s.bucket, s.latest = acc, bucket, latest
+			}
+		}
+		derived = append(derived, s.derivedRecord(bucket, acc.Result(s.function), group[len(group)-1].Unit))
+	}
+	return derived, nil
+}
+
+// aggregateRange returns the intervals overlapping the given range and their aggregates
+func (s *session) aggregateRange(from, to time.Time, storage data.Storage) (time.Time, time.Time, senml.Pack, error) {
+	first, last := from.Truncate(s.interval), to.Truncate(s.interval)
+	// the state is rebuilt with the next value
+	s.acc, s.latest = nil, nil
+
+	pack, err := s.query(storage, first, last.Add(s.interval), common.ASC, 0)
+	if err != nil {
+		return first, last, nil, err
+	}
+	var derived senml.Pack
+	var acc *data.Accumulator
+	var bucket time.Time
+	var unit string
+	for _, r := range pack {
+		b := toTime(r.Time).Truncate(s.interval)
+		if b.After(last) {
+			break
+		}
+		if acc != nil && !b.Equal(bucket) {
+			derived = append(derived, s.derivedRecord(bucket, acc.Result(s.function), unit))
+			acc = nil
+		}
+		if acc == nil {
+			acc = data.NewAccumulator([]string{s.function})
+			bucket = b
+		}
+		acc.Add(*r.Value)
+		unit = r.Unit
+	}
+	if acc != nil {
+		derived = append(derived, s.derivedRecord(bucket, acc.Result(s.function), unit))
+	}
+	return first, last, derived, nil
+}
+
+// diffRange returns the range of differences affected by the given range and the difference which replaces them
+// The value following the range is now preceded by the value preceding the range
+func (s *session) diffRange(from, to time.Time, storage data.Storage) (time.Time, time.Time, senml.Pack, error) {
+	// the state is rebuilt with the next value
+	s.latest = nil
+
+	next, err := s.neighbour(storage, to, common.ASC)
+	if err != nil || next == nil {
+		return from, to, nil, err
+	}
+	prev, err := s.neighbour(storage, from, common.DESC)
+	if err != nil {
+		return from, to, nil, err
+	}
+	t := toTime(next.Time)
+	if prev == nil {
+		return from, t, nil, nil
+	}
+	return from, t, senml.Pack{s.derivedRecord(t, *next.Value-*prev.Value, next.Unit)}, nil
+}
+
+// diff returns the difference of the given values to their preceding values in the source
+// A late value also changes the difference of the value following it
+func (s *session) diff(values senml.Pack, storage data.Storage) (senml.Pack, error) {
+	var derived senml.Pack
+	for i := range values {
+		r := &values[i]
+		t := toTime(r.Time)
+
+		var prev *senml.Record
+		if s.latest != nil && t.After(toTime(s.latest.Time)) {
+			prev = s.latest
+			s.latest = r
+		} else {
+			var err error
+			prev, err = s.neighbour(storage, t, common.DESC)
+			if err != nil {
+				return nil, err
+			}
+			next, err := s.neighbour(storage, t, common.ASC)
+			if err != nil {
+				return nil, err
+			}
+			if next != nil {
+				derived = append(derived, s.derivedRecord(toTime(next.Time), *next.Value-*r.Value, next.Unit))
+			} else {
+				s.latest = r
+			}
+		}
+
+		if prev != nil {
+			derived = append(derived, s.derivedRecord(t, *r.Value-*prev.Value, r.Unit))
+		}
+	}
+	return derived, nil
+}
+
+// neighbour returns the value of the source which precedes (descending) or follows (ascending) the given time
+func (s *session) neighbour(storage data.Storage, t time.Time, order string) (*senml.Record, error) {
+	from, to := time.Time{}, t
+	if order == common.ASC {
+		from, to = t, maxTime
+	}
+	// the value at the given time may be included
+	pack, err := s.query(storage, from, to, order, 2)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pack {
+		if !toTime(pack[i].Time).Equal(t) {
+			return &pack[i], nil
+		}
+	}
+	return nil, nil
+}
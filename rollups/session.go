@@ -1,8 +1,126 @@
-package rollups
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
 
 /*
-This package is responsible to take care of a rollup function. There will be one session per DataStream.
+Package rollups is responsible to take care of a rollup function. There will be one session per DataStream.
 Session contains the following:
-	1. The variables of the function
-	2. The time series over time
+ 1. The variables of the function
+ 2. The time series over time
 */
+package rollups
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	datastore "github.com/dschowta/senml.datastore"
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/data"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// session keeps the state of the function of a derived data stream
+// The state is rebuilt from the storage whenever the incoming data does not follow it, e.g. after a restart
+type session struct {
+	ds       registry.DataStream
+	source   *registry.DataStream
+	function string
+	interval time.Duration
+	// interval of the accumulator
+	bucket time.Time
+	acc    *data.Accumulator
+	// the latest known record of the source
+	latest *senml.Record
+}
+
+func newSession(ds registry.DataStream) (*session, error) {
+	if ds.Source.SeriesSource == nil {
+		return nil, fmt.Errorf("%s has no %s source", ds.Name, registry.SeriesType)
+	}
+	function, interval, err := common.ParseFunction(ds.Function)
+	if err != nil {
+		return nil, err
+	}
+	return &session{
+		ds:       ds,
+		source:   &registry.DataStream{Name: ds.Source.SeriesSource.URL},
+		function: function,
+		interval: interval,
+	}, nil
+}
+
+// evaluate returns the derived records for the given records of the source, which are already in the storage
+func (s *session) evaluate(records senml.Pack, storage data.Storage) (senml.Pack, error) {
+	var values senml.Pack
+	for _, r := range records {
+		if r.Value != nil {
+			values = append(values, r)
+		}
+	}
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].Time < values[j].Time
+	})
+
+	var derived senml.Pack
+	var err error
+	if s.function == "diff" {
+		derived, err = s.diff(values, storage)
+	} else {
+		derived, err = s.aggregate(values, storage)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error evaluating %s of %s: %s", s.ds.Function, s.source.Name, err)
+	}
+	return derived, nil
+}
+
+// reevaluate returns the range of derived data affected by a deletion of the source data within the given range
+// and the derived records which replace it. The source data must be deleted already.
+func (s *session) reevaluate(from, to time.Time, storage data.Storage) (time.Time, time.Time, senml.Pack, error) {
+	var derivedFrom, derivedTo time.Time
+	var derived senml.Pack
+	var err error
+	if s.function == "diff" {
+		derivedFrom, derivedTo, derived, err = s.diffRange(from, to, storage)
+	} else {
+		derivedFrom, derivedTo, derived, err = s.aggregateRange(from, to, storage)
+	}
+	if err != nil {
+		return derivedFrom, derivedTo, nil, fmt.Errorf("error re-evaluating %s of %s: %s", s.ds.Function, s.source.Name, err)
+	}
+	return derivedFrom, derivedTo, derived, nil
+}
+
+// query returns the values of the source within the given time range (inclusive)
+func (s *session) query(storage data.Storage, from, to time.Time, order string, limit int) (senml.Pack, error) {
+	pack, _, _, err := storage.Query(data.Query{From: from, To: to, Sort: order, Limit: limit}, s.source)
+	if err != nil {
+		return nil, err
+	}
+	var values senml.Pack
+	for _, r := range pack {
+		if r.Value != nil {
+			values = append(values, r)
+		}
+	}
+	return values, nil
+}
+
+// derivedRecord returns a record of the derived data stream
+func (s *session) derivedRecord(t time.Time, value float64, unit string) senml.Record {
+	if s.function == "count" {
+		unit = ""
+	}
+	return senml.Record{
+		Name:  s.ds.Name,
+		Unit:  unit,
+		Time:  datastore.ToSenmlTime(t),
+		Value: &value,
+	}
+}
+
+// toTime converts a SenML time to time, rounded to microseconds to compensate the floating point precision
+func toTime(t float64) time.Time {
+	return datastore.FromSenmlTime(t).Round(time.Microsecond)
+}
@@ -0,0 +1,268 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package rollups
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/data"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// Storage evaluates the functions of derived data streams on the data submitted to their source series
+// and stores the results along with the submitted data
+// Only the data submitted after the creation of a derived data stream is evaluated
+type Storage struct {
+	data.Storage
+	sync.Mutex
+	// sessions of derived data streams by their names
+	sessions map[string]*session
+	// sessions of derived data streams by the names of their sources
+	derived map[string][]*session
+}
+
+func NewStorage(storage data.Storage) *Storage {
+	return &Storage{
+		Storage:  storage,
+		sessions: make(map[string]*session),
+		derived:  make(map[string][]*session),
+	}
+}
+
+// Start creates sessions for the derived data streams in the given registry
+func (s *Storage) Start(reg registry.Storage) error {
+	s.Lock()
+	defer s.Unlock()
+
+	perPage := 100
+	for page := 1; ; page++ {
+		dataStreams, total, err := reg.GetMany(page, perPage)
+		if err != nil {
+			return fmt.Errorf("Rollups: Error getting data streams: %v", err)
+		}
+
+		for _, ds := range dataStreams {
+			if ds.Source.SrcType == registry.SeriesType {
+				session, err := s.newSession(ds)
+				if err != nil {
+					log.Printf("Rollups: Error creating session for %s: %v", ds.Name, err)
+					continue
+				}
+				s.addSession(session)
+			}
+		}
+
+		if page*perPage >= total {
+			break
+		}
+	}
+	return nil
+}
+
+// Submit stores the data and the data derived from it
+// Submissions with derived data streams are serialized to keep the sessions consistent with the storage
+func (s *Storage) Submit(data map[string]senml.Pack, sources map[string]*registry.DataStream) error {
+	if !s.hasDerived(data) {
+		return s.Storage.Submit(data, sources)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	return s.submit(data, sources)
+}
+
+func (s *Storage) submit(data map[string]senml.Pack, sources map[string]*registry.DataStream) error {
+	// derived data may itself be the source of other derived data streams
+	for len(data) > 0 {
+		err := s.Storage.Submit(data, sources)
+		if err != nil {
+			return err
+		}
+		data, sources = s.evaluate(data)
+	}
+	return nil
+}
+
+// Atomic returns true if the underlying storage is atomic
+func (s *Storage) Atomic() bool {
+	return data.IsAtomic(s.Storage)
+}
+
+// QueryStream streams the query results of the underlying storage
+func (s *Storage) QueryStream(q data.Query, ds *registry.DataStream, send func(senml.Record) error) error {
+	return data.QueryStream(s.Storage, q, ds, send)
+}
+
+// Delete deletes the data points and re-evaluates the data derived from them
+func (s *Storage) Delete(sources []*registry.DataStream, from time.Time, to time.Time) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.delete(sources, from, to)
+}
+
+func (s *Storage) delete(sources []*registry.DataStream, from time.Time, to time.Time) (int, error) {
+	total, err := s.Storage.Delete(sources, from, to)
+	if err != nil {
+		return total, err
+	}
+
+	for _, ds := range sources {
+		for _, session := range s.derived[ds.Name] {
+			derivedFrom, derivedTo, records, err := session.reevaluate(from, to, s.Storage)
+			if err != nil {
+				return total, err
+			}
+			// derived data may itself be the source of other derived data streams
+			_, err = s.delete([]*registry.DataStream{&session.ds}, derivedFrom, derivedTo)
+			if err != nil {
+				return total, err
+			}
+			if len(records) > 0 {
+				err = s.submit(map[string]senml.Pack{session.ds.Name: records}, map[string]*registry.DataStream{session.ds.Name: &session.ds})
+				if err != nil {
+					return total, err
+				}
+			}
+		}
+	}
+	return total, nil
+}
+
+func (s *Storage) hasDerived(data map[string]senml.Pack) bool {
+	s.Lock()
+	defer s.Unlock()
+	for name := range data {
+		if len(s.derived[name]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate returns the derived data of the given data
+func (s *Storage) evaluate(data map[string]senml.Pack) (map[string]senml.Pack, map[string]*registry.DataStream) {
+	derivedData := make(map[string]senml.Pack)
+	derivedSources := make(map[string]*registry.DataStream)
+	for name, pack := range data {
+		for _, session := range s.derived[name] {
+			records, err := session.evaluate(pack, s.Storage)
+			if err != nil {
+				// the source data is stored already and the interval is rebuilt with the next submission
+				log.Printf("Rollups: %v", err)
+				continue
+			}
+			if len(records) > 0 {
+				derivedData[session.ds.Name] = append(derivedData[session.ds.Name], records...)
+				derivedSources[session.ds.Name] = &session.ds
+			}
+		}
+	}
+	return derivedData, derivedSources
+}
+
+// newSession creates a session for the derived data stream if it does not lead to cyclic derivations
+func (s *Storage) newSession(ds registry.DataStream) (*session, error) {
+	session, err := newSession(ds)
+	if err != nil {
+		return nil, err
+	}
+	// walk up the sources
+	for source := session.source.Name; ; {
+		if source == ds.Name {
+			return nil, fmt.Errorf("cyclic derivation of %s", ds.Name)
+		}
+		parent, found := s.sessions[source]
+		if !found {
+			break
+		}
+		source = parent.source.Name
+	}
+	return session, nil
+}
+
+func (s *Storage) addSession(session *session) {
+	s.sessions[session.ds.Name] = session
+	s.derived[session.source.Name] = append(s.derived[session.source.Name], session)
+}
+
+func (s *Storage) removeSession(name string) {
+	session, found := s.sessions[name]
+	if !found {
+		return
+	}
+	delete(s.sessions, name)
+	siblings := s.derived[session.source.Name]
+	for i := range siblings {
+		if siblings[i] == session {
+			s.derived[session.source.Name] = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(s.derived[session.source.Name]) == 0 {
+		delete(s.derived, session.source.Name)
+	}
+}
+
+// CreateHandler handles the creation of a new data source
+func (s *Storage) CreateHandler(ds registry.DataStream) error {
+	s.Lock()
+	defer s.Unlock()
+
+	var session *session
+	if ds.Source.SrcType == registry.SeriesType {
+		var err error
+		session, err = s.newSession(ds)
+		if err != nil {
+			return err
+		}
+	}
+	err := s.Storage.CreateHandler(ds)
+	if err != nil {
+		return err
+	}
+	if session != nil {
+		s.addSession(session)
+	}
+	return nil
+}
+
+// UpdateHandler handles updates of a data source
+func (s *Storage) UpdateHandler(oldDS registry.DataStream, newDS registry.DataStream) error {
+	s.Lock()
+	defer s.Unlock()
+
+	var session *session
+	if newDS.Source.SrcType == registry.SeriesType {
+		var err error
+		session, err = s.newSession(newDS)
+		if err != nil {
+			return err
+		}
+	}
+	err := s.Storage.UpdateHandler(oldDS, newDS)
+	if err != nil {
+		return err
+	}
+	s.removeSession(oldDS.Name)
+	if session != nil {
+		s.addSession(session)
+	}
+	return nil
+}
+
+// DeleteHandler handles deletion of a data source
+func (s *Storage) DeleteHandler(ds registry.DataStream) error {
+	s.Lock()
+	defer s.Unlock()
+
+	err := s.Storage.DeleteHandler(ds)
+	if err != nil {
+		return err
+	}
+	s.removeSession(ds.Name)
+	return nil
+}
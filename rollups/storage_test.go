@@ -0,0 +1,294 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package rollups
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/farshidtz/senml"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/data"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+func TestRollups(t *testing.T) {
+	fileName := os.TempDir() + "/TestRollups"
+	os.Remove(fileName)
+	defer os.Remove(fileName)
+	dataStorage, disconnect, err := data.NewSenmlStorage(common.DataConf{Backend: common.DataBackendConf{Type: data.SENMLSTORE, DSN: fileName}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disconnect()
+	storage := NewStorage(dataStorage)
+	regStorage := registry.NewMemoryStorage(common.RegConf{}, storage)
+
+	derived := func(name, source, function string) registry.DataStream {
+		return registry.DataStream{
+			Name:     name,
+			Type:     common.FLOAT,
+			Function: function,
+			Source:   registry.Source{SrcType: registry.SeriesType, SeriesSource: &registry.SeriesSource{URL: source}},
+		}
+	}
+	source, err := regStorage.Add(registry.DataStream{Name: "rollup/source", Type: common.FLOAT})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ds := range []registry.DataStream{
+		derived("rollup/mean", "rollup/source", "mean(15m)"),
+		derived("rollup/diff", "rollup/source", "diff"),
+		derived("rollup/mean/max", "rollup/mean", "max(1h)"),
+		derived("rollup/cycle/a", "rollup/cycle/b", "diff"),
+	} {
+		if _, err := regStorage.Add(ds); err != nil {
+			t.Fatalf("Error adding %s: %s", ds.Name, err)
+		}
+	}
+	if _, err := regStorage.Add(derived("rollup/cycle/b", "rollup/cycle/a", "diff")); err == nil {
+		t.Errorf("Expected cyclic derivation to fail")
+	}
+
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	submit := func(minutes ...int) {
+		var pack senml.Pack
+		for _, m := range minutes {
+			v := float64(m)
+			if m < 0 { // late value of 100 at the given minute
+				m, v = -m, 100
+			}
+			pack = append(pack, senml.Record{Name: source.Name, Value: &v, Time: float64(start.Add(time.Duration(m) * time.Minute).Unix())})
+		}
+		err := storage.Submit(map[string]senml.Pack{source.Name: pack}, map[string]*registry.DataStream{source.Name: source})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// returns the values of a derived data stream by minute
+	query := func(name string) map[int]float64 {
+		pack, _, _, err := storage.Query(data.Query{From: start, To: start.Add(time.Hour), Sort: common.ASC}, &registry.DataStream{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := make(map[int]float64)
+		for _, r := range pack {
+			values[int(r.Time-float64(start.Unix()))/60] = *r.Value
+		}
+		return values
+	}
+
+	// one value per minute: 0, 1, ..., 29
+	var minutes []int
+	for m := 0; m < 30; m++ {
+		minutes = append(minutes, m)
+	}
+	submit(minutes[:20]...)
+	if mean := query("rollup/mean"); len(mean) != 2 || mean[0] != 7 || mean[15] != 17 {
+		t.Errorf("Unexpected means of the partial intervals: %v", mean)
+	}
+	submit(minutes[20:]...)
+	if mean := query("rollup/mean"); len(mean) != 2 || mean[0] != 7 || mean[15] != 22 {
+		t.Errorf("Unexpected means: %v", mean)
+	}
+	diff := query("rollup/diff")
+	if len(diff) != 29 || diff[1] != 1 || diff[29] != 1 {
+		t.Errorf("Unexpected differences: %v", diff)
+	}
+	if max := query("rollup/mean/max"); len(max) != 1 || max[0] != 22 {
+		t.Errorf("Unexpected maximum of means: %v", max)
+	}
+
+	// replace the value at minute 5
+	submit(-5)
+	if mean := query("rollup/mean"); math.Abs(mean[0]-200.0/15) > 1e-9 || mean[15] != 22 {
+		t.Errorf("Unexpected means after a late value: %v", mean)
+	}
+	if diff := query("rollup/diff"); diff[5] != 96 || diff[6] != -94 || diff[7] != 1 {
+		t.Errorf("Unexpected differences after a late value: %v", diff)
+	}
+
+	// delete the values from minute 5 to 20
+	_, err = storage.Delete([]*registry.DataStream{source}, start.Add(5*time.Minute), start.Add(20*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mean := query("rollup/mean"); mean[0] != 2 || mean[15] != 25 {
+		t.Errorf("Unexpected means after deletion: %v", mean)
+	}
+	if diff := query("rollup/diff"); len(diff) != 13 || diff[5] != 0 || diff[21] != 17 || diff[22] != 1 {
+		t.Errorf("Unexpected differences after deletion: %v", diff)
+	}
+	if max := query("rollup/mean/max"); len(max) != 1 || max[0] != 25 {
+		t.Errorf("Unexpected maximum of means after deletion: %v", max)
+	}
+}
+
+func TestRollupsRetention(t *testing.T) {
+	dataStorage, _, err := data.NewMemoryStorage(common.DataConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewStorage(dataStorage)
+	regStorage := registry.NewMemoryStorage(common.RegConf{RetentionPeriods: []string{"1h"}}, storage)
+
+	source := registry.DataStream{Name: "retention/source", Type: common.FLOAT}
+	source.Retention.Max = "1h"
+	if _, err := regStorage.Add(source); err != nil {
+		t.Fatal(err)
+	}
+	mean := registry.DataStream{
+		Name:     "retention/mean",
+		Type:     common.FLOAT,
+		Function: "mean(15m)",
+		Source:   registry.Source{SrcType: registry.SeriesType, SeriesSource: &registry.SeriesSource{URL: source.Name}},
+	}
+	if _, err := regStorage.Add(mean); err != nil {
+		t.Fatal(err)
+	}
+
+	// one value per minute, two hours ago
+	start := time.Now().Add(-2 * time.Hour).Truncate(time.Hour)
+	var pack senml.Pack
+	for m := 0; m < 30; m++ {
+		v := float64(m)
+		pack = append(pack, senml.Record{Name: source.Name, Value: &v, Time: float64(start.Add(time.Duration(m) * time.Minute).Unix())})
+	}
+	if err := storage.Submit(map[string]senml.Pack{source.Name: pack}, map[string]*registry.DataStream{source.Name: &source}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the retention of the source purges the storage beneath the rollups
+	retention := data.NewRetentionManager(dataStorage)
+	retention.Start(regStorage)
+	retention.Stop()
+
+	count := func(ds *registry.DataStream) int {
+		_, total, _, err := storage.Query(data.Query{From: start, To: time.Now(), Sort: common.ASC, Limit: -1}, ds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return total
+	}
+	if n := count(&source); n != 0 {
+		t.Errorf("Expected the expired source data to be purged, got %d data points", n)
+	}
+	if n := count(&mean); n != 2 {
+		t.Errorf("Expected the 2 means to be kept, got %d", n)
+	}
+}
+
+// streamingStorage counts the streamed queries of the underlying storage
+type streamingStorage struct {
+	data.Storage
+	streamed int
+}
+
+func (s *streamingStorage) QueryStream(q data.Query, ds *registry.DataStream, send func(senml.Record) error) error {
+	s.streamed++
+	return data.QueryStream(s.Storage, q, ds, send)
+}
+
+func TestRollupsQueryStream(t *testing.T) {
+	memory, _, err := data.NewMemoryStorage(common.DataConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the storages are wrapped as in main
+	streaming := &streamingStorage{Storage: memory}
+	batch := data.NewBatchStorage(NewStorage(data.NewStreamHub(streaming)), common.BatchConf{Enabled: true})
+	wal, err := data.OpenWAL(t.TempDir(), common.WALConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	defer batch.Close()
+	storage := data.NewWALStorage(batch, wal, nil)
+
+	ds := &registry.DataStream{Name: "stream/source", Type: common.FLOAT}
+	var pack senml.Pack
+	for i := 0; i < 10; i++ {
+		v := float64(i)
+		pack = append(pack, senml.Record{Name: ds.Name, Value: &v, Time: float64(1546300800 + i)})
+	}
+	if err := storage.Submit(map[string]senml.Pack{ds.Name: pack}, map[string]*registry.DataStream{ds.Name: ds}); err != nil {
+		t.Fatal(err)
+	}
+	batch.Flush()
+
+	count := 0
+	q := data.Query{From: time.Unix(1546300800, 0), To: time.Unix(1546300810, 0), Sort: common.ASC}
+	err = data.QueryStream(storage, q, ds, func(senml.Record) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 10 {
+		t.Errorf("Expected 10 streamed records, got %d", count)
+	}
+	if streaming.streamed != 1 {
+		t.Errorf("Expected the query to be streamed by the underlying storage, got %d streamed queries", streaming.streamed)
+	}
+}
+
+// rejectingStorage fails the submissions of a data stream before storing any data
+type rejectingStorage struct {
+	data.Storage
+	rejected string
+}
+
+func (s *rejectingStorage) Submit(d map[string]senml.Pack, sources map[string]*registry.DataStream) error {
+	if _, found := d[s.rejected]; found {
+		return fmt.Errorf("rejected %s", s.rejected)
+	}
+	return s.Storage.Submit(d, sources)
+}
+
+func (s *rejectingStorage) Atomic() bool {
+	return true
+}
+
+func TestRollupsBatchFailure(t *testing.T) {
+	memory, _, err := data.NewMemoryStorage(common.DataConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the storages are wrapped as in main
+	base := &rejectingStorage{Storage: memory, rejected: "batch/bad"}
+	batch := data.NewBatchStorage(NewStorage(data.NewStreamHub(base)), common.BatchConf{Enabled: true, MaxLatency: 100})
+	defer batch.Close()
+
+	good := &registry.DataStream{Name: "batch/good", Type: common.FLOAT}
+	bad := &registry.DataStream{Name: "batch/bad", Type: common.FLOAT}
+	results := make(map[string]chan error)
+	for i, ds := range []*registry.DataStream{good, bad} {
+		v := float64(i)
+		pack := senml.Pack{{Name: ds.Name, Value: &v, Time: 1546300800}}
+		results[ds.Name] = make(chan error, 1)
+		done := results[ds.Name]
+		err := batch.Enqueue(map[string]senml.Pack{ds.Name: pack}, map[string]*registry.DataStream{ds.Name: ds}, func(err error) { done <- err }, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the submissions of the batch are written again one by one
+	if err := <-results[bad.Name]; err == nil {
+		t.Error("Expected the error of the failing submission")
+	}
+	if err := <-results[good.Name]; err != nil {
+		t.Errorf("Expected the other submission of the batch to be written, got %s", err)
+	}
+	_, total, _, err := memory.Query(data.Query{From: time.Unix(1546300800, 0), To: time.Unix(1546300801, 0), Sort: common.ASC, Limit: -1}, good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 {
+		t.Errorf("Expected the record of the other submission to be stored, got %d", total)
+	}
+}
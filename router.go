@@ -7,6 +7,8 @@ import (
 	"log"
 	"net/http"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/codegangsta/negroni"
@@ -14,9 +16,17 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/justinas/alice"
 	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/metrics"
 	"github.com/rs/cors"
 )
 
+var (
+	httpRequests = metrics.NewCounterVec("hds_http_requests_total",
+		"Number of HTTP requests per method, route and status.", "method", "route", "status")
+	httpDuration = metrics.NewHistogramVec("hds_http_request_duration_seconds",
+		"Latency of HTTP requests per method and route.", metrics.DefBuckets, "method", "route")
+)
+
 type router struct {
 	*mux.Router
 	alice.Chain
@@ -35,6 +45,7 @@ func newRouter() *router {
 	r.Chain = alice.New(
 		context.ClearHandler,
 		loggingHandler,
+		r.metricsHandler,
 		recoverHandler,
 		cors.AllowAll().Handler,
 	)
@@ -68,10 +79,56 @@ func loggingHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
+// metricsHandler counts the requests and measures their latency per route and status
+func (r *router) metricsHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		t1 := time.Now()
+		nw := negroni.NewResponseWriter(w)
+		next.ServeHTTP(nw, req)
+
+		route := "unmatched"
+		var match mux.RouteMatch
+		if r.Match(req, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				route = template
+				if len(route) > 1 {
+					route = strings.TrimSuffix(route, "/")
+				}
+			}
+		}
+		status := nw.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.Inc(req.Method, route, strconv.Itoa(status))
+		httpDuration.Observe(time.Since(t1).Seconds(), req.Method, route)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// exempt returns a middleware which skips the given middleware for requests to the path
+func exempt(path string, handler alice.Constructor) alice.Constructor {
+	return func(next http.Handler) http.Handler {
+		handled := handler(next)
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == path || r.URL.Path == path+"/" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			handled.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
 func recoverHandler(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if r := recover(); r != nil {
+				if r == http.ErrAbortHandler {
+					// the handler aborts a response which is already being sent
+					panic(r)
+				}
 				log.Printf("PANIC: %v\n%v", r, string(debug.Stack()))
 				http.Error(w, http.StatusText(500), 500)
 			}
@@ -0,0 +1,89 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/linksmart/historical-datastore/common"
+)
+
+// tlsReloader provides the TLS configuration of the HTTP server, which can be reloaded from the files while serving
+type tlsReloader struct {
+	sync.RWMutex
+	conf   common.HTTPTLSConf
+	config *tls.Config
+}
+
+func newTLSReloader(conf common.HTTPTLSConf) (*tlsReloader, error) {
+	r := &tlsReloader{conf: conf}
+	err := r.reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the certificate and the client CAs, keeping the previous ones on error
+func (r *tlsReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.conf.CertFile, r.conf.KeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		// the configuration replaces the one of the server for every connection, which offers HTTP/2
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	if r.conf.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.conf.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("error reading client CA file: %v", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file %s", r.conf.ClientCAFile)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.Lock()
+	r.config = config
+	r.Unlock()
+	return nil
+}
+
+// serverConfig returns a server configuration which uses the latest loaded configuration for every connection
+func (r *tlsReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.RLock()
+			defer r.RUnlock()
+			return r.config, nil
+		},
+	}
+}
+
+// reloadOnHangup reloads the configuration whenever the process receives SIGHUP
+func (r *tlsReloader) reloadOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		err := r.reload()
+		if err != nil {
+			log.Printf("Error reloading HTTP TLS configuration: %s", err)
+			continue
+		}
+		log.Println("Reloaded HTTP TLS configuration")
+	}
+}
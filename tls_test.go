@@ -0,0 +1,99 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/internal/testutil"
+)
+
+func TestTLSReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestTLSReloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := common.HTTPTLSConf{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server-key.pem"),
+		ClientCAFile: filepath.Join(dir, "client.pem"),
+	}
+	serverCert := testutil.WriteCertificate(t, conf.CertFile, conf.KeyFile, "server1")
+	testutil.WriteCertificate(t, conf.ClientCAFile, filepath.Join(dir, "client-key.pem"), "client")
+	clientCert, err := tls.LoadX509KeyPair(conf.ClientCAFile, filepath.Join(dir, "client-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloader, err := newTLSReloader(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", reloader.serverConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	// returns the name of the served certificate
+	get := func(trusted *x509.Certificate, certs ...tls.Certificate) (string, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(trusted)
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}}
+		res, err := client.Get("https://" + listener.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		res.Body.Close()
+		return res.TLS.PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	if _, err := get(serverCert); err == nil {
+		t.Fatalf("Expected the request without a client certificate to fail")
+	}
+	if name, err := get(serverCert, clientCert); err != nil || name != "server1" {
+		t.Fatalf("Expected the certificate server1, got %s: %v", name, err)
+	}
+
+	// HTTP/2 is negotiated
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+		t.Fatalf("Expected the protocol h2, got %q", proto)
+	}
+
+	// renew the server certificate
+	serverCert = testutil.WriteCertificate(t, conf.CertFile, conf.KeyFile, "server2")
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := get(serverCert, clientCert); err != nil || name != "server2" {
+		t.Fatalf("Expected the reloaded certificate server2, got %s: %v", name, err)
+	}
+
+	// invalid files keep the current configuration
+	ioutil.WriteFile(conf.CertFile, []byte("invalid"), 0600)
+	if err := reloader.reload(); err == nil {
+		t.Fatalf("Expected reloading an invalid certificate to fail")
+	}
+	if name, err := get(serverCert, clientCert); err != nil || name != "server2" {
+		t.Fatalf("Expected the previous certificate server2, got %s: %v", name, err)
+	}
+}